@@ -149,7 +149,7 @@ in the form:
 `
 	kingpin.Parse()
 
-	parser, err := participle.Build(&EBNF{}, nil)
+	parser, err := participle.Build(&EBNF{})
 	kingpin.FatalIfError(err, "")
 
 	ebnf := &EBNF{}
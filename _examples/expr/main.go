@@ -170,7 +170,7 @@ func main() {
 	kingpin.CommandLine.Help = "A basic expression parser and evaluator."
 	kingpin.Parse()
 
-	parser, err := participle.Build(&Expression{}, nil)
+	parser, err := participle.Build(&Expression{})
 	kingpin.FatalIfError(err, "")
 
 	expr := &Expression{}
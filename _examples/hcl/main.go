@@ -74,7 +74,7 @@ type Config struct {
 func main() {
 	kingpin.Parse()
 
-	parser, err := participle.Build(&Config{}, nil)
+	parser, err := participle.Build(&Config{})
 	kingpin.FatalIfError(err, "")
 
 	expr := &Config{}
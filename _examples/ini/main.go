@@ -41,7 +41,7 @@ type Value struct {
 }
 
 func main() {
-	parser, err := participle.Build(&INI{}, iniLexer)
+	parser, err := participle.Build(&INI{}, participle.UseLexer(iniLexer))
 	if err != nil {
 		panic(err)
 	}
@@ -17,7 +17,7 @@ var (
 		`|(?P<String>'[^']*'|"[^"]*")`+
 		`|(?P<Operators><>|!=|<=|>=|[-+*/%,.()=<>])`,
 	)), "Keyword"), "String")
-	sqlParser = participle.MustBuild(&Select{}, sqlLexer)
+	sqlParser = participle.MustBuild(&Select{}, participle.UseLexer(sqlLexer))
 )
 
 type Boolean bool
@@ -62,7 +62,7 @@ type AliasedExpression struct {
 }
 
 type Expression struct {
-	And *AndCondition `@@ { "OR" @@ }`
+	And []*AndCondition `@@ { "OR" @@ }`
 }
 
 type AndCondition struct {
@@ -1,6 +1,8 @@
 package participle
 
 import (
+	"context"
+
 	"github.com/peterebden/participle/lexer"
 )
 
@@ -9,11 +11,60 @@ type Capture interface {
 	Capture(values []string) error
 }
 
+// ContextCapture is like Capture, but also receives the context passed to Parser.ParseContext().
+//
+// This allows captures to share state across a single parse, such as a symbol table.
+type ContextCapture interface {
+	CaptureContext(ctx context.Context, values []string) error
+}
+
+// PositionCapture is like Capture, but also receives the position of the first captured token.
+//
+// This allows a capture to report exactly where a value is invalid, by returning a *lexer.Error,
+// which is reported as is. Other errors are reported at pos.
+type PositionCapture interface {
+	CapturePosition(pos lexer.Position, values []string) error
+}
+
+// Appender can be implemented by slice types that maintain invariants, such as ordering or
+// uniqueness, as elements are added.
+//
+// When a slice field's type implements Appender, Append is called with each captured value
+// (converted to the slice's element type) in place of appending to the slice directly.
+type Appender interface {
+	Append(value interface{}) error
+}
+
+// Initializer can be implemented by grammar structs to set up internal state, such as maps or
+// defaults, after allocation and before any fields are parsed into them.
+type Initializer interface {
+	Init()
+}
+
+// PosSetter can be implemented by grammar structs to receive the position at which they start, eg.
+// to store it privately or in a type wrapping lexer.Position. It takes the place of injecting the
+// position into a "Pos" or lexer.Position field.
+type PosSetter interface {
+	SetPos(pos lexer.Position)
+}
+
 // The Parseable interface can be implemented by any element in the grammar to provide custom parsing.
+//
+// It may be implemented by a type of any kind, not just structs, eg. `type Args []lexer.Token`, in
+// which case a field of that type captured with `@@` is parsed by it, controlling exactly which
+// tokens the field consumes.
 type Parseable interface {
 	// Parse into the receiver.
 	//
 	// Should return NextMatch if no tokens matched and parsing should continue.
 	// Nil should be returned if parsing was successful.
+	//
+	// Any other error fails the parse. A *lexer.Error, eg. from lexer.Errorf, is returned by the
+	// Parser as is, so may report exactly where the input is invalid, while other errors are
+	// reported at the position of the first token the implementation was given.
+	//
+	// lex is a lexer.Checkpointer, so an implementation may backtrack over tokens it has consumed.
+	// Any tokens consumed are restored when NextMatch is returned. It is also a lexer.Lookahead,
+	// so an implementation may decide whether to match from several tokens ahead.
 	Parse(lex lexer.Lexer) error
 }
@@ -0,0 +1,379 @@
+package participle
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/peterebden/participle/lexer"
+)
+
+// parseContext holds the state of a single parse.
+//
+// It also acts as a Lexer, buffering all tokens read from the underlying Lexer so that the parse
+// can checkpoint and later restore its position, or retrieve the tokens consumed between two
+// checkpoints.
+type parseContext struct {
+	lexer   lexer.Lexer
+	context context.Context
+	tokens  []lexer.Token
+	cursor  int
+	// Names of the productions currently being parsed, innermost last.
+	productions []string
+	// If non-nil, records the grammar constructs that matched.
+	coverage map[interface{}]bool
+	// The complete input, if retained.
+	source []byte
+	// Productions that must not match.
+	disabled map[string]bool
+	// Maximum number of tokens a failed alternative may consume and still be backtracked.
+	maxBacktrack int
+	// The error from the furthest position reached by a backtracked alternative, if any.
+	furthest       *lexer.Error
+	furthestCursor int
+	// Report syntax errors by setting err and returning no match, rather than panicking.
+	returnErrors bool
+	// The syntax error that failed the parse, if any.
+	err *lexer.Error
+	// Location of times captured without a zone, if not UTC.
+	location *time.Location
+	// The structs being parsed that have fields with defaults, innermost last.
+	assigned []assignedFields
+	// Conversions of captured tokens to values of particular types.
+	converters map[reflect.Type]Converter
+	// If non-nil, recover from syntax errors in elements of repetitions by skipping past the next
+	// of these tokens.
+	syncTokens map[string]bool
+	// The syntax errors recovered from.
+	recovered []*lexer.Error
+	// Permit input to remain once the grammar has matched.
+	allowTrailing bool
+	// If non-nil, set to the offset of the first token not consumed by a successful parse.
+	consumed *int
+	// If non-nil, the results of parsing productions at each position, keyed by production and
+	// cursor.
+	memo map[memoKey]memoEntry
+	// The fields each node of the grammar may capture into.
+	snapshots snapshotFields
+}
+
+type memoKey struct {
+	node   node
+	cursor int
+}
+
+// The result of parsing a production, and the cursor it left the parse at.
+type memoEntry struct {
+	out []reflect.Value
+	err *lexer.Error
+	end int
+}
+
+func newParseContext(ctx context.Context, lex lexer.Lexer) *parseContext {
+	return &parseContext{lexer: lex, context: ctx}
+}
+
+func (p *parseContext) Peek() lexer.Token {
+	return p.PeekN(0)
+}
+
+// PeekN implements lexer.Lookahead.
+func (p *parseContext) PeekN(n int) lexer.Token {
+	for p.cursor+n >= len(p.tokens) {
+		if len(p.tokens) > p.cursor && p.tokens[len(p.tokens)-1].EOF() {
+			return p.tokens[len(p.tokens)-1]
+		}
+		p.tokens = append(p.tokens, p.lexer.Next())
+	}
+	return p.tokens[p.cursor+n]
+}
+
+func (p *parseContext) Next() lexer.Token {
+	token := p.Peek()
+	if !token.EOF() {
+		p.cursor++
+	}
+	return token
+}
+
+// Check that the input was consumed entirely, unless trailing input is allowed, recording the
+// offset the parse stopped at.
+func (p *parseContext) finish() error {
+	peek := p.Peek()
+	if !peek.EOF() && !p.allowTrailing {
+		return p.errorf(peek.Pos, "unexpected token %q", peek)
+	}
+	if p.consumed != nil {
+		*p.consumed = peek.Pos.Offset
+	}
+	return nil
+}
+
+// Returns a checkpoint that the parse can later be restored to.
+func (p *parseContext) checkpoint() int {
+	return p.cursor
+}
+
+// Restore the parse to a checkpoint.
+func (p *parseContext) restore(checkpoint int) {
+	p.cursor = checkpoint
+}
+
+// Checkpoint implements lexer.Checkpointer.
+func (p *parseContext) Checkpoint() int {
+	return p.checkpoint()
+}
+
+// Restore implements lexer.Checkpointer.
+func (p *parseContext) Restore(checkpoint int) {
+	if checkpoint < 0 || checkpoint > len(p.tokens) {
+		panic("invalid checkpoint")
+	}
+	p.restore(checkpoint)
+}
+
+// Returns the tokens consumed since checkpoint.
+func (p *parseContext) consumedSince(checkpoint int) []lexer.Token {
+	return append([]lexer.Token(nil), p.tokens[checkpoint:p.cursor]...)
+}
+
+// The fields of a struct being parsed that values have been captured into.
+type assignedFields struct {
+	strct  reflect.Value
+	fields map[string]bool
+}
+
+// Record that a value was captured into field of strct, so that it does not receive its default.
+func (p *parseContext) assign(strct reflect.Value, field reflect.StructField) {
+	if len(p.assigned) == 0 || !strct.CanAddr() {
+		return
+	}
+	top := p.assigned[len(p.assigned)-1]
+	if top.strct.Type() == strct.Type() && top.strct.UnsafeAddr() == strct.UnsafeAddr() {
+		top.fields[field.Name] = true
+	}
+}
+
+// Enter a production. Must be paired with a call to leave().
+func (p *parseContext) enter(production string) {
+	p.productions = append(p.productions, production)
+}
+
+// Leave the innermost production.
+func (p *parseContext) leave() {
+	p.productions = p.productions[:len(p.productions)-1]
+}
+
+// Panicf throws an *lexer.Error naming the production currently being parsed.
+//
+// If a backtracked alternative previously failed further into the input, its error is thrown
+// instead, as it is likely closer to the cause of the failure.
+func (p *parseContext) Panicf(pos lexer.Position, format string, args ...interface{}) {
+	panic(p.errorf(pos, format, args...))
+}
+
+// Fail the parse with a syntax error.
+//
+// If returning errors, the error is recorded and the caller must return nil, as must every node
+// above it on seeing failed(). Otherwise this is Panicf().
+func (p *parseContext) fail(pos lexer.Position, format string, args ...interface{}) {
+	p.raise(p.errorf(pos, format, args...))
+}
+
+// Fail the parse with a syntax error at the next token, which n could not start with.
+func (p *parseContext) failExpected(n node) {
+	token := p.Peek()
+	err := p.errorf(token.Pos, "%s but got %q", expected(n), token)
+	if err != p.furthest {
+		err.Expected = expectedItems(n)
+	}
+	p.raise(err)
+}
+
+// Fail the parse with err, as for fail().
+func (p *parseContext) raise(err *lexer.Error) {
+	if !p.returnErrors {
+		panic(err)
+	}
+	p.err = err
+}
+
+// Returns true if the parse has failed with an error recorded by fail().
+func (p *parseContext) failed() bool {
+	return p.err != nil
+}
+
+func (p *parseContext) errorf(pos lexer.Position, format string, args ...interface{}) *lexer.Error {
+	if p.furthest != nil && p.furthestCursor > p.cursor {
+		return p.furthest
+	}
+	if len(p.productions) > 0 {
+		format = "while parsing " + p.productions[len(p.productions)-1] + ": " + format
+	}
+	return lexer.Errorf(pos, format, args...)
+}
+
+// Record that a grammar construct matched, if coverage is being collected.
+func (p *parseContext) cover(key interface{}) {
+	if p.coverage != nil {
+		p.coverage[key] = true
+	}
+}
+
+// Parse n, backtracking to the current position if it fails having consumed no more than
+// maxBacktrack tokens.
+//
+// Any values already captured into parent by n are discarded on backtracking.
+func (p *parseContext) backtrack(n node, parent reflect.Value) (out []reflect.Value) {
+	start := p.checkpoint()
+	saved := p.snapshot(snapshotKey(n), parent)
+	defer func() {
+		if msg := recover(); msg != nil {
+			err, ok := msg.(*lexer.Error)
+			if !ok || p.cursor-start > p.maxBacktrack {
+				panic(msg)
+			}
+			p.abandon(err, start)
+			saved.restore()
+			out = nil
+		}
+	}()
+	out = n.Parse(p, parent)
+	if out == nil {
+		if p.failed() && p.cursor-start <= p.maxBacktrack {
+			p.abandon(p.err, start)
+			p.err = nil
+		}
+		saved.restore()
+	}
+	return out
+}
+
+// Returns the result of parse for n at the current position, parsing it only the first time n is
+// parsed at that position.
+//
+// Syntax errors are memoized and raised again, so that an alternative backtracked over fails
+// without being parsed again, while results are not memoized once the parse has failed.
+func (p *parseContext) memoize(n node, parse func() []reflect.Value) (out []reflect.Value) {
+	key := memoKey{node: n, cursor: p.cursor}
+	if entry, ok := p.memo[key]; ok {
+		p.cursor = entry.end
+		if entry.err != nil {
+			panic(entry.err)
+		}
+		return entry.out
+	}
+	defer func() {
+		if msg := recover(); msg != nil {
+			if err, ok := msg.(*lexer.Error); ok {
+				p.memo[key] = memoEntry{err: err, end: p.cursor}
+			}
+			panic(msg)
+		}
+	}()
+	out = parse()
+	if !p.failed() {
+		p.memo[key] = memoEntry{out: out, end: p.cursor}
+	}
+	return out
+}
+
+// Returns true if n matches at the current position, without consuming any input or capturing
+// any values into parent.
+//
+// A partial match that fails is treated as not matching.
+func (p *parseContext) lookahead(n node, parent reflect.Value) (matched bool) {
+	start := p.checkpoint()
+	saved := p.snapshot(snapshotKey(n), parent)
+	defer func() {
+		if msg := recover(); msg != nil {
+			if _, ok := msg.(*lexer.Error); !ok {
+				panic(msg)
+			}
+			matched = false
+		}
+		p.err = nil
+		p.restore(start)
+		saved.restore()
+	}()
+	return n.Parse(p, parent) != nil && !p.failed()
+}
+
+// Parse n as an element of a repetition.
+//
+// When recovering from syntax errors and n fails with one, the error is recorded, any values n
+// captured into parent are discarded, and tokens up to and including the next synchronisation
+// token are skipped. The result is then an empty match, so that the repetition continues.
+func (p *parseContext) recoverable(n node, parent reflect.Value) (out []reflect.Value) {
+	if p.syncTokens == nil {
+		return n.Parse(p, parent)
+	}
+	saved := p.snapshot(snapshotKey(n), parent)
+	defer func() {
+		if msg := recover(); msg != nil {
+			err, ok := msg.(*lexer.Error)
+			if !ok {
+				panic(msg)
+			}
+			out = p.resynchronise(err, saved)
+		}
+	}()
+	out = n.Parse(p, parent)
+	if out == nil && p.failed() {
+		err := p.err
+		p.err = nil
+		out = p.resynchronise(err, saved)
+	}
+	return out
+}
+
+// Record err and skip past the next synchronisation token, undoing the captures made since saved.
+func (p *parseContext) resynchronise(err *lexer.Error, saved snapshot) []reflect.Value {
+	p.recovered = append(p.recovered, err)
+	p.furthest = nil
+	saved.restore()
+	for token := p.Peek(); !token.EOF(); token = p.Peek() {
+		p.Next()
+		if p.syncTokens[token.Value] {
+			break
+		}
+	}
+	return []reflect.Value{}
+}
+
+// Abandon an alternative that failed with err, restoring the parse to start.
+func (p *parseContext) abandon(err *lexer.Error, start int) {
+	if p.furthest == nil || p.cursor >= p.furthestCursor {
+		p.furthest = err
+		p.furthestCursor = p.cursor
+	}
+	p.restore(start)
+}
+
+// Returns the source text spanning the tokens consumed since checkpoint, with interior whitespace
+// intact.
+func (p *parseContext) sourceSince(checkpoint int) string {
+	if checkpoint == p.cursor {
+		return ""
+	}
+	start := p.tokens[checkpoint].Pos.Offset
+	end := p.Peek().Pos.Offset
+	if p.Peek().EOF() {
+		end = len(p.source)
+	}
+	return strings.TrimSpace(string(p.source[start:end]))
+}
+
+// Returns a context that parses only the given tokens, followed by an EOF at eof.
+func (p *parseContext) sub(tokens []lexer.Token, eof lexer.Position) *parseContext {
+	sub := *p
+	sub.tokens = append(append([]lexer.Token(nil), tokens...), lexer.Token{Type: lexer.EOF, Pos: eof})
+	sub.cursor = 0
+	sub.furthest = nil
+	// Cursors index the sub-context's own tokens, so its results can not share the memo.
+	if p.memo != nil {
+		sub.memo = map[memoKey]memoEntry{}
+	}
+	return &sub
+}
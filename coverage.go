@@ -0,0 +1,99 @@
+package participle
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Coverage records which parts of a grammar are exercised across a series of parses.
+//
+// This is the grammar equivalent of code coverage, and is useful for finding alternatives,
+// optional elements and repetitions that are never matched by a test suite.
+//
+// Like a Parser, a Coverage may be used by multiple goroutines concurrently.
+type Coverage struct {
+	parser  *Parser
+	mu      sync.Mutex
+	covered map[interface{}]bool
+}
+
+// Identifies a single alternative of a disjunction.
+type alternativeKey struct {
+	disjunction *node
+	index       int
+}
+
+// Coverage returns a new coverage collector for the grammar.
+func (p *Parser) Coverage() *Coverage {
+	return &Coverage{parser: p, covered: map[interface{}]bool{}}
+}
+
+// Parse is like Parser.Parse, but records the grammar constructs that matched.
+func (c *Coverage) Parse(r io.Reader, v interface{}, options ...ParseOption) (err error) {
+	defer func() {
+		if msg := recover(); msg != nil {
+			err = fmt.Errorf("%s", msg)
+		}
+	}()
+	ctx, err := c.parser.newParseContext(context.Background(), r, options)
+	if err != nil {
+		return err
+	}
+	// Each parse records into its own map, merged once it completes.
+	ctx.coverage = map[interface{}]bool{}
+	defer c.merge(ctx.coverage)
+	return c.parser.parse(ctx, v)
+}
+
+func (c *Coverage) merge(covered map[interface{}]bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range covered {
+		c.covered[key] = true
+	}
+}
+
+// ParseString is a convenience around Parse().
+func (c *Coverage) ParseString(s string, v interface{}, options ...ParseOption) error {
+	return c.Parse(strings.NewReader(s), v, options...)
+}
+
+// ParseBytes is a convenience around Parse().
+func (c *Coverage) ParseBytes(b []byte, v interface{}, options ...ParseOption) error {
+	return c.Parse(bytes.NewReader(b), v, options...)
+}
+
+// Uncovered returns a description of each production, alternative, optional element and
+// repetition that has not matched in any parse so far, prefixed by the enclosing production.
+// Constructs are described in the notation of Parser.PEG().
+func (c *Coverage) Uncovered() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := []string{}
+	peg := &pegWriter{seen: map[*strct]bool{}}
+	visitProductions(c.parser.root, func(production string, n node) {
+		switch n := n.(type) {
+		case *strct:
+			if !c.covered[n] {
+				out = append(out, fmt.Sprintf("%s: never matched", production))
+			}
+
+		case disjunction:
+			for i, alt := range n {
+				if !c.covered[alternativeKey{&n[0], i}] {
+					out = append(out, fmt.Sprintf("%s: alternative %s never matched", production, peg.node(alt)))
+				}
+			}
+
+		case *optional, *repetition:
+			if !c.covered[n] {
+				out = append(out, fmt.Sprintf("%s: %s never matched", production, peg.node(n)))
+			}
+		}
+	})
+	return out
+}
@@ -6,8 +6,10 @@
 //
 //     - `@<expr>` Capture expression into the field.
 //     - `@@` Recursively capture using the fields own type.
+//     - `@<field>=<expr>` Capture expression into another field of the same struct.
 //     - `<identifier>` Match named lexer token.
 //     - `{ ... }` Match 0 or more times.
+//     - `<expr>+` Match 1 or more times.
 //     - `( ... )` Group.
 //     - `[ ... ]` Optional.
 //     - `"..."[:<identifier>]` Match the literal, optionally specifying the exact lexer token
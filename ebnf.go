@@ -0,0 +1,209 @@
+package participle
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// EBNF returns the grammar in the Extended Backus-Naur Form accepted by lexer.EBNF, eg.
+// `Sum = Term { "+" Term } .`.
+//
+// Each struct type is emitted as a production named after the type, preceded by a comment
+// containing its `doc` tag, if any. EBNF has no equivalent of lookahead or of matching any token,
+// so these are rendered as comments, while unordered groups are rendered as a repetition of their
+// terms, which accepts a superset of the group.
+func (p *Parser) EBNF() string {
+	w := &ebnfWriter{seen: map[*strct]bool{}}
+	w.production(p.root)
+	return strings.Join(w.out, "\n") + "\n"
+}
+
+type ebnfWriter struct {
+	seen    map[*strct]bool
+	pending []*strct
+	out     []string
+}
+
+func (w *ebnfWriter) production(root node) {
+	if s, ok := root.(*strct); ok {
+		w.ref(s)
+	} else {
+		w.out = append(w.out, "Grammar = "+w.node(root)+" .")
+	}
+	for len(w.pending) > 0 {
+		s := w.pending[0]
+		w.pending = w.pending[1:]
+		if s.doc != "" {
+			w.out = append(w.out, "// "+s.doc)
+		}
+		expr := w.node(s.expr)
+		if s.binary != nil {
+			ops := []string{}
+			for _, op := range s.binary.operators {
+				ops = append(ops, strconv.Quote(op))
+			}
+			// EBNF can not express precedence, which is resolved by the parser.
+			operand := w.operand(s.expr)
+			expr = fmt.Sprintf("%s { ( %s ) %s }", operand, strings.Join(ops, " | "), operand)
+		}
+		w.out = append(w.out, fmt.Sprintf("%s = %s .", pegName(s), expr))
+	}
+}
+
+func (w *ebnfWriter) ref(s *strct) string {
+	if !w.seen[s] {
+		w.seen[s] = true
+		w.pending = append(w.pending, s)
+	}
+	return pegName(s)
+}
+
+func (w *ebnfWriter) node(n node) string { // nolint: gocyclo
+	switch n := n.(type) {
+	case disjunction:
+		out := []string{}
+		for _, c := range n {
+			out = append(out, w.node(c))
+		}
+		return strings.Join(out, " | ")
+
+	case sequence:
+		out := []string{}
+		for _, c := range n {
+			out = append(out, w.operand(c))
+		}
+		return strings.Join(out, " ")
+
+	case *strct:
+		return w.ref(n)
+
+	case *parseable:
+		return n.t.Elem().Name()
+
+	case *reference:
+		return w.node(n.node)
+
+	case *unary:
+		ops := []string{}
+		for op := range n.ops {
+			ops = append(ops, strconv.Quote(op))
+		}
+		sort.Strings(ops)
+		return "{ " + strings.Join(ops, " | ") + " }"
+
+	case *path:
+		return fmt.Sprintf("Ident { %q Ident }", n.sep)
+
+	case *keyed:
+		return fmt.Sprintf("{ Ident %q /* any token */ }", n.sep)
+
+	case *factory:
+		sep := ""
+		if n.sep != "" {
+			sep = " " + strconv.Quote(n.sep)
+		}
+		out := []string{}
+		for _, discriminator := range n.discriminators() {
+			out = append(out, strconv.Quote(discriminator)+sep+" "+w.operand(n.types[discriminator]))
+		}
+		return "( " + strings.Join(out, " | ") + " )"
+
+	case *lookahead:
+		return "/* followed by " + w.node(n.node) + " */"
+
+	case *negation:
+		return "/* any token but " + w.node(n.node) + " */"
+
+	case *atLeastOne:
+		// EBNF can not require that at least one of the elements matches.
+		out := []string{}
+		for _, c := range n.elements {
+			out = append(out, w.operand(c))
+		}
+		return strings.Join(out, " ")
+
+	case *unordered:
+		out := []string{}
+		for _, c := range n.bodies {
+			out = append(out, w.node(c))
+		}
+		return "{ " + strings.Join(out, " | ") + " }"
+
+	case *labelled:
+		return w.node(n.node)
+
+	case *balanced:
+		return fmt.Sprintf("%q %s %q", n.open, w.operand(n.node), n.close)
+
+	case *nested:
+		return fmt.Sprintf("{ Ident { %q Ident } \"=\" /* any token */ }", n.sep)
+
+	case *tokenReference:
+		return n.identifier
+
+	case *literal:
+		return strconv.Quote(n.s)
+
+	case *optional:
+		return "[ " + w.node(n.node) + " ]"
+
+	case *repetition:
+		return w.repetition(n)
+	}
+	panic(fmt.Sprintf("unsupported node type %T", n))
+}
+
+// Render a repetition, spelling out any bounds, eg. `{ x }2,3` as `x x [ x ]` and `{ x % "," }`
+// as `[ x { "," x } ]`.
+func (w *ebnfWriter) repetition(n *repetition) string {
+	elem := w.operand(n.node)
+	rest := elem
+	if n.separator != nil {
+		rest = w.operand(n.separator) + " " + elem
+	}
+	if n.separator == nil && n.max == 0 && n.min == 0 {
+		return "{ " + w.node(n.node) + " }"
+	}
+	// The first match is not preceded by a separator.
+	out := []string{elem}
+	min := n.min
+	if min == 0 {
+		min = 1
+	}
+	for i := 1; i < min; i++ {
+		out = append(out, rest)
+	}
+	if n.max == 0 {
+		out = append(out, "{ "+rest+" }")
+	}
+	for i := min; i < n.max; i++ {
+		out = append(out, "[ "+rest+" ]")
+	}
+	if n.trailing {
+		out = append(out, "[ "+w.node(n.separator)+" ]")
+	}
+	if n.min == 0 {
+		return "[ " + strings.Join(out, " ") + " ]"
+	}
+	return strings.Join(out, " ")
+}
+
+// Render a node as an element of a sequence, grouping it if necessary.
+func (w *ebnfWriter) operand(n node) string {
+	inner := n
+	for {
+		switch c := inner.(type) {
+		case *reference:
+			inner = c.node
+			continue
+		case *labelled:
+			inner = c.node
+			continue
+		case disjunction:
+			return "( " + w.node(n) + " )"
+		}
+		return w.node(n)
+	}
+}
@@ -0,0 +1,159 @@
+package participle
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Returns a human readable summary of the tokens that n can start with, eg.
+// `expected one of "+", "-" or a Number`.
+func expected(n node) string {
+	items := expectedItems(n)
+	switch len(items) {
+	case 0:
+		return "unexpected input"
+	case 1:
+		return "expected " + items[0]
+	case 2:
+		return "expected " + items[0] + " or " + items[1]
+	}
+	return "expected one of " + strings.Join(items[:len(items)-1], ", ") + " or " + items[len(items)-1]
+}
+
+// Returns descriptions of each of the tokens that n can start with, eg. `"+"` or `a Number`.
+func expectedItems(n node) []string {
+	literals, types, others := firstSet(n)
+	items := []string{}
+	for _, literal := range literals {
+		items = append(items, strconv.Quote(literal))
+	}
+	for _, typ := range types {
+		items = append(items, article(typ)+" "+typ)
+	}
+	return append(items, others...)
+}
+
+func article(name string) string {
+	if name != "" && strings.ContainsRune("AEIOUaeiou", rune(name[0])) {
+		return "an"
+	}
+	return "a"
+}
+
+// Returns the sorted, de-duplicated literals and token type names that n can start with, and
+// descriptions of any other tokens it can start with.
+func firstSet(n node) (literals []string, types []string, others []string) {
+	literalSet := map[string]bool{}
+	typeSet := map[string]bool{}
+	otherSet := map[string]bool{}
+	seen := map[*strct]bool{}
+	var first func(n node) (empty bool)
+	// Adds the tokens n can start with, returning true if n can match without consuming input.
+	first = func(n node) bool {
+		switch n := n.(type) {
+		case disjunction:
+			empty := false
+			for _, alt := range n {
+				if first(alt) {
+					empty = true
+				}
+			}
+			return empty
+
+		case sequence:
+			for _, child := range n {
+				if !first(child) {
+					return false
+				}
+			}
+			return true
+
+		case *strct:
+			if seen[n] {
+				return false
+			}
+			seen[n] = true
+			return first(n.expr)
+
+		case *reference:
+			return first(n.node)
+
+		case *labelled:
+			return first(n.node)
+
+		case *atLeastOne:
+			for _, child := range n.elements {
+				first(child)
+			}
+			return false
+
+		case *unordered:
+			empty := true
+			for i, body := range n.bodies {
+				if !first(body) && n.required[i] {
+					empty = false
+				}
+			}
+			return empty
+
+		case *optional:
+			first(n.node)
+			return true
+
+		case *repetition:
+			return first(n.node) || n.min == 0
+
+		case *literal:
+			literalSet[n.s] = true
+
+		case *balanced:
+			literalSet[n.open] = true
+
+		case *tokenReference:
+			typeSet[n.identifier] = true
+
+		case *unary:
+			for op := range n.ops {
+				literalSet[op] = true
+			}
+			return true
+
+		case *path:
+			typeSet["Ident"] = true
+
+		case *keyed, *nested:
+			typeSet["Ident"] = true
+			return true
+
+		case *parseable:
+			typeSet[n.t.Elem().Name()] = true
+
+		case *factory:
+			for discriminator := range n.types {
+				literalSet[discriminator] = true
+			}
+
+		case *lookahead:
+			return first(n.node)
+
+		case *negation:
+			otherSet["any token other than "+strings.TrimPrefix(expected(n.node), "expected ")] = true
+		}
+		return false
+	}
+	first(n)
+	for literal := range literalSet {
+		literals = append(literals, literal)
+	}
+	for typ := range typeSet {
+		types = append(types, typ)
+	}
+	for other := range otherSet {
+		others = append(others, other)
+	}
+	sort.Strings(literals)
+	sort.Strings(types)
+	sort.Strings(others)
+	return literals, types, others
+}
@@ -3,6 +3,8 @@ package participle
 import (
 	"fmt"
 	"reflect"
+	"strconv"
+	"strings"
 	"text/scanner"
 
 	"github.com/peterebden/participle/lexer"
@@ -11,15 +13,37 @@ import (
 type generatorContext struct {
 	lexer.Definition
 	typeNodes map[reflect.Type]node
+	// Macros defined by the structs parsed so far.
+	macros macros
+	// The grammars of the types registered for each interface by the Factory option, by
+	// discriminator.
+	factories map[reflect.Type]map[string]node
 }
 
 func newGeneratorContext(lex lexer.Definition) *generatorContext {
-	return &generatorContext{Definition: lex, typeNodes: map[reflect.Type]node{}}
+	return &generatorContext{
+		Definition: lex,
+		typeNodes:  map[reflect.Type]node{},
+		macros:     macros{},
+		factories:  map[reflect.Type]map[string]node{},
+	}
+}
+
+// Returns the registry of types for an interface.
+func (g *generatorContext) factory(iface reflect.Type) map[string]node {
+	registry, ok := g.factories[iface]
+	if !ok {
+		registry = map[string]node{}
+		g.factories[iface] = registry
+	}
+	return registry
 }
 
 // Takes a type and builds a tree of nodes out of it.
 func (g *generatorContext) parseType(t reflect.Type) node {
-	rt := t
+	if pt, ok := findParseable(t); ok {
+		return &parseable{pt}
+	}
 	t = indirectType(t)
 	defer decorate(t.Name())
 	if n, ok := g.typeNodes[t]; ok {
@@ -31,12 +55,23 @@ func (g *generatorContext) parseType(t reflect.Type) node {
 		fallthrough
 
 	case reflect.Struct:
-		if rt.Implements(parseableType) {
-			return &parseable{rt}
-		}
 		out := &strct{typ: t}
+		if f, ok := t.FieldByName("Tokens"); ok && f.Type == tokensType {
+			out.tokensIndex = f.Index
+		}
+		out.doc = productionDoc(t)
+		out.posFields = positionFields(t)
+		out.posSetter = reflect.PtrTo(t).Implements(posSetterType)
+		if f, ok := t.FieldByName("EndPos"); ok && f.Type == positionType {
+			out.endPosIndex = f.Index
+		}
+		out.defaults = defaultFields(t)
+		out.binary = binaryOperators(t)
+		validateCounts(t)
+		validatePositions(t)
 		g.typeNodes[t] = out
-		slexer := lexStruct(t)
+		g.macros.define(t)
+		slexer := lexStruct(t, g.macros)
 		defer func() {
 			if msg := recover(); msg != nil {
 				panic(fmt.Sprintf("%s: %s", slexer.Field().Name, msg))
@@ -44,7 +79,7 @@ func (g *generatorContext) parseType(t reflect.Type) node {
 		}()
 		e := g.parseExpression(slexer)
 		if !slexer.Peek().EOF() {
-			panic("unexpected input " + slexer.Peek().Value)
+			panic("unexpected input " + describeToken(slexer.Peek()))
 		}
 		out.expr = e
 		return out
@@ -52,6 +87,214 @@ func (g *generatorContext) parseType(t reflect.Type) node {
 	panic("expected struct type but got " + t.String())
 }
 
+// Returns a pointer to the first of t, or the types t is a pointer to or slice of, implementing
+// Parseable, eg. *Args for a field of type []Args.
+func findParseable(t reflect.Type) (reflect.Type, bool) {
+	for {
+		if pt := reflect.PtrTo(t); pt.Implements(parseableType) {
+			return pt, true
+		}
+		if t.Kind() != reflect.Ptr && t.Kind() != reflect.Slice {
+			return nil, false
+		}
+		t = t.Elem()
+	}
+}
+
+// Returns the indexes of the lexer.Position fields of t that the start position of a production
+// is injected into. A field named "Pos" takes precedence, followed by any other fields of type
+// lexer.Position other than "EndPos", which receives the end position, and those named by
+// `positions` tags, in declaration order.
+func positionFields(t reflect.Type) [][]int {
+	out := [][]int{}
+	targets := positionTargets(t)
+	if f, ok := t.FieldByName("Pos"); ok && f.Type == positionType && !targets["Pos"] {
+		out = append(out, f.Index)
+	}
+	for _, f := range grammarFields(t) {
+		if f.Type == positionType && f.Name != "Pos" && f.Name != "EndPos" && !targets[f.Name] {
+			out = append(out, f.Index)
+		}
+	}
+	return out
+}
+
+// Returns the fields of t tagged with `default:"<value>"`, if any, checking that the defaults of
+// fields of the built-in numeric types are numbers.
+func defaultFields(t reflect.Type) (out []reflect.StructField) {
+	for _, field := range grammarFields(t) {
+		value, ok := field.Tag.Lookup("default")
+		if !ok {
+			continue
+		}
+		var err error
+		ft := indirectType(field.Type)
+		switch ft.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			_, err = strconv.ParseInt(value, 0, 64)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			_, err = strconv.ParseUint(value, 0, 64)
+		case reflect.Float32, reflect.Float64:
+			_, err = strconv.ParseFloat(value, 64)
+		}
+		// Named types, eg. time.Duration, may be converted other than as numbers.
+		if err != nil && ft.PkgPath() == "" {
+			panicf("%s: invalid default %q", field.Name, value)
+		}
+		out = append(out, field)
+	}
+	return out
+}
+
+// Check that fields tagged with `count:"<field>"` name an integer field of the same struct.
+func validateCounts(t reflect.Type) {
+	for _, field := range grammarFields(t) {
+		name, ok := field.Tag.Lookup("count")
+		if !ok {
+			continue
+		}
+		count, ok := t.FieldByName(name)
+		if !ok {
+			panicf("%s: unknown count field %q", field.Name, name)
+		}
+		switch count.Type.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		default:
+			panicf("%s: count field %q must be an integer", field.Name, name)
+		}
+	}
+}
+
+// Returns the binary operators declared by a field of t tagged with
+// `binary:"<op> <op> ... ; <op> ...  :right"`, if any.
+//
+// Levels of operators are separated by semicolons, lowest precedence first, and are left
+// associative unless they end with ":right". The operators combine values of t into its "Left"
+// and "Right" fields, both of type *t.
+func binaryOperators(t reflect.Type) *binary {
+	var out *binary
+	for _, field := range grammarFields(t) {
+		tag, ok := field.Tag.Lookup("binary")
+		if !ok {
+			continue
+		}
+		if out != nil {
+			panicf("%s: only one field may be tagged with binary operators", field.Name)
+		}
+		if field.Type.Kind() != reflect.String {
+			panicf("%s: binary operators can only be captured into string fields", field.Name)
+		}
+		out = &binary{op: field, precedence: map[string]int{}}
+		for level, ops := range strings.Split(tag, ";") {
+			words := strings.Fields(ops)
+			right := len(words) > 0 && words[len(words)-1] == ":right"
+			if right {
+				words = words[:len(words)-1]
+			}
+			if len(words) == 0 {
+				panicf("%s: no operators at precedence level %d", field.Name, level+1)
+			}
+			for _, op := range words {
+				if _, ok := out.precedence[op]; ok {
+					panicf("%s: duplicate binary operator %q", field.Name, op)
+				}
+				out.precedence[op] = level
+				out.operators = append(out.operators, op)
+			}
+			out.rightAssoc = append(out.rightAssoc, right)
+		}
+		for _, name := range []string{"Left", "Right"} {
+			f, ok := t.FieldByName(name)
+			if !ok || f.Type != reflect.PtrTo(t) {
+				panicf("%s: binary operators require a %s field of type *%s", field.Name, name, t.Name())
+			}
+			if name == "Left" {
+				out.left = f.Index
+			} else {
+				out.right = f.Index
+			}
+		}
+	}
+	return out
+}
+
+// Checks that productions captured repeatedly by the grammar of s, eg. with `{ @@ }`, are captured
+// into fields that can hold more than one, rather than each replacing the last.
+//
+// Tokens may be captured repeatedly into any field, as strings concatenate them and numeric fields
+// count them.
+func validateRepeatedCaptures(s *strct) {
+	defer decorate(s.typ.Name())
+	validateRepeated(s.expr, false)
+}
+
+func validateRepeated(n node, repeated bool) {
+	switch n := n.(type) {
+	case *strct:
+		// Validated when its own type is built.
+		return
+	case *repetition:
+		repeated = true
+	case *unordered:
+		for i, body := range n.bodies {
+			validateRepeated(body, repeated || n.repeat[i])
+		}
+		return
+	case *reference:
+		switch n.node.(type) {
+		case *strct, *parseable:
+			kind := n.field.Type.Kind()
+			if repeated && kind != reflect.Slice && kind != reflect.Map && !implementsCapture(n.field.Type) {
+				panicf("%s: productions captured repeatedly into a single %s would each replace the last, use a slice",
+					n.field.Name, n.field.Type)
+			}
+		}
+	}
+	for _, child := range nodeChildren(n) {
+		validateRepeated(child, repeated)
+	}
+}
+
+// Checks that fields tagged with `positions:"<field>"` name a lexer.Position or []lexer.Position
+// field.
+func validatePositions(t reflect.Type) {
+	for _, field := range grammarFields(t) {
+		name, ok := field.Tag.Lookup("positions")
+		if !ok {
+			continue
+		}
+		f, ok := t.FieldByName(name)
+		if !ok {
+			panicf("%s: unknown positions field %q", field.Name, name)
+		}
+		if f.Type != positionType && f.Type != positionsType {
+			panicf("%s: positions field %q must be a lexer.Position or []lexer.Position", field.Name, name)
+		}
+	}
+}
+
+// Returns the names of the fields of t named by `positions` tags.
+func positionTargets(t reflect.Type) map[string]bool {
+	out := map[string]bool{}
+	for _, field := range grammarFields(t) {
+		if name, ok := field.Tag.Lookup("positions"); ok {
+			out[name] = true
+		}
+	}
+	return out
+}
+
+// Returns the documentation for a production, from the first `doc` tag on its fields.
+func productionDoc(t reflect.Type) string {
+	for _, field := range grammarFields(t) {
+		if doc, ok := field.Tag.Lookup("doc"); ok {
+			return doc
+		}
+	}
+	return ""
+}
+
 func (g *generatorContext) parseExpression(slexer *structLexer) node {
 	out := disjunction{}
 	for {
@@ -69,6 +312,16 @@ func (g *generatorContext) parseExpression(slexer *structLexer) node {
 
 func (g *generatorContext) parseAlternative(slexer *structLexer) node {
 	elements := sequence{}
+	var label *labelled
+	if slexer.Peek().Type == scanner.Ident {
+		token := slexer.Next()
+		if slexer.Peek().Type == ':' {
+			slexer.Next()
+			label = newLabelled(slexer.s, slexer.Field(), token.Value)
+		} else {
+			elements = append(elements, g.parseModifiers(slexer, g.tokenReference(token)))
+		}
+	}
 loop:
 	for {
 		switch slexer.Peek().Type {
@@ -82,13 +335,53 @@ loop:
 			elements = append(elements, term)
 		}
 	}
+	var out node = elements
 	if len(elements) == 1 {
-		return elements[0]
+		out = elements[0]
+	}
+	if label != nil {
+		label.node = out
+		return label
 	}
-	return elements
+	return out
+}
+
+// <label>: <alternative> records <label> into the string field named by the `oneof` tag of the
+// field it appears in when <alternative> matches.
+func newLabelled(s reflect.Type, field reflect.StructField, label string) *labelled {
+	name, ok := field.Tag.Lookup("oneof")
+	if !ok {
+		panicf("labelled alternative %q requires a oneof tag naming the field to record it in", label)
+	}
+	tag, ok := s.FieldByName(name)
+	if !ok {
+		panicf("unknown oneof field %q", name)
+	}
+	if tag.Type.Kind() != reflect.String {
+		panicf("oneof field %q must be a string", name)
+	}
+	return &labelled{field: tag, label: label}
 }
 
 func (g *generatorContext) parseTerm(slexer *structLexer) node {
+	return g.parseModifiers(slexer, g.parseTermNoModifiers(slexer))
+}
+
+// Applies any postfix modifiers following term.
+func (g *generatorContext) parseModifiers(slexer *structLexer, term node) node {
+	// <term>+ matches 1 or more times.
+	if term != nil && slexer.Peek().Type == '+' {
+		slexer.Next()
+		if r, ok := term.(*repetition); ok && r.separator != nil {
+			r.min = 1
+		} else {
+			term = &repetition{node: term, min: 1}
+		}
+	}
+	return term
+}
+
+func (g *generatorContext) parseTermNoModifiers(slexer *structLexer) node {
 	r := slexer.Peek()
 	switch r.Type {
 	case '@':
@@ -101,6 +394,14 @@ func (g *generatorContext) parseTerm(slexer *structLexer) node {
 		return g.parseRepetition(slexer)
 	case '(':
 		return g.parseGroup(slexer)
+	case '~':
+		return g.parseUnordered(slexer)
+	case '!':
+		return g.parseNegation(slexer)
+	case '&':
+		return g.parseLookahead(slexer)
+	case '^':
+		return g.parseAtLeastOne(slexer)
 	case scanner.Ident:
 		return g.parseTokenReference(slexer)
 	case lexer.EOF:
@@ -112,26 +413,224 @@ func (g *generatorContext) parseTerm(slexer *structLexer) node {
 }
 
 // @<expression> captures <expression> into the current field.
+//
+// @<field>=<expression> captures <expression> into another field of the same struct, eg. to
+// capture operands and operators into parallel slices.
 func (g *generatorContext) parseCapture(slexer *structLexer) node {
 	slexer.Next()
-	token := slexer.Peek()
 	field := slexer.Field()
-	if token.Type == '@' {
+	if token := slexer.Peek(); token.Type == scanner.Ident {
 		slexer.Next()
-		return &reference{field, g.parseType(field.Type)}
+		if slexer.Peek().Type != '=' {
+			return g.newReference(field, g.parseModifiers(slexer, g.tokenReference(token)))
+		}
+		slexer.Next() // =
+		var ok bool
+		field, ok = slexer.s.FieldByName(token.Value)
+		if !ok {
+			panicf("unknown field %q", token.Value)
+		}
+	}
+	if slexer.Peek().Type == '@' {
+		slexer.Next()
+		if ops, ok := field.Tag.Lookup("unary"); ok {
+			return g.parseUnary(field, ops)
+		}
+		if sep, ok := field.Tag.Lookup("path"); ok {
+			return g.parsePath(field, sep)
+		}
+		if sep, ok := field.Tag.Lookup("keys"); ok {
+			return g.parseKeyed(field, sep)
+		}
+		if sep, ok := field.Tag.Lookup("nested"); ok {
+			return g.parseNested(field, sep)
+		}
+		if delimiters, ok := field.Tag.Lookup("balanced"); ok {
+			return g.parseBalanced(field, delimiters)
+		}
+		if sep, ok := field.Tag.Lookup("factory"); ok {
+			return g.parseFactory(field, sep)
+		}
+		if field.Type.Kind() == reflect.Map {
+			s := g.typeNodes[slexer.s].(*strct)
+			s.maps = append(s.maps, field.Index)
+			return g.newReference(field, g.parseMapEntry(field))
+		}
+		return g.newReference(field, g.parseType(field.Type))
 	}
-	if indirectType(field.Type).Kind() == reflect.Struct && !field.Type.Implements(captureType) {
+	if indirectType(field.Type).Kind() == reflect.Struct && !implementsCapture(field.Type) {
 		panic("structs can only be parsed with @@ or by implementing the Capture interface")
 	}
-	return &reference{field, g.parseTerm(slexer)}
+	return g.newReference(field, g.parseTerm(slexer))
+}
+
+// A field tagged with `preserve:""` captures the source text it matches verbatim, while a field
+// tagged with `index:""` captures the index of the alternative that matched. Quoted fields
+// capture the quote style of the tokens they match.
+func (g *generatorContext) newReference(field reflect.StructField, n node) *reference {
+	_, preserve := field.Tag.Lookup("preserve")
+	if preserve && indirectType(field.Type).Kind() != reflect.String {
+		panic("preserved source can only be captured into string fields")
+	}
+	if _, ok := field.Tag.Lookup("rune"); ok && indirectType(field.Type).Kind() != reflect.Int32 {
+		panic("a character can only be captured into a rune field")
+	}
+	if tag, ok := field.Tag.Lookup("bool"); ok {
+		if indirectType(field.Type).Kind() != reflect.Bool {
+			panic("literals can only be captured as bools into bool fields")
+		}
+		if len(strings.Split(tag, ",")) != 2 {
+			panicf("bool tag must be of the form `bool:\"<true>,<false>\"` but got %q", tag)
+		}
+	}
+	if unit, ok := field.Tag.Lookup("unix"); ok {
+		if indirectType(field.Type) != timeType {
+			panic("Unix timestamps can only be captured into time.Time fields")
+		}
+		if unit != "s" && unit != "ms" {
+			panicf("unsupported Unix timestamp unit %q, expected \"s\" or \"ms\"", unit)
+		}
+	}
+	if _, ok := field.Tag.Lookup("bytes"); ok && (field.Type.Kind() != reflect.Slice || field.Type.Elem() != byteType) {
+		panic("raw bytes can only be captured into a []byte field")
+	}
+	_, index := field.Tag.Lookup("index")
+	if index {
+		if _, ok := n.(disjunction); !ok {
+			panic("an alternative index can only be captured from a set of alternatives")
+		}
+		switch indirectType(field.Type).Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		default:
+			panic("an alternative index can only be captured into integer fields")
+		}
+	}
+	r := &reference{field: field, node: n, preserve: preserve, index: index}
+	r.positions = field.Tag.Get("positions")
+	if indirectType(field.Type) == quotedType {
+		r.quotes = quoteStyles(g.Symbols())
+	}
+	return r
+}
+
+// Returns true if values of t can capture tokens themselves.
+func implementsCapture(t reflect.Type) bool {
+	if t == regexpType || indirectType(t) == quotedType {
+		return true
+	}
+	for _, iface := range []reflect.Type{captureType, contextCaptureType, positionCaptureType, binaryUnmarshalerType, textUnmarshalerType} {
+		if t.Implements(iface) || reflect.PtrTo(indirectType(t)).Implements(iface) {
+			return true
+		}
+	}
+	return false
+}
+
+// A field tagged with `unary:"<op> <op> ..."` captures a run of prefix operators.
+func (g *generatorContext) parseUnary(field reflect.StructField, ops string) node {
+	t := indirectType(field.Type)
+	if t.Kind() != reflect.String && !(field.Type.Kind() == reflect.Slice && t.Kind() == reflect.String) {
+		panic("unary operators can only be captured into string or []string fields")
+	}
+	n := &unary{field: field, ops: map[string]bool{}}
+	for _, op := range strings.Fields(ops) {
+		n.ops[op] = true
+	}
+	if len(n.ops) == 0 {
+		panic("no unary operators provided")
+	}
+	return n
+}
+
+// A field tagged with `path:"<separator>"` captures a separated path of identifiers, eg. a.b.c.
+func (g *generatorContext) parsePath(field reflect.StructField, sep string) node {
+	t := indirectType(field.Type)
+	if t.Kind() != reflect.String {
+		panic("paths can only be captured into string or []string fields")
+	}
+	if sep == "" {
+		sep = "."
+	}
+	ident, ok := g.Symbols()["Ident"]
+	if !ok {
+		panic("lexer does not provide an Ident token for paths")
+	}
+	return &path{field: field, sep: sep, ident: ident}
+}
+
+// A field tagged with `keys:"<separator>"` captures a set of key/value assignments, eg. a=1 b=2,
+// into the fields of a struct named by each key.
+func (g *generatorContext) parseKeyed(field reflect.StructField, sep string) node {
+	t := indirectType(field.Type)
+	if t.Kind() != reflect.Struct {
+		panic("keys can only be captured into struct fields")
+	}
+	if sep == "" {
+		sep = "="
+	}
+	ident, ok := g.Symbols()["Ident"]
+	if !ok {
+		panic("lexer does not provide an Ident token for keys")
+	}
+	n := &keyed{field: field, typ: t, sep: sep, ident: ident}
+	n.index("key")
+	return n
+}
+
+// A field tagged with `nested:"<separator>"` captures a set of assignments to dotted keys, eg.
+// a.b.c = 1, into a nested map[string]interface{}.
+func (g *generatorContext) parseNested(field reflect.StructField, sep string) node {
+	if field.Type != nestedMapType {
+		panic("nested keys can only be captured into map[string]interface{} fields")
+	}
+	if sep == "" {
+		sep = "."
+	}
+	symbols := g.Symbols()
+	ident, ok := symbols["Ident"]
+	if !ok {
+		panic("lexer does not provide an Ident token for nested keys")
+	}
+	n := &nested{field: field, sep: sep, ident: ident, strings: map[rune]bool{}}
+	for _, name := range []string{"String", "RawString", "Char"} {
+		if typ, ok := symbols[name]; ok {
+			n.strings[typ] = true
+		}
+	}
+	return n
+}
+
+// An interface field tagged with `factory:"[<separator>]"` captures the type registered for the
+// discriminator token by the Factory option.
+func (g *generatorContext) parseFactory(field reflect.StructField, sep string) node {
+	iface := indirectType(field.Type)
+	if iface.Kind() != reflect.Interface {
+		panic("factory fields must be interfaces or slices of interfaces")
+	}
+	return &factory{field: field, iface: iface, sep: sep, types: g.factory(iface)}
+}
+
+// A field tagged with `balanced:"<open> <close>"` captures the region between balanced delimiters,
+// eg. `{ ... }`, parsing its contents with the grammar of the field's type.
+func (g *generatorContext) parseBalanced(field reflect.StructField, delimiters string) node {
+	parts := strings.Fields(delimiters)
+	if len(parts) != 2 {
+		panic("balanced delimiters must be in the form \"<open> <close>\"")
+	}
+	return &balanced{field: field, open: parts[0], close: parts[1], node: g.parseType(field.Type)}
 }
 
 // A reference in the form <identifier> refers to a named token from the lexer.
 func (g *generatorContext) parseTokenReference(slexer *structLexer) node {
 	token := slexer.Next()
 	if token.Type != scanner.Ident {
-		panic("expected identifier")
+		panic("expected identifier but got " + describeToken(token))
 	}
+	return g.tokenReference(token)
+}
+
+func (g *generatorContext) tokenReference(token lexer.Token) node {
 	typ, ok := g.Symbols()[token.Value]
 	if !ok {
 		panicf("unknown token type %q", token.String())
@@ -139,43 +638,196 @@ func (g *generatorContext) parseTokenReference(slexer *structLexer) node {
 	return &tokenReference{typ, token.Value}
 }
 
+// Describes a token of a grammar tag in an error, eg. `Int "1"`.
+func describeToken(token lexer.Token) string {
+	if token.EOF() {
+		return "EOF"
+	}
+	return fmt.Sprintf("%s %q", lexer.TokenTypeName(token.Type), token.Value)
+}
+
 // [ <expression> ] optionally matches <expression>.
 func (g *generatorContext) parseOptional(slexer *structLexer) node {
 	slexer.Next() // [
 	optional := &optional{g.parseExpression(slexer)}
 	next := slexer.Peek()
 	if next.Type != ']' {
-		panic("expected ] but got " + next.String())
+		panic("expected ] but got " + describeToken(next))
 	}
 	slexer.Next()
 	return optional
 }
 
 // { <expression> } matches 0 or more repititions of <expression>
+//
+// { <expression> % <separator> } matches <expression> separated by <separator>, while
+// { <expression> %% <separator> } also allows a trailing <separator>.
+//
+// A repetition may be followed by bounds on the number of matches, either <n> for exactly n,
+// <min>, for at least min or <min>,<max>, and then by a limit, <<limit>>, beyond which further
+// matches are an error rather than ending the repetition.
 func (g *generatorContext) parseRepetition(slexer *structLexer) node {
 	slexer.Next() // {
 	n := &repetition{
 		node: g.parseExpression(slexer),
 	}
+	if slexer.Peek().Type == '%' {
+		slexer.Next()
+		if slexer.Peek().Type == '%' {
+			slexer.Next()
+			n.trailing = true
+		}
+		if n.separator = g.parseTerm(slexer); n.separator == nil {
+			panic("expected separator after % but got " + describeToken(slexer.Peek()))
+		}
+	}
 	next := slexer.Next()
 	if next.Type != '}' {
-		panic("expected } but got " + next.String())
+		panic("expected } but got " + describeToken(next))
+	}
+	if slexer.Peek().Type == scanner.Int {
+		n.min, n.max = parseBounds(slexer)
+	}
+	if slexer.Peek().Type == '<' {
+		slexer.Next()
+		limit := slexer.Next()
+		var err error
+		if n.limit, err = strconv.Atoi(limit.Value); limit.Type != scanner.Int || err != nil || n.limit <= 0 {
+			panic("expected a positive repetition limit but got " + describeToken(limit))
+		}
+		if next := slexer.Next(); next.Type != '>' {
+			panic("expected > but got " + describeToken(next))
+		}
 	}
 	return n
 }
 
+// <min>[,[<max>]]
+func parseBounds(slexer *structLexer) (min int, max int) {
+	min, err := strconv.Atoi(slexer.Next().Value)
+	if err != nil {
+		panic("invalid repetition bound: " + err.Error())
+	}
+	if slexer.Peek().Type != ',' {
+		if min == 0 {
+			panic("a repetition of exactly 0 never matches")
+		}
+		return min, min
+	}
+	if slexer.Peek().Type == ',' {
+		slexer.Next()
+		max = 0
+		if slexer.Peek().Type == scanner.Int {
+			if max, err = strconv.Atoi(slexer.Next().Value); err != nil {
+				panic("invalid repetition bound: " + err.Error())
+			}
+		}
+	}
+	if max != 0 && max < min {
+		panic(fmt.Sprintf("maximum repetitions %d is less than the minimum %d", max, min))
+	}
+	return min, max
+}
+
+// Returns the grammar of the entries of a map field captured with @@, which are structs with a Key
+// field holding the key of each entry.
+//
+// The entries of a map of any other type are structs with Key and Value fields, whose grammars are
+// given by the `key` and `value` tags of the field, and the Value of each entry is inserted.
+func (g *generatorContext) parseMapEntry(field reflect.StructField) node {
+	t := indirectType(field.Type.Elem())
+	if t.Kind() != reflect.Struct {
+		keyGrammar, hasKey := field.Tag.Lookup("key")
+		valueGrammar, hasValue := field.Tag.Lookup("value")
+		if !hasKey || !hasValue {
+			panicf("map values must be structs with a Key field, or the map must be tagged with key and value grammars, not %s", field.Type.Elem())
+		}
+		return g.parseType(reflect.StructOf([]reflect.StructField{
+			{Name: "Key", Type: field.Type.Key(), Tag: reflect.StructTag("parser:" + strconv.Quote(keyGrammar))},
+			{Name: "Value", Type: field.Type.Elem(), Tag: reflect.StructTag("parser:" + strconv.Quote(valueGrammar))},
+		}))
+	}
+	key, ok := t.FieldByName("Key")
+	if !ok || !key.Type.AssignableTo(field.Type.Key()) {
+		panicf("map values must be structs with a Key field of type %s", field.Type.Key())
+	}
+	return g.parseType(field.Type.Elem())
+}
+
 // ( <expression> ) groups a sub-expression
 func (g *generatorContext) parseGroup(slexer *structLexer) node {
 	slexer.Next() // (
 	n := g.parseExpression(slexer)
 	next := slexer.Peek() // )
 	if next.Type != ')' {
-		panic("expected ) but got " + next.Value)
+		panic("expected ) but got " + describeToken(next))
+	}
+	slexer.Next() // )
+	return n
+}
+
+// ~( <term> <term> ... ) matches each term in any order.
+func (g *generatorContext) parseUnordered(slexer *structLexer) node {
+	slexer.Next() // ~
+	if next := slexer.Next(); next.Type != '(' {
+		panic("expected ( after ~ but got " + describeToken(next))
+	}
+	n := &unordered{}
+	for slexer.Peek().Type != ')' {
+		term := g.parseTerm(slexer)
+		if term == nil {
+			panic("expected ) but got " + describeToken(slexer.Peek()))
+		}
+		n.add(term)
 	}
 	slexer.Next() // )
+	if len(n.elements) == 0 {
+		panic("empty unordered group")
+	}
 	return n
 }
 
+// ^( <term> <term> ... ) matches its terms in sequence, but only if at least one matches.
+func (g *generatorContext) parseAtLeastOne(slexer *structLexer) node {
+	slexer.Next() // ^
+	if next := slexer.Next(); next.Type != '(' {
+		panic("expected ( after ^ but got " + describeToken(next))
+	}
+	n := &atLeastOne{}
+	for slexer.Peek().Type != ')' {
+		term := g.parseTerm(slexer)
+		if term == nil {
+			panic("expected ) but got " + describeToken(slexer.Peek()))
+		}
+		n.elements = append(n.elements, term)
+	}
+	slexer.Next() // )
+	if len(n.elements) == 0 {
+		panic("empty at least one group")
+	}
+	return n
+}
+
+// !<term> matches any single token, provided that <term> does not match.
+func (g *generatorContext) parseNegation(slexer *structLexer) node {
+	slexer.Next() // !
+	n := g.parseTermNoModifiers(slexer)
+	if n == nil {
+		panic("expected term after ! but got " + describeToken(slexer.Peek()))
+	}
+	return &negation{n}
+}
+
+// &<term> matches without consuming any input, provided that <term> matches.
+func (g *generatorContext) parseLookahead(slexer *structLexer) node {
+	slexer.Next() // &
+	n := g.parseTermNoModifiers(slexer)
+	if n == nil {
+		panic("expected term after & but got " + describeToken(slexer.Peek()))
+	}
+	return &lookahead{n}
+}
+
 // A literal string.
 //
 // Note that for this to match, the tokeniser must be able to produce this string. For example,
@@ -183,7 +835,7 @@ func (g *generatorContext) parseGroup(slexer *structLexer) node {
 func (g *generatorContext) parseLiteral(lex *structLexer) node { // nolint: interfacer
 	token := lex.Next()
 	if token.Type != scanner.String && token.Type != scanner.RawString && token.Type != scanner.Char {
-		panic("expected quoted string but got " + token.String())
+		panic("expected quoted string but got " + describeToken(token))
 	}
 	s := token.Value
 	t := rune(-1)
@@ -192,7 +844,7 @@ func (g *generatorContext) parseLiteral(lex *structLexer) node { // nolint: inte
 		lex.Next()
 		token = lex.Next()
 		if token.Type != scanner.Ident {
-			panic("expected identifier for literal type constraint but got " + token.String())
+			panic("expected identifier for literal type constraint but got " + describeToken(token))
 		}
 		var ok bool
 		t, ok = g.Symbols()[token.Value]
@@ -0,0 +1,78 @@
+package lexer
+
+import "text/scanner"
+
+// Class is a broad classification of a token, independent of the lexer that produced it.
+type Class int
+
+// Token classes.
+const (
+	ClassOther Class = iota
+	ClassIdent
+	ClassString
+	ClassNumber
+)
+
+func (c Class) String() string {
+	switch c {
+	case ClassIdent:
+		return "Ident"
+	case ClassString:
+		return "String"
+	case ClassNumber:
+		return "Number"
+	}
+	return "Other"
+}
+
+// A Classifier can be implemented by a Definition to classify its own token types.
+type Classifier interface {
+	Classify(token Token) Class
+}
+
+// ClassOf returns the Class of a token produced by a lexer with the given definition.
+//
+// If the definition implements Classifier it is used, otherwise the token type is classified by
+// its symbolic name: "Ident" is an identifier, "String", "RawString" and "Char" are strings, and
+// "Int" and "Float" are numbers.
+func ClassOf(def Definition, token Token) Class {
+	if classifier, ok := def.(Classifier); ok {
+		return classifier.Classify(token)
+	}
+	for name, typ := range def.Symbols() {
+		if typ == token.Type {
+			return classOfSymbol(name)
+		}
+	}
+	return ClassOther
+}
+
+func classOfSymbol(name string) Class {
+	switch name {
+	case "Ident":
+		return ClassIdent
+	case "String", "RawString", "Char":
+		return ClassString
+	case "Int", "Float":
+		return ClassNumber
+	}
+	return ClassOther
+}
+
+// IsIdent returns true if the token is an identifier.
+//
+// This and the other Is* predicates assume the token types of text/scanner, as produced by the
+// default lexer. Use ClassOf() for tokens from other lexers.
+func (t Token) IsIdent() bool {
+	return t.Type == scanner.Ident
+}
+
+// IsString returns true if the token is a string, raw string or character literal.
+func (t Token) IsString() bool {
+	return t.Type == scanner.String || t.Type == scanner.RawString || t.Type == scanner.Char
+}
+
+// IsNumber returns true if the token is an integer or floating point literal.
+func (t Token) IsNumber() bool {
+	return t.Type == scanner.Int || t.Type == scanner.Float
+}
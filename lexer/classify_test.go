@@ -0,0 +1,47 @@
+package lexer
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenPredicates(t *testing.T) {
+	tokens, err := ConsumeAll(TextScannerLexer.Lex(strings.NewReader(`a "b" 'c' 1 2.5 +`)))
+	require.NoError(t, err)
+	require.True(t, tokens[0].IsIdent())
+	require.True(t, tokens[1].IsString())
+	require.True(t, tokens[2].IsString())
+	require.True(t, tokens[3].IsNumber())
+	require.True(t, tokens[4].IsNumber())
+	for _, token := range tokens[5:] {
+		require.False(t, token.IsIdent() || token.IsString() || token.IsNumber())
+	}
+}
+
+type classifyingDefinition struct {
+	Definition
+}
+
+func (c classifyingDefinition) Classify(token Token) Class {
+	if token.Value == "true" || token.Value == "false" {
+		return ClassOther
+	}
+	return ClassOf(c.Definition, token)
+}
+
+func TestClassOf(t *testing.T) {
+	def := Must(Regexp(`(?P<Ident>[a-z]+)|(\s+)|(?P<Int>\d+)|(?P<Punct>[+=])`))
+	tokens, err := ConsumeAll(def.Lex(strings.NewReader(`a = 1 + true`)))
+	require.NoError(t, err)
+	classes := []Class{}
+	for _, token := range tokens {
+		classes = append(classes, ClassOf(def, token))
+	}
+	require.Equal(t, []Class{ClassIdent, ClassOther, ClassNumber, ClassOther, ClassIdent, ClassOther}, classes)
+
+	custom := classifyingDefinition{def}
+	require.Equal(t, ClassOther, ClassOf(custom, tokens[4]))
+	require.Equal(t, ClassIdent, ClassOf(custom, tokens[0]))
+}
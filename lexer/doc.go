@@ -8,7 +8,9 @@
 // late 2013 15" MacBook Pro.
 //
 // The second lexer is constructed via the Regexp() function, mapping regexp capture groups
-// to tokens. The complete input source is read into memory, so it is unsuitable for large inputs.
+// to tokens, or the Rules() function, from an ordered list of named patterns. Stateful() extends
+// this with states entered and left on particular tokens, eg. for string interpolation. The
+// complete input source is read into memory, so it is unsuitable for large inputs.
 //
 // The final lexer provided accepts a lexical grammar in EBNF. Each capitalised production is a
 // lexical token supported by the resulting Lexer. This is very flexible, but a bit slower, scanning
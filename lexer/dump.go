@@ -0,0 +1,26 @@
+package lexer
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Dump lexes input with def and returns all tokens, including the final EOF token.
+//
+// This is useful for verifying that a Definition emits the tokens a grammar expects.
+func Dump(def Definition, input string) ([]Token, error) {
+	return ConsumeAll(def.Lex(strings.NewReader(input)))
+}
+
+// FormatTokens formats tokens one per line, with their position, type name and value.
+//
+// Type names are resolved via def.Symbols(). Types without a symbol, such as the single character
+// tokens returned by the default lexer, are shown as quoted characters.
+func FormatTokens(def Definition, tokens []Token) string {
+	names := symbolNames(def)
+	out := []string{}
+	for _, token := range tokens {
+		out = append(out, fmt.Sprintf("%s %s %q", token.Pos, typeName(names, token.Type), token.Value))
+	}
+	return strings.Join(out, "\n")
+}
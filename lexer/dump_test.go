@@ -0,0 +1,29 @@
+package lexer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDump(t *testing.T) {
+	def := Must(Regexp(`(?P<Ident>[a-z]+)|(\s+)|(?P<Number>\d+)|(?P<Punct>[=])`))
+	tokens, err := Dump(def, "a = 1")
+	require.NoError(t, err)
+	require.Equal(t, `<source>:1:1 Ident "a"
+<source>:1:3 Punct "="
+<source>:1:5 Number "1"
+<source>:1:6 EOF "<<EOF>>"`, FormatTokens(def, tokens))
+
+	_, err = Dump(def, "a ?")
+	require.Error(t, err)
+}
+
+func TestFormatTokensUnnamedType(t *testing.T) {
+	tokens, err := Dump(TextScannerLexer, "a=1")
+	require.NoError(t, err)
+	require.Equal(t, `<source>:1:1 Ident "a"
+<source>:1:2 '=' "="
+<source>:1:3 Int "1"
+<source>:1:4 EOF ""`, FormatTokens(TextScannerLexer, tokens))
+}
@@ -6,6 +6,8 @@ import "fmt"
 type Error struct {
 	Message string
 	Pos     Position
+	// Descriptions of the tokens the parser expected at Pos, if known, eg. `"("` or `an Ident`.
+	Expected []string
 }
 
 // Panic throws a lexer error. Lexers should use this to report errors.
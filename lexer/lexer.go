@@ -38,6 +38,62 @@ type Lexer interface {
 	Next() Token
 }
 
+// A Checkpointer is a Lexer that can be restored to an earlier position, for backtracking.
+//
+// The Lexer passed to participle.Parseable implementations is always a Checkpointer and a
+// Lookahead.
+type Checkpointer interface {
+	Lexer
+	// Checkpoint returns the current position, which may later be passed to Restore.
+	Checkpoint() int
+	// Restore the lexer to a position returned by Checkpoint.
+	Restore(checkpoint int)
+}
+
+// A Lookahead is a Lexer that can peek more than one token ahead, eg. to distinguish `a = b` from
+// `a = = b` without consuming any input.
+type Lookahead interface {
+	Lexer
+	// PeekN returns the token n tokens after the next, so PeekN(0) is equivalent to Peek(). Peeking
+	// beyond the end of the input returns the EOF token.
+	PeekN(n int) Token
+}
+
+// Buffer returns lex as a Lookahead, buffering its tokens if it does not already implement one.
+func Buffer(lex Lexer) Lookahead {
+	if lookahead, ok := lex.(Lookahead); ok {
+		return lookahead
+	}
+	return &bufferedLexer{lexer: lex}
+}
+
+type bufferedLexer struct {
+	lexer  Lexer
+	tokens []Token
+}
+
+func (b *bufferedLexer) Peek() Token {
+	return b.PeekN(0)
+}
+
+func (b *bufferedLexer) PeekN(n int) Token {
+	for len(b.tokens) <= n {
+		if len(b.tokens) > 0 && b.tokens[len(b.tokens)-1].EOF() {
+			return b.tokens[len(b.tokens)-1]
+		}
+		b.tokens = append(b.tokens, b.lexer.Next())
+	}
+	return b.tokens[n]
+}
+
+func (b *bufferedLexer) Next() Token {
+	token := b.PeekN(0)
+	if !token.EOF() {
+		b.tokens = b.tokens[1:]
+	}
+	return token
+}
+
 type namedReader interface {
 	Name() string
 }
@@ -113,6 +169,36 @@ func (t Token) EOF() bool {
 	return t.Type == EOF
 }
 
+// TokenTypeName returns the name of a token type of the default lexer, eg. "Ident" for
+// scanner.Ident, or the quoted character of a single character token, eg. '='.
+//
+// This is useful for readable errors from Parseable implementations. The types of other lexers are
+// named by their Definition's Symbols().
+func TokenTypeName(typ rune) string {
+	return typeName(defaultTypeNames, typ)
+}
+
+var defaultTypeNames = symbolNames(DefaultDefinition)
+
+// Returns the symbol naming each token type of def.
+func symbolNames(def Definition) map[rune]string {
+	names := map[rune]string{}
+	for name, typ := range def.Symbols() {
+		names[typ] = name
+	}
+	return names
+}
+
+func typeName(names map[rune]string, typ rune) string {
+	if name, ok := names[typ]; ok {
+		return name
+	}
+	if typ < 0 {
+		return fmt.Sprintf("token type %d", typ)
+	}
+	return fmt.Sprintf("%q", typ)
+}
+
 func (t Token) String() string {
 	return t.Value
 }
@@ -1,6 +1,7 @@
 package lexer
 
 import (
+	"errors"
 	"io"
 	"strconv"
 	"strings"
@@ -72,7 +73,9 @@ func Elide(def Definition, types ...string) Definition {
 
 // Unquote applies strconv.Unquote() to tokens of the given types.
 //
-// Tokens of type "String" will be unquoted if no other types are provided.
+// Double and single quoted tokens have their escapes decoded, eg. "\n" or "\x41", while the
+// contents of backquoted tokens are used verbatim. Tokens of type "String" will be unquoted if no
+// other types are provided.
 func Unquote(def Definition, types ...string) Definition {
 	if len(types) == 0 {
 		types = []string{"String"}
@@ -91,8 +94,14 @@ func Unquote(def Definition, types ...string) Definition {
 }
 
 func unquote(s string) (string, error) {
+	if len(s) < 2 || s[len(s)-1] != s[0] {
+		return "", errors.New("not a quoted string")
+	}
 	quote := s[0]
 	s = s[1 : len(s)-1]
+	if quote == '`' {
+		return s, nil
+	}
 	out := ""
 	for s != "" {
 		value, _, tail, err := strconv.UnquoteChar(s, quote)
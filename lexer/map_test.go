@@ -45,6 +45,21 @@ func TestUnquote(t *testing.T) {
 	require.Equal(t, expected, actual)
 }
 
+func TestUnquoteEscapes(t *testing.T) {
+	def := Unquote(Must(Regexp(`(\s+)|(?P<String>"(\\.|[^"])*"|'(\\.|[^'])*'|` + "`[^`]*`)")))
+	lexer := def.Lex(strings.NewReader(`"a\x41\n" '\'' ` + "`raw\\n`"))
+	actual, err := ConsumeAll(lexer)
+	require.NoError(t, err)
+	values := []string{}
+	for _, token := range actual {
+		values = append(values, token.Value)
+	}
+	require.Equal(t, []string{"aA\n", "'", `raw\n`, "<<EOF>>"}, values)
+
+	_, err = ConsumeAll(def.Lex(strings.NewReader(`"bad \q"`)))
+	require.EqualError(t, err, `<source>:1:1: invalid quoted string "\"bad \\q\"": invalid syntax`)
+}
+
 func TestUnquoteSingleQuote(t *testing.T) {
 	def := Unquote(Must(Regexp(`(\s+)|(?P<Ident>\w+)|(?P<String>'(\\.|[^'])*'|"[^"]*")`)))
 	lexer := def.Lex(strings.NewReader(`hello 'world\''`))
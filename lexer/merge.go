@@ -0,0 +1,108 @@
+package lexer
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// MergeSymbols merges the symbol tables of several lexer definitions, eg. for a grammar composed
+// of sub-grammars with their own lexers.
+//
+// An error is returned if the definitions disagree, either by giving the same symbol different
+// token types or by giving the same token type to different symbols. Use Unify() to resolve such
+// conflicts by remapping token types.
+func MergeSymbols(defs ...Definition) (map[string]rune, error) {
+	symbols := map[string]rune{}
+	names := map[rune]string{}
+	for _, def := range defs {
+		for _, name := range sortedSymbols(def) {
+			typ := def.Symbols()[name]
+			if existing, ok := symbols[name]; ok && existing != typ {
+				return nil, fmt.Errorf("symbol %q has conflicting token types %d and %d", name, existing, typ)
+			}
+			if existing, ok := names[typ]; ok && existing != name {
+				return nil, fmt.Errorf("token type %d is used by both %q and %q", typ, existing, name)
+			}
+			symbols[name] = typ
+			names[typ] = name
+		}
+	}
+	return symbols, nil
+}
+
+// Unify returns copies of the given definitions that share a single consistent symbol table.
+//
+// Symbols with the same name are given the same token type, that of the first definition
+// providing it. Symbols whose token type is already in use by a different symbol are remapped to
+// a new, unused token type. The Symbols() of each returned definition is the merged table.
+func Unify(defs ...Definition) []Definition {
+	symbols := map[string]rune{}
+	used := map[rune]bool{}
+	next := EOF
+	for _, def := range defs {
+		for _, typ := range def.Symbols() {
+			if typ <= next {
+				next = typ - 1
+			}
+		}
+	}
+	remaps := make([]map[rune]rune, len(defs))
+	for i, def := range defs {
+		remaps[i] = map[rune]rune{}
+		for _, name := range sortedSymbols(def) {
+			typ := def.Symbols()[name]
+			if existing, ok := symbols[name]; ok {
+				remaps[i][typ] = existing
+				continue
+			}
+			if used[typ] {
+				remaps[i][typ] = next
+				typ = next
+				next--
+			} else {
+				remaps[i][typ] = typ
+			}
+			symbols[name] = typ
+			used[typ] = true
+		}
+	}
+	out := make([]Definition, len(defs))
+	for i, def := range defs {
+		out[i] = &remapDef{def: def, remap: remaps[i], symbols: symbols}
+	}
+	return out
+}
+
+// Symbol names of def, sorted for deterministic merging.
+func sortedSymbols(def Definition) []string {
+	names := []string{}
+	for name := range def.Symbols() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type remapDef struct {
+	def     Definition
+	remap   map[rune]rune
+	symbols map[string]rune
+}
+
+func (r *remapDef) Lex(reader io.Reader) Lexer {
+	return Map(r.def, func(t *Token) *Token {
+		if typ, ok := r.remap[t.Type]; ok {
+			t.Type = typ
+		}
+		return t
+	}).Lex(reader)
+}
+
+func (r *remapDef) Symbols() map[string]rune {
+	symbols := map[string]rune{}
+	for name, typ := range r.symbols {
+		symbols[name] = typ
+	}
+	return symbols
+}
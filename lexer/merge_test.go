@@ -0,0 +1,50 @@
+package lexer
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeSymbolsCompatible(t *testing.T) {
+	a := Must(Regexp(`(?P<Ident>[a-z]+)|(?P<Int>\d+)`))
+	b := Must(Regexp(`(?P<Ident>[a-z]+)|(?P<Int>\d+)|(?P<Op>[+-])`))
+	symbols, err := MergeSymbols(a, b)
+	require.NoError(t, err)
+	require.Equal(t, b.Symbols(), symbols)
+}
+
+func TestMergeSymbolsConflicting(t *testing.T) {
+	a := Must(Regexp(`(?P<Ident>[a-z]+)|(?P<Int>\d+)`))
+	b := Must(Regexp(`(?P<Int>\d+)|(?P<Ident>[a-z]+)`))
+	_, err := MergeSymbols(a, b)
+	require.Error(t, err)
+
+	_, err = MergeSymbols(TextScannerLexer, b)
+	require.Error(t, err)
+}
+
+func TestUnify(t *testing.T) {
+	a := Must(Regexp(`(?P<Ident>[a-z]+)|(\s+)|(?P<Int>\d+)`))
+	b := Must(Regexp(`(?P<Op>[+-])|(\s+)|(?P<Ident>[a-z]+)`))
+
+	unified := Unify(a, b)
+	symbols, err := MergeSymbols(unified...)
+	require.NoError(t, err)
+	require.Len(t, symbols, 4)
+	require.Equal(t, symbols, unified[0].Symbols())
+	require.Equal(t, symbols, unified[1].Symbols())
+
+	tokens, err := ConsumeAll(unified[1].Lex(strings.NewReader(`x + y`)))
+	require.NoError(t, err)
+	require.Equal(t, symbols["Ident"], tokens[0].Type)
+	require.Equal(t, symbols["Op"], tokens[1].Type)
+	require.Equal(t, symbols["Ident"], tokens[2].Type)
+	require.Equal(t, EOF, tokens[3].Type)
+
+	tokens, err = ConsumeAll(unified[0].Lex(strings.NewReader(`x 1`)))
+	require.NoError(t, err)
+	require.Equal(t, symbols["Ident"], tokens[0].Type)
+	require.Equal(t, symbols["Int"], tokens[1].Type)
+}
@@ -2,9 +2,11 @@ package lexer
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"regexp"
+	"strings"
 	"unicode/utf8"
 )
 
@@ -39,6 +41,46 @@ func Regexp(pattern string) (Definition, error) {
 	return &regexpDefinition{re: re, symbols: symbols}, nil
 }
 
+// A Rule of a lexer created by Rules, matching tokens of type Name with the regular expression
+// Pattern. Input matching a rule without a Name, eg. whitespace, is discarded.
+type Rule struct {
+	Name    string
+	Pattern string
+}
+
+// Rules creates a lexer definition from an ordered list of rules.
+//
+// At each position in the input the first rule that matches wins, rather than the longest match,
+// so rules that overlap must be ordered most specific first, eg. a Float rule before Int, or a
+// Keyword rule matching `\b(if|else)\b` before Ident.
+//
+// eg.
+//
+//     	def, err := Rules(Rule{"Ident", `[a-z]+`}, Rule{"", `\s+`}, Rule{"Number", `\d+`})
+func Rules(rules ...Rule) (Definition, error) {
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("no lexer rules")
+	}
+	seen := map[string]bool{}
+	alternatives := []string{}
+	for _, rule := range rules {
+		if _, err := regexp.Compile(rule.Pattern); err != nil {
+			return nil, fmt.Errorf("rule %q: %s", rule.Name, err)
+		}
+		if rule.Name == "" {
+			alternatives = append(alternatives, "("+rule.Pattern+")")
+			continue
+		}
+		if seen[rule.Name] || rule.Name == "EOF" {
+			return nil, fmt.Errorf("duplicate rule %q", rule.Name)
+		}
+		seen[rule.Name] = true
+		alternatives = append(alternatives, "(?P<"+rule.Name+">"+rule.Pattern+")")
+	}
+	// Anchor the rules so that input no rule matches is reported rather than searched past.
+	return Regexp("^(?:" + strings.Join(alternatives, "|") + ")")
+}
+
 func (d *regexpDefinition) Lex(r io.Reader) Lexer {
 	b, err := ioutil.ReadAll(r)
 	if err != nil {
@@ -87,15 +129,7 @@ nextToken:
 		}
 
 		// Update lexer state.
-		r.pos.Offset += matches[1]
-		lines := bytes.Count(match, eolBytes)
-		r.pos.Line += lines
-		// Update column.
-		if lines == 0 {
-			r.pos.Column += utf8.RuneCount(match)
-		} else {
-			r.pos.Column = utf8.RuneCount(match[bytes.LastIndex(match, eolBytes):])
-		}
+		advance(&r.pos, match)
 		// Move slice along.
 		r.b = r.b[matches[1]:]
 
@@ -124,3 +158,15 @@ func (r *regexpLexer) Next() Token {
 	r.peek = nil
 	return token
 }
+
+// Advance pos past match.
+func advance(pos *Position, match []byte) {
+	pos.Offset += len(match)
+	lines := bytes.Count(match, eolBytes)
+	pos.Line += lines
+	if lines == 0 {
+		pos.Column += utf8.RuneCount(match)
+	} else {
+		pos.Column = utf8.RuneCount(match[bytes.LastIndex(match, eolBytes):])
+	}
+}
@@ -38,3 +38,49 @@ func BenchmarkRegexpLexer(b *testing.B) {
 		ConsumeAll(lex)
 	}
 }
+
+func TestRules(t *testing.T) {
+	def, err := Rules(
+		Rule{"Keyword", `\b(if|else)\b`},
+		Rule{"Ident", `[a-z]+`},
+		Rule{"Float", `\d+\.\d+`},
+		Rule{"Int", `\d+`},
+		Rule{"", `\s+`},
+	)
+	require.NoError(t, err)
+	symbols := def.Symbols()
+	lexer := def.Lex(strings.NewReader("if iffy 1.5\nelse 15"))
+	tokens, err := ConsumeAll(lexer)
+	require.NoError(t, err)
+	require.Equal(t, []Token{
+		{Type: symbols["Keyword"], Value: "if", Pos: Position{Offset: 0, Line: 1, Column: 1}},
+		{Type: symbols["Ident"], Value: "iffy", Pos: Position{Offset: 3, Line: 1, Column: 4}},
+		{Type: symbols["Float"], Value: "1.5", Pos: Position{Offset: 8, Line: 1, Column: 9}},
+		{Type: symbols["Keyword"], Value: "else", Pos: Position{Offset: 12, Line: 2, Column: 1}},
+		{Type: symbols["Int"], Value: "15", Pos: Position{Offset: 17, Line: 2, Column: 6}},
+		{Type: EOF, Value: "<<EOF>>", Pos: Position{Offset: 19, Line: 2, Column: 8}},
+	}, tokens)
+
+	// The first matching rule wins, even if a later rule matches more.
+	def, err = Rules(Rule{"Int", `\d+`}, Rule{"Float", `\d+\.\d+`}, Rule{"Dot", `\.`})
+	require.NoError(t, err)
+	tokens, err = ConsumeAll(def.Lex(strings.NewReader("1.5")))
+	require.NoError(t, err)
+	require.Equal(t, []string{"1", ".", "5", "<<EOF>>"}, tokenValues(tokens))
+
+	_, err = ConsumeAll(def.Lex(strings.NewReader("1 ?")))
+	require.Error(t, err)
+
+	_, err = Rules(Rule{"Int", `\d+`}, Rule{"Int", `0x[0-9a-f]+`})
+	require.EqualError(t, err, `duplicate rule "Int"`)
+	_, err = Rules(Rule{"Int", `\d+(`})
+	require.Error(t, err)
+}
+
+func tokenValues(tokens []Token) []string {
+	out := []string{}
+	for _, token := range tokens {
+		out = append(out, token.Value)
+	}
+	return out
+}
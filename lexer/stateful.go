@@ -0,0 +1,180 @@
+package lexer
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// A StateRule is a rule of a Stateful lexer, matching tokens of type Name with the regular
+// expression Pattern, and optionally changing the state of the lexer once it matches.
+//
+// Input matching a rule without a Name is discarded, though its action is still taken.
+type StateRule struct {
+	Name    string
+	Pattern string
+	// If non-empty, the state to enter after the rule matches.
+	Push string
+	// Return to the state that was current before the current state was entered.
+	Pop bool
+}
+
+// States are the rules of a Stateful lexer, by the name of the state in which they apply.
+type States map[string][]StateRule
+
+type statefulDefinition struct {
+	states  map[string]*lexerState
+	symbols map[string]rune
+}
+
+// The rules of a single state, compiled into one regular expression.
+type lexerState struct {
+	re *regexp.Regexp
+	// The rule matched by each group of re, if the group is a whole rule.
+	rules map[int]StateRule
+	// The groups of re that are whole rules, in order.
+	groups []int
+}
+
+// Stateful creates a lexer definition that changes the rules it matches as it encounters
+// particular tokens, eg. to lex the expressions interpolated into a string with different rules
+// to the string itself.
+//
+// Lexing begins in the state named "Root". A rule with Push enters another state, and a rule with
+// Pop returns to the previous one, so states nest. Within each state the first rule that matches
+// wins, as for Rules. The token types are shared by all states, so a rule with the same Name in
+// several states produces tokens of the same type.
+//
+// eg.
+//
+//     	def, err := Stateful(States{
+//     		"Root": {{Name: "String", Pattern: `"`, Push: "String"}, {Name: "Ident", Pattern: `\w+`}, {Pattern: `\s+`}},
+//     		"String": {
+//     			{Name: "StringEnd", Pattern: `"`, Pop: true},
+//     			{Name: "Expr", Pattern: `\$\{`, Push: "Expr"},
+//     			{Name: "Chars", Pattern: `[^"$]+`},
+//     		},
+//     		"Expr": {{Name: "ExprEnd", Pattern: `}`, Pop: true}, {Name: "Ident", Pattern: `\w+`}, {Pattern: `\s+`}},
+//     	})
+func Stateful(states States) (Definition, error) {
+	if _, ok := states["Root"]; !ok {
+		return nil, fmt.Errorf("no Root state")
+	}
+	names := []string{}
+	for name := range states {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	d := &statefulDefinition{states: map[string]*lexerState{}, symbols: map[string]rune{"EOF": EOF}}
+	next := EOF - 1
+	for _, name := range names {
+		state := &lexerState{rules: map[int]StateRule{}}
+		alternatives := []string{}
+		group := 1
+		for _, rule := range states[name] {
+			re, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("state %q: rule %q: %s", name, rule.Name, err)
+			}
+			if _, ok := states[rule.Push]; rule.Push != "" && !ok {
+				return nil, fmt.Errorf("state %q: rule %q: unknown state %q", name, rule.Name, rule.Push)
+			}
+			if rule.Name != "" && d.symbols[rule.Name] == 0 {
+				d.symbols[rule.Name] = next
+				next--
+			}
+			alternatives = append(alternatives, "("+rule.Pattern+")")
+			state.rules[group] = rule
+			state.groups = append(state.groups, group)
+			group += 1 + re.NumSubexp()
+		}
+		re, err := regexp.Compile("^(?:" + strings.Join(alternatives, "|") + ")")
+		if err != nil {
+			return nil, fmt.Errorf("state %q: %s", name, err)
+		}
+		state.re = re
+		d.states[name] = state
+	}
+	return d, nil
+}
+
+func (d *statefulDefinition) Lex(r io.Reader) Lexer {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		panic(err)
+	}
+	return &statefulLexer{
+		def:   d,
+		stack: []*lexerState{d.states["Root"]},
+		pos: Position{
+			Filename: NameOfReader(r),
+			Line:     1,
+			Column:   1,
+		},
+		b: b,
+	}
+}
+
+func (d *statefulDefinition) Symbols() map[string]rune {
+	return d.symbols
+}
+
+type statefulLexer struct {
+	def *statefulDefinition
+	// The states entered, the current state last.
+	stack []*lexerState
+	pos   Position
+	b     []byte
+	peek  *Token
+}
+
+func (s *statefulLexer) Next() Token {
+	token := s.Peek()
+	s.peek = nil
+	return token
+}
+
+func (s *statefulLexer) Peek() Token {
+	if s.peek != nil {
+		return *s.peek
+	}
+	for len(s.b) != 0 {
+		state := s.stack[len(s.stack)-1]
+		matches := state.re.FindSubmatchIndex(s.b)
+		if matches == nil || matches[1] == 0 {
+			rn, _ := utf8.DecodeRune(s.b)
+			Panicf(s.pos, "invalid token %q", rn)
+		}
+		var rule StateRule
+		for _, group := range state.groups {
+			if matches[group*2] != -1 {
+				rule = state.rules[group]
+				break
+			}
+		}
+		match := s.b[:matches[1]]
+		token := Token{Type: s.def.symbols[rule.Name], Value: string(match), Pos: s.pos}
+		advance(&s.pos, match)
+		s.b = s.b[matches[1]:]
+
+		switch {
+		case rule.Pop && len(s.stack) == 1:
+			Panicf(token.Pos, "unexpected %q outside of any state entered", token.Value)
+		case rule.Pop:
+			s.stack = s.stack[:len(s.stack)-1]
+		case rule.Push != "":
+			s.stack = append(s.stack, s.def.states[rule.Push])
+		}
+		if rule.Name != "" {
+			s.peek = &token
+			return token
+		}
+	}
+	eof := EOFToken
+	eof.Pos = s.pos
+	return eof
+}
@@ -0,0 +1,57 @@
+package lexer
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStateful(t *testing.T) {
+	def, err := Stateful(States{
+		"Root": {
+			{Name: "String", Pattern: `"`, Push: "String"},
+			{Name: "Ident", Pattern: `\w+`},
+			{Pattern: `\s+`},
+		},
+		"String": {
+			{Name: "StringEnd", Pattern: `"`, Pop: true},
+			{Name: "Expr", Pattern: `\$\{`, Push: "Expr"},
+			{Name: "Chars", Pattern: `[^"$]+`},
+		},
+		"Expr": {
+			{Name: "ExprEnd", Pattern: `}`, Pop: true},
+			{Name: "String", Pattern: `"`, Push: "String"},
+			{Name: "Ident", Pattern: `\w+`},
+			{Pattern: `\s+`},
+		},
+	})
+	require.NoError(t, err)
+	symbols := def.Symbols()
+	require.Len(t, symbols, 7)
+
+	tokens, err := ConsumeAll(def.Lex(strings.NewReader(`x "a ${b "c ${d}"} e"`)))
+	require.NoError(t, err)
+	types := []string{}
+	for _, token := range tokens {
+		for name, typ := range symbols {
+			if typ == token.Type {
+				types = append(types, name+":"+token.Value)
+			}
+		}
+	}
+	require.Equal(t, []string{
+		`Ident:x`, `String:"`, `Chars:a `, `Expr:${`, `Ident:b`, `String:"`, `Chars:c `, `Expr:${`,
+		`Ident:d`, `ExprEnd:}`, `StringEnd:"`, `ExprEnd:}`, `Chars: e`, `StringEnd:"`, `EOF:<<EOF>>`,
+	}, types)
+	require.Equal(t, Position{Offset: 5, Line: 1, Column: 6}, tokens[3].Pos)
+
+	// Outside of an expression, } is not a token.
+	_, err = ConsumeAll(def.Lex(strings.NewReader(`x }`)))
+	require.EqualError(t, err, `<source>:1:3: invalid token '}'`)
+
+	_, err = Stateful(States{"String": {{Name: "Chars", Pattern: `.`}}})
+	require.EqualError(t, err, "no Root state")
+	_, err = Stateful(States{"Root": {{Name: "Open", Pattern: `\(`, Push: "Parens"}}})
+	require.EqualError(t, err, `state "Root": rule "Open": unknown state "Parens"`)
+}
@@ -2,7 +2,6 @@ package lexer
 
 import (
 	"bytes"
-	"fmt"
 	"io"
 	"strconv"
 	"strings"
@@ -13,14 +12,24 @@ import (
 // TextScannerLexer is a lexer that uses the text/scanner module.
 var TextScannerLexer Definition = &defaultDefinition{}
 
-type defaultDefinition struct{}
+// TextScannerLexerWithEOL is like TextScannerLexer, but emits each newline as a token of type
+// "EOL" rather than skipping it as whitespace, for line oriented formats.
+var TextScannerLexerWithEOL Definition = &defaultDefinition{eol: true}
+
+type defaultDefinition struct {
+	eol bool
+}
 
 func (d *defaultDefinition) Lex(r io.Reader) Lexer {
-	return Lex(r)
+	lexer := Lex(r).(*textScannerLexer)
+	if d.eol {
+		lexer.scanner.Whitespace &^= 1 << '\n'
+	}
+	return lexer
 }
 
 func (d *defaultDefinition) Symbols() map[string]rune {
-	return map[string]rune{
+	symbols := map[string]rune{
 		"EOF":       scanner.EOF,
 		"Char":      scanner.Char,
 		"Ident":     scanner.Ident,
@@ -30,12 +39,17 @@ func (d *defaultDefinition) Symbols() map[string]rune {
 		"RawString": scanner.RawString,
 		"Comment":   scanner.Comment,
 	}
+	if d.eol {
+		symbols["EOL"] = '\n'
+	}
+	return symbols
 }
 
 // textScannerLexer is a Lexer based on text/scanner.Scanner
 type textScannerLexer struct {
-	scanner  scanner.Scanner
-	peek     *Token
+	scanner scanner.Scanner
+	// Tokens scanned but not yet consumed.
+	buffer   []Token
 	filename string
 }
 
@@ -47,9 +61,12 @@ func Lex(r io.Reader) Lexer {
 		filename: NameOfReader(r),
 	}
 	lexer.scanner.Init(r)
+	// Decimal numbers such as 3.14 must come through as a single Float token.
+	lexer.scanner.Mode |= scanner.ScanFloats
 	lexer.scanner.Error = func(s *scanner.Scanner, msg string) {
-		// This is to support single quoted strings. Hacky.
-		if msg != "illegal char literal" {
+		// This is to support single quoted strings. Hacky. Newer versions of text/scanner
+		// report this as an "invalid" rather than "illegal" char literal.
+		if msg != "illegal char literal" && msg != "invalid char literal" {
 			Panic(Position(lexer.scanner.Pos()), msg)
 		}
 	}
@@ -67,44 +84,57 @@ func LexString(s string) Lexer {
 }
 
 func (t *textScannerLexer) Next() Token {
-	if t.peek == nil {
-		t.Peek()
+	token := t.PeekN(0)
+	if !token.EOF() {
+		t.buffer = t.buffer[1:]
 	}
-	token := t.peek
-	t.peek = nil
-	return *token
+	return token
 }
 
 func (t *textScannerLexer) Peek() Token {
-	if t.peek != nil {
-		return *t.peek
+	return t.PeekN(0)
+}
+
+// PeekN implements Lookahead.
+func (t *textScannerLexer) PeekN(n int) Token {
+	for len(t.buffer) <= n {
+		if len(t.buffer) > 0 && t.buffer[len(t.buffer)-1].EOF() {
+			return t.buffer[len(t.buffer)-1]
+		}
+		t.buffer = append(t.buffer, t.scan())
 	}
+	return t.buffer[n]
+}
+
+func (t *textScannerLexer) scan() Token {
 	pos := Position(t.scanner.Pos())
 	pos.Filename = t.filename
-	t.peek = &Token{
+	token := Token{
 		Type:  t.scanner.Scan(),
 		Value: t.scanner.TokenText(),
 		Pos:   pos,
 	}
-	t.peek.Pos.Filename = t.filename
 	// Unquote strings.
-	switch t.peek.Type {
+	switch token.Type {
 	case scanner.Char:
-		// FIXME(alec): This is pretty hacky...we convert a single quoted char into a double
-		// quoted string in order to support single quoted strings.
-		t.peek.Value = fmt.Sprintf("\"%s\"", t.peek.Value[1:len(t.peek.Value)-1])
-		fallthrough
-	case scanner.String:
-		s, err := strconv.Unquote(t.peek.Value)
+		// Single quoted literals are decoded with their escapes, eg. '\n' or '\'', and may
+		// contain more than one character in order to support single quoted strings.
+		s, err := unquote(token.Value)
 		if err != nil {
-			Panic(t.peek.Pos, err.Error())
+			Panicf(token.Pos, "invalid char literal %s: %s", token.Value, err)
 		}
-		t.peek.Value = s
-		if t.peek.Type == scanner.Char && utf8.RuneCountInString(s) > 1 {
-			t.peek.Type = scanner.String
+		token.Value = s
+		if utf8.RuneCountInString(s) > 1 {
+			token.Type = scanner.String
+		}
+	case scanner.String:
+		s, err := strconv.Unquote(token.Value)
+		if err != nil {
+			Panic(token.Pos, err.Error())
 		}
+		token.Value = s
 	case scanner.RawString:
-		t.peek.Value = t.peek.Value[1 : len(t.peek.Value)-1]
+		token.Value = token.Value[1 : len(token.Value)-1]
 	}
-	return *t.peek
+	return token
 }
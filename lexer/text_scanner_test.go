@@ -22,6 +22,55 @@ func TestLexer(t *testing.T) {
 	assert.Equal(t, Token{Type: scanner.EOF, Value: "", Pos: eofPos}, lexer.Next())
 }
 
+func TestLexerPeekN(t *testing.T) {
+	lexer := LexString("a = = b").(Lookahead)
+	assert.Equal(t, "a", lexer.PeekN(0).Value)
+	assert.Equal(t, "=", lexer.PeekN(2).Value)
+	assert.Equal(t, "b", lexer.PeekN(3).Value)
+	assert.True(t, lexer.PeekN(10).EOF())
+	assert.Equal(t, "a", lexer.Next().Value)
+	assert.Equal(t, "b", lexer.PeekN(2).Value)
+	assert.True(t, lexer.PeekN(3).EOF())
+}
+
+func TestBuffer(t *testing.T) {
+	def := Elide(DefaultDefinition, "Comment")
+	lexer := Buffer(def.Lex(strings.NewReader("a /* comment */ b c")))
+	assert.Equal(t, "c", lexer.PeekN(2).Value)
+	assert.Equal(t, "a", lexer.Peek().Value)
+	assert.Equal(t, "a", lexer.Next().Value)
+	assert.Equal(t, "b", lexer.Next().Value)
+	assert.Equal(t, "c", lexer.Next().Value)
+	assert.True(t, lexer.PeekN(1).EOF())
+	assert.True(t, lexer.Next().EOF())
+	assert.True(t, lexer.Next().EOF())
+
+	direct := LexString("a")
+	assert.Equal(t, direct, Buffer(direct))
+}
+
+func TestTokenTypeName(t *testing.T) {
+	assert.Equal(t, "Ident", TokenTypeName(scanner.Ident))
+	assert.Equal(t, "EOF", TokenTypeName(EOF))
+	assert.Equal(t, "RawString", TokenTypeName(scanner.RawString))
+	assert.Equal(t, "'='", TokenTypeName('='))
+	assert.Equal(t, "token type -20", TokenTypeName(-20))
+}
+
+func TestLexEOL(t *testing.T) {
+	eol := TextScannerLexerWithEOL.Symbols()["EOL"]
+	tokens, err := ConsumeAll(TextScannerLexerWithEOL.Lex(strings.NewReader("a b\n\n\nc\n")))
+	assert.NoError(t, err)
+	types := []rune{}
+	for _, token := range tokens {
+		types = append(types, token.Type)
+	}
+	assert.Equal(t, []rune{scanner.Ident, scanner.Ident, eol, eol, eol, scanner.Ident, eol, scanner.EOF}, types)
+	assert.Equal(t, Position{Offset: 3, Line: 1, Column: 4}, tokens[2].Pos)
+	_, ok := TextScannerLexer.Symbols()["EOL"]
+	assert.False(t, ok)
+}
+
 func TestLexString(t *testing.T) {
 	lexer := LexString(`"hello\nworld"`)
 	assert.Equal(t, lexer.Next(), Token{Type: scanner.String, Value: "hello\nworld", Pos: Position{Line: 1, Column: 1}})
@@ -45,3 +94,36 @@ func BenchmarkTextScannerLexer(b *testing.B) {
 		ConsumeAll(lex)
 	}
 }
+
+func TestLexFloat(t *testing.T) {
+	lexer := LexString(`3.14 42`)
+	assert.Equal(t, Token{Type: scanner.Float, Value: "3.14", Pos: Position{Line: 1, Column: 1}}, lexer.Next())
+	assert.Equal(t, Token{Type: scanner.Int, Value: "42", Pos: Position{Offset: 4, Line: 1, Column: 5}}, lexer.Next())
+}
+
+func TestLexCharEscapes(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`'a'`, "a"},
+		{`'\n'`, "\n"},
+		{`'\''`, "'"},
+		{`'"'`, `"`},
+		{`'\\'`, `\`},
+		{`'\x41'`, "A"},
+		{`'é'`, "é"},
+		{`'\U0001F600'`, "\U0001F600"},
+		{`'界'`, "界"},
+	}
+	for _, test := range tests {
+		lexer := LexString(test.input)
+		assert.Equal(t, Token{Type: scanner.Char, Value: test.expected, Pos: Position{Line: 1, Column: 1}}, lexer.Next(), test.input)
+	}
+}
+
+func TestLexInvalidCharEscape(t *testing.T) {
+	_, err := ConsumeAll(LexString(`a '\q'`))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "char escape")
+}
@@ -0,0 +1,222 @@
+package participle
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// UnusedTokens returns the names of token types provided by the lexer that are never referenced
+// by the grammar.
+//
+// Unused token types are often a sign that the lexer and grammar are out of sync.
+func (p *Parser) UnusedTokens() []string {
+	used := map[rune]bool{}
+	visit(p.root, func(n node) {
+		switch n := n.(type) {
+		case *tokenReference:
+			used[n.typ] = true
+		case *literal:
+			used[n.t] = true
+		case *path:
+			used[n.ident] = true
+		case *keyed:
+			used[n.ident] = true
+		case *nested:
+			used[n.ident] = true
+		}
+	})
+	unused := []string{}
+	for name, typ := range p.lex.Symbols() {
+		if name != "EOF" && !used[typ] {
+			unused = append(unused, name)
+		}
+	}
+	sort.Strings(unused)
+	return unused
+}
+
+// Warnings returns descriptions of grammar constructs that are legal but likely to match
+// surprisingly, prefixed by the enclosing production.
+//
+// Currently this reports repetitions whose body leads with an optional element, eg.
+// `{ [ @A ] @B }`. Such a body can begin matching without consuming input, so each iteration is
+// only committed once a later element matches. The canonical form is to make the leading element
+// of the repetition required, eg. `{ @B }` or `{ @A [ @B ] | @B }`.
+func (p *Parser) Warnings() []string {
+	out := []string{}
+	peg := &pegWriter{seen: map[*strct]bool{}}
+	visitProductions(p.root, func(production string, n node) {
+		if r, ok := n.(*repetition); ok && leadsWithOptional(r.node) {
+			out = append(out, fmt.Sprintf("%s: repetition %s leads with an optional element", production, peg.node(r)))
+		}
+	})
+	return out
+}
+
+// Returns true if n may begin by matching without consuming any input.
+func leadsWithOptional(n node) bool {
+	switch n := n.(type) {
+	case sequence:
+		return leadsWithOptional(n[0])
+	case disjunction:
+		for _, alt := range n {
+			if leadsWithOptional(alt) {
+				return true
+			}
+		}
+	case *reference:
+		return leadsWithOptional(n.node)
+	case *labelled:
+		return leadsWithOptional(n.node)
+	case *optional:
+		return true
+	case *repetition:
+		return n.min == 0 || leadsWithOptional(n.node)
+	}
+	return false
+}
+
+// Validate checks the grammar for left recursion, where a production can reach itself without
+// consuming any input, eg. an Expr struct whose first field is an *Expr captured with `@@`.
+// Parsing such a production would otherwise recurse until the stack overflows.
+//
+// The error names the productions forming the first cycle found, eg.
+// `left recursion: Expr -> Sum -> Expr`.
+func (p *Parser) Validate() error {
+	v := &leftRecursion{nullable: map[*strct]bool{}, state: map[*strct]int{}}
+	var cycle []string
+	visit(p.root, func(n node) {
+		if s, ok := n.(*strct); ok && cycle == nil {
+			cycle = v.find(s)
+		}
+	})
+	if cycle != nil {
+		return fmt.Errorf("left recursion: %s", strings.Join(cycle, " -> "))
+	}
+	return nil
+}
+
+// Finds cycles of productions that reach each other without consuming input.
+type leftRecursion struct {
+	// Whether each production may match without consuming input, once computed.
+	nullable map[*strct]bool
+	// 1 while a production is on the stack being searched, 2 once it has been.
+	state map[*strct]int
+	stack []*strct
+}
+
+// Returns the names of the productions of a cycle reachable from s, first and last the same, or
+// nil if there is none.
+func (l *leftRecursion) find(s *strct) (cycle []string) {
+	switch l.state[s] {
+	case 1:
+		for i := len(l.stack) - 1; i >= 0; i-- {
+			if l.stack[i] == s {
+				for _, t := range l.stack[i:] {
+					cycle = append(cycle, pegName(t))
+				}
+				return append(cycle, pegName(s))
+			}
+		}
+	case 2:
+		return nil
+	}
+	l.state[s] = 1
+	l.stack = append(l.stack, s)
+	l.leftmost(s.expr, func(t *strct) {
+		if cycle == nil {
+			cycle = l.find(t)
+		}
+	})
+	l.stack = l.stack[:len(l.stack)-1]
+	l.state[s] = 2
+	return cycle
+}
+
+// Calls fn with each production that n may parse before consuming any input.
+func (l *leftRecursion) leftmost(n node, fn func(s *strct)) {
+	switch n := n.(type) {
+	case *strct:
+		fn(n)
+	case sequence:
+		for _, e := range n {
+			l.leftmost(e, fn)
+			if !l.isNullable(e) {
+				return
+			}
+		}
+	case *atLeastOne:
+		for _, e := range n.elements {
+			l.leftmost(e, fn)
+			if !l.isNullable(e) {
+				return
+			}
+		}
+	case disjunction:
+		for _, alt := range n {
+			l.leftmost(alt, fn)
+		}
+	case *unordered:
+		for _, e := range n.elements {
+			l.leftmost(e, fn)
+		}
+	case *reference:
+		l.leftmost(n.node, fn)
+	case *labelled:
+		l.leftmost(n.node, fn)
+	case *optional:
+		l.leftmost(n.node, fn)
+	case *repetition:
+		l.leftmost(n.node, fn)
+	case *lookahead:
+		l.leftmost(n.node, fn)
+	case *negation:
+		l.leftmost(n.node, fn)
+	}
+}
+
+// Returns true if n may match without consuming any input.
+func (l *leftRecursion) isNullable(n node) bool {
+	switch n := n.(type) {
+	case *strct:
+		if nullable, ok := l.nullable[n]; ok {
+			return nullable
+		}
+		// Assume a production reached recursively consumes input, as otherwise it is left
+		// recursive, which is reported regardless.
+		l.nullable[n] = false
+		l.nullable[n] = l.isNullable(n.expr)
+		return l.nullable[n]
+	case sequence:
+		for _, e := range n {
+			if !l.isNullable(e) {
+				return false
+			}
+		}
+		return true
+	case disjunction:
+		for _, alt := range n {
+			if l.isNullable(alt) {
+				return true
+			}
+		}
+		return false
+	case *unordered:
+		for _, e := range n.elements {
+			if !l.isNullable(e) {
+				return false
+			}
+		}
+		return true
+	case *reference:
+		return l.isNullable(n.node)
+	case *labelled:
+		return l.isNullable(n.node)
+	case *repetition:
+		return n.min == 0 || l.isNullable(n.node)
+	case *optional, *lookahead, *unary:
+		return true
+	}
+	return false
+}
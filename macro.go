@@ -0,0 +1,180 @@
+package participle
+
+import (
+	"reflect"
+	"strings"
+	"text/scanner"
+	"unicode"
+)
+
+// Limit on nested macro expansion, to catch macros that expand recursively.
+const maxMacroDepth = 16
+
+// A grammar fragment defined by a `macro:"<name>(<param>, ...) <body>"` tag.
+//
+// Each %<name>(<arg>, ...) in the grammar is replaced by the body, with each parameter replaced
+// by its argument.
+type macro struct {
+	name   string
+	params []string
+	body   string
+}
+
+// Macros by name.
+type macros map[string]*macro
+
+// Define the macros in the `macro` tags of the fields of t.
+func (m macros) define(t reflect.Type) {
+	for _, field := range grammarFields(t) {
+		definition, ok := field.Tag.Lookup("macro")
+		if !ok {
+			continue
+		}
+		def := parseMacro(definition)
+		if existing, ok := m[def.name]; ok && !reflect.DeepEqual(existing, def) {
+			panicf("%s: macro %q is already defined", field.Name, def.name)
+		}
+		m[def.name] = def
+	}
+}
+
+func parseMacro(definition string) *macro {
+	s := newTagScanner(definition)
+	if s.Scan() != scanner.Ident {
+		panicf("invalid macro %q: expected a name", definition)
+	}
+	m := &macro{name: s.TokenText()}
+	if s.Scan() != '(' {
+		panicf("invalid macro %q: expected ( after name", definition)
+	}
+	for token := s.Scan(); token != ')'; token = s.Scan() {
+		if len(m.params) > 0 {
+			if token != ',' {
+				panicf("invalid macro %q: expected , or ) but got %q", definition, s.TokenText())
+			}
+			token = s.Scan()
+		}
+		if token != scanner.Ident {
+			panicf("invalid macro %q: expected a parameter name but got %q", definition, s.TokenText())
+		}
+		m.params = append(m.params, s.TokenText())
+	}
+	m.body = strings.TrimSpace(definition[s.Pos().Offset:])
+	return m
+}
+
+// Expand each macro invocation in tag.
+func (m macros) expand(tag string, depth int) string {
+	if !strings.Contains(tag, "%") {
+		return tag
+	}
+	if depth > maxMacroDepth {
+		panicf("macro expansion exceeds a depth of %d, is a macro recursive?", maxMacroDepth)
+	}
+	out := ""
+	last := 0
+	s := newTagScanner(tag)
+	for token := s.Scan(); token != scanner.EOF; {
+		if token != '%' {
+			token = s.Scan()
+			continue
+		}
+		// Anything but %<name>( is not a macro, eg. the separator of a repetition.
+		start := s.Position.Offset
+		if token = s.Scan(); token != scanner.Ident {
+			continue
+		}
+		for unicode.IsSpace(s.Peek()) {
+			s.Next()
+		}
+		if s.Peek() != '(' {
+			token = s.Scan()
+			continue
+		}
+		def, ok := m[s.TokenText()]
+		if !ok {
+			panicf("unknown macro %q", s.TokenText())
+		}
+		args := macroArguments(s, tag, def.name)
+		if len(args) != len(def.params) {
+			panicf("macro %q expects %d arguments but got %d", def.name, len(def.params), len(args))
+		}
+		out += tag[last:start] + "(" + m.expand(def.substitute(args), depth+1) + ")"
+		last = s.Pos().Offset
+		token = s.Scan()
+	}
+	return out + tag[last:]
+}
+
+// Scan the arguments of an invocation of the named macro in src, each as its source text.
+func macroArguments(s *scanner.Scanner, src string, name string) []string {
+	if s.Scan() != '(' {
+		panicf("expected ( after macro %q but got %q", name, s.TokenText())
+	}
+	args := []string{}
+	start := s.Pos().Offset
+	tokens := 0
+	depth := 0
+	for {
+		token := s.Scan()
+		switch {
+		case token == scanner.EOF:
+			panicf("unterminated arguments to macro %q", name)
+
+		case (token == ',' || token == ')') && depth == 0:
+			arg := strings.TrimSpace(src[start:s.Position.Offset])
+			if arg == "" {
+				if token == ')' && len(args) == 0 {
+					return args
+				}
+				panicf("empty argument to macro %q", name)
+			}
+			// Arguments of several tokens are grouped, so that they substitute as a single term.
+			if tokens > 1 {
+				arg = "(" + arg + ")"
+			}
+			args = append(args, arg)
+			if token == ')' {
+				return args
+			}
+			start = s.Pos().Offset
+			tokens = 0
+			continue
+
+		case token == '(' || token == '[' || token == '{':
+			depth++
+
+		case token == ')' || token == ']' || token == '}':
+			depth--
+		}
+		tokens++
+	}
+}
+
+// Returns the body of the macro with each parameter replaced by the corresponding argument.
+func (m *macro) substitute(args []string) string {
+	out := ""
+	last := 0
+	s := newTagScanner(m.body)
+	for token := s.Scan(); token != scanner.EOF; token = s.Scan() {
+		if token != scanner.Ident {
+			continue
+		}
+		for i, param := range m.params {
+			if s.TokenText() == param {
+				out += m.body[last:s.Position.Offset] + args[i]
+				last = s.Pos().Offset
+				break
+			}
+		}
+	}
+	return out + m.body[last:]
+}
+
+// Returns a scanner over the tokens of a struct tag, as lexed by the grammar.
+func newTagScanner(tag string) *scanner.Scanner {
+	s := &scanner.Scanner{}
+	s.Init(strings.NewReader(tag))
+	s.Error = func(*scanner.Scanner, string) {}
+	return s
+}
@@ -0,0 +1,624 @@
+package participle
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A MarshalOption modifies how Parser.Marshal() lays out its output.
+type MarshalOption func(m *marshaller)
+
+// Indent places each element of a repetition of structs (eg. `{ @@ }`) on its own line, indented
+// by unit for each level of nesting.
+func Indent(unit string) MarshalOption {
+	return func(m *marshaller) {
+		m.indent = unit
+		m.pretty = true
+	}
+}
+
+// BreakAfter starts a new line after each of the given literals, eg. ";".
+func BreakAfter(literals ...string) MarshalOption {
+	return func(m *marshaller) {
+		for _, literal := range literals {
+			m.breakAfter[literal] = true
+		}
+	}
+}
+
+// Marshal renders v, which must be a pointer to a value of the grammar type, back into source.
+//
+// The grammar is walked in the same order as when parsing, with alternatives and optional
+// elements selected based on which fields of v are set. Tokens are separated by a single space
+// unless options dictate otherwise. Values captured from String, RawString or Char tokens are
+// quoted.
+func (p *Parser) Marshal(v interface{}, options ...MarshalOption) (out []byte, err error) {
+	defer func() {
+		if msg := recover(); msg != nil {
+			err = fmt.Errorf("%s", msg)
+		}
+	}()
+	m := &marshaller{breakAfter: map[string]bool{}}
+	for _, option := range options {
+		option(m)
+	}
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	pieces, _, ok := m.marshal(p.root, &marshalScope{value: rv, cursors: map[int]int{}}, 0)
+	if !ok {
+		return nil, fmt.Errorf("value of type %s does not match the grammar", rv.Type())
+	}
+	return []byte(m.render(pieces)), nil
+}
+
+type marshaller struct {
+	pretty     bool
+	indent     string
+	breakAfter map[string]bool
+}
+
+// A piece of output, either a token or a line break at a given depth.
+type marshalPiece struct {
+	text  string
+	br    bool
+	depth int
+}
+
+// The struct currently being marshalled, and the next element to consume from each slice field.
+//
+// Within an optional or repetition a field holding its zero value is treated as absent.
+type marshalScope struct {
+	value    reflect.Value
+	cursors  map[int]int
+	optional bool
+}
+
+func (s *marshalScope) save() map[int]int {
+	saved := map[int]int{}
+	for k, v := range s.cursors {
+		saved[k] = v
+	}
+	return saved
+}
+
+// Marshal a node, returning the output, how many captured values were consumed, and whether the
+// node matched.
+func (m *marshaller) marshal(n node, scope *marshalScope, depth int) (out []marshalPiece, captured int, ok bool) { // nolint: gocyclo
+	switch n := n.(type) {
+	case *strct:
+		if n.binary != nil && scope.value.FieldByIndex(n.binary.op.Index).String() != "" {
+			return m.marshalBinary(n, scope.value, depth)
+		}
+		return m.marshal(n.expr, &marshalScope{value: scope.value, cursors: map[int]int{}}, depth)
+
+	case disjunction:
+		// Alternatives are selected by the fields that are set, so zero values are first treated
+		// as absent, and only captured if no alternative matches without them.
+		passes := []bool{true}
+		if !scope.optional {
+			passes = append(passes, false)
+		}
+		defer func(optional bool) { scope.optional = optional }(scope.optional)
+		for _, optional := range passes {
+			scope.optional = optional
+			for _, alt := range n {
+				saved := scope.save()
+				if out, captured, ok = m.marshal(alt, scope, depth); ok {
+					return out, captured, true
+				}
+				scope.cursors = saved
+			}
+		}
+		return nil, 0, false
+
+	case sequence:
+		for _, child := range n {
+			pieces, c, ok := m.marshal(child, scope, depth)
+			if !ok {
+				return nil, 0, false
+			}
+			out = append(out, pieces...)
+			captured += c
+		}
+		return out, captured, true
+
+	case *optional:
+		saved := scope.save()
+		defer func(optional bool) { scope.optional = optional }(scope.optional)
+		scope.optional = true
+		if out, captured, ok = m.marshal(n.node, scope, depth); ok && captured > 0 {
+			return out, captured, true
+		}
+		scope.cursors = saved
+		return nil, 0, true
+
+	case *repetition:
+		defer func(optional bool) { scope.optional = optional }(scope.optional)
+		scope.optional = true
+		br := m.pretty && startsWithStruct(n.node)
+		inner := depth
+		if br {
+			inner++
+		}
+		count := 0
+		for n.max == 0 || count < n.max {
+			saved := scope.save()
+			pieces, c, ok := m.marshal(n.node, scope, inner)
+			if !ok || c == 0 {
+				scope.cursors = saved
+				break
+			}
+			if n.separator != nil && count > 0 {
+				sep, _, ok := m.marshal(n.separator, scope, inner)
+				if !ok {
+					scope.cursors = saved
+					break
+				}
+				pieces = append(sep, pieces...)
+			}
+			if br {
+				out = append(out, marshalPiece{br: true, depth: depth})
+			}
+			out = append(out, pieces...)
+			captured += c
+			count++
+		}
+		if count < n.min {
+			return nil, 0, false
+		}
+		if br && count > 0 && depth > 0 {
+			out = append(out, marshalPiece{br: true, depth: depth - 1})
+		}
+		return out, captured, true
+
+	case *literal:
+		return m.token(n.s, n.s), 0, true
+
+	case *reference:
+		if n.index {
+			return m.marshalIndex(n, scope, depth)
+		}
+		return m.marshalReference(n.field, n.node, scope, depth)
+
+	case *unary:
+		return m.marshalReference(n.field, n, scope, depth)
+
+	case *path:
+		return m.marshalReference(n.field, n, scope, depth)
+
+	case *keyed:
+		return m.marshalKeyed(n, scope)
+
+	case *nested:
+		return m.marshalNested(n, scope)
+
+	case *balanced:
+		pieces, captured, ok := m.marshalReference(n.field, n.node, scope, depth)
+		if !ok {
+			return nil, 0, false
+		}
+		out = append(m.token(n.open, n.open), pieces...)
+		return append(out, m.token(n.close, n.close)...), captured, true
+
+	case *atLeastOne:
+		for _, child := range n.elements {
+			pieces, c, ok := m.marshal(child, scope, depth)
+			if !ok {
+				return nil, 0, false
+			}
+			out = append(out, pieces...)
+			captured += c
+		}
+		return out, captured, captured > 0
+
+	case *unordered:
+		// Elements are marshalled in grammar order, which is always a valid ordering.
+		for _, child := range n.elements {
+			pieces, c, ok := m.marshal(child, scope, depth)
+			if !ok {
+				return nil, 0, false
+			}
+			out = append(out, pieces...)
+			captured += c
+		}
+		return out, captured, true
+
+	case *labelled:
+		// Only the alternative whose label was recorded is marshalled.
+		if scope.value.FieldByIndex(n.field.Index).String() != n.label {
+			return nil, 0, false
+		}
+		return m.marshal(n.node, scope, depth)
+
+	case *factory:
+		return m.marshalFactory(n, scope, depth)
+
+	case *lookahead:
+		// Lookahead does not consume input, so there is nothing to emit.
+		return nil, 0, true
+
+	case *tokenReference, *negation:
+		// Uncaptured tokens can not be reconstructed.
+		return nil, 0, false
+
+	case *parseable:
+		panicf("can not marshal custom Parseable type %s", n.t)
+	}
+	panicf("can not marshal node type %T", n)
+	return nil, 0, false
+}
+
+// Marshal the value of field, as captured by node n.
+func (m *marshaller) marshalReference(field reflect.StructField, n node, scope *marshalScope, depth int) ([]marshalPiece, int, bool) {
+	fv := scope.value.FieldByIndex(field.Index)
+	values := []reflect.Value{}
+	switch {
+	case fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() != reflect.Uint8:
+		cursor := scope.cursors[field.Index[0]]
+		if cursor >= fv.Len() {
+			return nil, 0, false
+		}
+		// Captures that match repeatedly, such as @Int+, consume all remaining elements.
+		end := cursor + 1
+		if _, ok := n.(*repetition); ok {
+			end = fv.Len()
+		}
+		if _, ok := n.(*unary); ok {
+			end = fv.Len()
+		}
+		if _, ok := n.(*path); ok {
+			end = fv.Len()
+		}
+		for i := cursor; i < end; i++ {
+			values = append(values, fv.Index(i))
+		}
+		scope.cursors[field.Index[0]] = end
+
+	case isZero(fv) && (scope.optional || isNil(fv)):
+		return nil, 0, false
+
+	default:
+		// Scalar fields are only consumed once.
+		if scope.cursors[field.Index[0]] > 0 {
+			return nil, 0, false
+		}
+		scope.cursors[field.Index[0]] = 1
+		values = append(values, fv)
+	}
+
+	if s, ok := n.(*strct); ok {
+		out := []marshalPiece{}
+		for _, v := range values {
+			pieces, _, ok := m.marshal(s, &marshalScope{value: reflect.Indirect(v)}, depth)
+			if !ok {
+				return nil, 0, false
+			}
+			out = append(out, pieces...)
+		}
+		return out, len(values), true
+	}
+
+	out := []marshalPiece{}
+	switch n := n.(type) {
+	case *path:
+		segments := []string{}
+		for _, v := range values {
+			segments = append(segments, valueText(v))
+		}
+		return m.token(strings.Join(segments, n.sep), ""), len(values), true
+
+	case *literal:
+		// A literal captured into a bool field emits the literal itself.
+		if values[0].Kind() == reflect.Bool {
+			return m.token(n.s, n.s), 1, true
+		}
+	}
+	// Captures of literals only, eg. @("GET" | "POST"), emit the literals the value was captured
+	// from, failing if it could not have been.
+	if alternatives := literalAlternatives(n); alternatives != nil && reflect.Indirect(values[0]).Kind() == reflect.String {
+	next:
+		for _, v := range values {
+			text := valueText(v)
+			for _, literals := range alternatives {
+				if strings.Join(literals, "") == text {
+					for _, literal := range literals {
+						out = append(out, m.token(literal, literal)...)
+					}
+					continue next
+				}
+			}
+			return nil, 0, false
+		}
+		return out, len(values), true
+	}
+	quote := capturesQuoted(n)
+	layout, isTime := field.Tag.Lookup("time")
+	_, isRune := field.Tag.Lookup("rune")
+	for _, v := range values {
+		text := valueText(v)
+		if t, ok := reflect.Indirect(v).Interface().(time.Time); ok && isTime {
+			text = t.Format(layout)
+		}
+		if isRune {
+			text = string(rune(reflect.Indirect(v).Int()))
+		}
+		// Quoted values render their own quotes.
+		if _, ok := reflect.Indirect(v).Interface().(Quoted); ok {
+			out = append(out, m.token(text, text)...)
+			continue
+		}
+		if quote {
+			text = strconv.Quote(text)
+		}
+		out = append(out, m.token(text, text)...)
+	}
+	return out, len(values), true
+}
+
+// Marshal a struct combining its Left and Right operands with a binary operator.
+func (m *marshaller) marshalBinary(n *strct, value reflect.Value, depth int) ([]marshalPiece, int, bool) {
+	left, right := value.FieldByIndex(n.binary.left), value.FieldByIndex(n.binary.right)
+	if left.IsNil() || right.IsNil() {
+		return nil, 0, false
+	}
+	out, captured, ok := m.marshal(n, &marshalScope{value: left.Elem()}, depth)
+	if !ok {
+		return nil, 0, false
+	}
+	op := value.FieldByIndex(n.binary.op.Index).String()
+	out = append(out, m.token(op, op)...)
+	pieces, c, ok := m.marshal(n, &marshalScope{value: right.Elem()}, depth)
+	if !ok {
+		return nil, 0, false
+	}
+	return append(out, pieces...), captured + 1 + c, true
+}
+
+// Marshal the value of a factory field as its discriminator followed by the value.
+func (m *marshaller) marshalFactory(n *factory, scope *marshalScope, depth int) ([]marshalPiece, int, bool) {
+	fv := scope.value.FieldByIndex(n.field.Index)
+	cursor := scope.cursors[n.field.Index[0]]
+	if fv.Kind() == reflect.Slice {
+		if cursor >= fv.Len() {
+			return nil, 0, false
+		}
+		fv = fv.Index(cursor)
+	} else if cursor > 0 {
+		return nil, 0, false
+	}
+	if fv.IsNil() {
+		return nil, 0, false
+	}
+	value := reflect.Indirect(fv.Elem())
+	for _, discriminator := range n.discriminators() {
+		s, ok := n.types[discriminator].(*strct)
+		if !ok || s.typ != value.Type() {
+			continue
+		}
+		scope.cursors[n.field.Index[0]] = cursor + 1
+		out := m.token(discriminator, discriminator)
+		if n.sep != "" {
+			out = append(out, m.token(n.sep, n.sep)...)
+		}
+		pieces, _, ok := m.marshal(s, &marshalScope{value: value}, depth)
+		return append(out, pieces...), 1, ok
+	}
+	panicf("no discriminator is registered for type %s", value.Type())
+	return nil, 0, false
+}
+
+// Marshal the alternative whose index was captured by a field tagged with `index`.
+func (m *marshaller) marshalIndex(n *reference, scope *marshalScope, depth int) ([]marshalPiece, int, bool) {
+	fv := reflect.Indirect(scope.value.FieldByIndex(n.field.Index))
+	cursor := scope.cursors[n.field.Index[0]]
+	if fv.Kind() == reflect.Slice {
+		if cursor >= fv.Len() {
+			return nil, 0, false
+		}
+		fv = fv.Index(cursor)
+	} else if !fv.IsValid() || cursor > 0 {
+		return nil, 0, false
+	}
+	scope.cursors[n.field.Index[0]] = cursor + 1
+	alternatives := n.node.(disjunction)
+	i, err := strconv.Atoi(valueText(fv))
+	if err != nil || i < 0 || i >= len(alternatives) {
+		return nil, 0, false
+	}
+	pieces, _, ok := m.marshal(alternatives[i], scope, depth)
+	return pieces, 1, ok
+}
+
+// Marshal each non-zero field of a struct captured by a `keys` tag as a key/value assignment.
+func (m *marshaller) marshalKeyed(n *keyed, scope *marshalScope) (out []marshalPiece, captured int, ok bool) {
+	sv := reflect.Indirect(scope.value.FieldByIndex(n.field.Index))
+	if !sv.IsValid() {
+		return nil, 0, true
+	}
+	for _, key := range n.keys {
+		fv := sv.FieldByIndex(n.fields[key].Index)
+		if isZero(fv) {
+			continue
+		}
+		text := valueText(fv)
+		if reflect.Indirect(fv).Kind() == reflect.String {
+			text = strconv.Quote(text)
+		}
+		out = append(out, m.token(key, key)...)
+		out = append(out, m.token(n.sep, n.sep)...)
+		out = append(out, m.token(text, text)...)
+		captured++
+	}
+	return out, captured, true
+}
+
+// Marshal the leaves of a nested map captured by a `nested` tag as assignments to separated keys,
+// in sorted order.
+func (m *marshaller) marshalNested(n *nested, scope *marshalScope) (out []marshalPiece, captured int, ok bool) {
+	var walk func(prefix string, tree map[string]interface{})
+	walk = func(prefix string, tree map[string]interface{}) {
+		keys := []string{}
+		for key := range tree {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if child, ok := tree[key].(map[string]interface{}); ok {
+				walk(prefix+key+n.sep, child)
+				continue
+			}
+			text := fmt.Sprint(tree[key])
+			if _, ok := tree[key].(string); ok {
+				text = strconv.Quote(text)
+			}
+			out = append(out, m.token(prefix+key, "")...)
+			out = append(out, m.token("=", "=")...)
+			out = append(out, m.token(text, text)...)
+			captured++
+		}
+	}
+	tree, _ := scope.value.FieldByIndex(n.field.Index).Interface().(map[string]interface{})
+	walk("", tree)
+	return out, captured, true
+}
+
+// Emit a token, followed by a line break if it is a BreakAfter literal.
+func (m *marshaller) token(text, literal string) []marshalPiece {
+	out := []marshalPiece{{text: text}}
+	if m.breakAfter[literal] {
+		out = append(out, marshalPiece{br: true, depth: -1})
+	}
+	return out
+}
+
+// Join pieces into the final output.
+func (m *marshaller) render(pieces []marshalPiece) string {
+	out := &bytes.Buffer{}
+	depth := 0
+	pendingBreak := false
+	for _, piece := range pieces {
+		if piece.br {
+			pendingBreak = true
+			if piece.depth >= 0 {
+				depth = piece.depth
+			}
+			continue
+		}
+		if out.Len() > 0 {
+			if pendingBreak {
+				out.WriteString("\n" + strings.Repeat(m.indent, depth))
+			} else {
+				out.WriteString(" ")
+			}
+		}
+		pendingBreak = false
+		out.WriteString(piece.text)
+	}
+	return out.String()
+}
+
+// Returns true if n begins by capturing a struct.
+func startsWithStruct(n node) bool {
+	switch n := n.(type) {
+	case sequence:
+		return startsWithStruct(n[0])
+	case disjunction:
+		for _, alt := range n {
+			if startsWithStruct(alt) {
+				return true
+			}
+		}
+	case *reference:
+		_, ok := n.node.(*strct)
+		return ok
+	}
+	return false
+}
+
+// Returns the sequences of literals n matches, if it matches only literals, eg. [["GET"], ["POST"]]
+// for "GET" | "POST", otherwise nil.
+func literalAlternatives(n node) [][]string {
+	switch n := n.(type) {
+	case *literal:
+		return [][]string{{n.s}}
+
+	case disjunction:
+		out := [][]string{}
+		for _, alt := range n {
+			alternatives := literalAlternatives(alt)
+			if alternatives == nil {
+				return nil
+			}
+			out = append(out, alternatives...)
+		}
+		return out
+
+	case sequence:
+		out := [][]string{{}}
+		for _, child := range n {
+			alternatives := literalAlternatives(child)
+			if alternatives == nil {
+				return nil
+			}
+			product := [][]string{}
+			for _, prefix := range out {
+				for _, suffix := range alternatives {
+					product = append(product, append(append([]string{}, prefix...), suffix...))
+				}
+			}
+			out = product
+		}
+		return out
+	}
+	return nil
+}
+
+// Returns true if n captures tokens that must be quoted when marshalled.
+func capturesQuoted(n node) bool {
+	switch n := n.(type) {
+	case *tokenReference:
+		switch n.identifier {
+		case "String", "RawString", "Char":
+			return true
+		}
+	case disjunction:
+		for _, alt := range n {
+			if capturesQuoted(alt) {
+				return true
+			}
+		}
+	case *repetition:
+		return capturesQuoted(n.node)
+	case *optional:
+		return capturesQuoted(n.node)
+	}
+	return false
+}
+
+func valueText(v reflect.Value) string {
+	v = reflect.Indirect(v)
+	if v.Kind() == reflect.Slice {
+		return string(v.Bytes())
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+func isZero(v reflect.Value) bool {
+	if isNil(v) {
+		return true
+	}
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
+
+// Returns true if v is a nil pointer, interface, map or slice, which can never be marshalled.
+func isNil(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice:
+		return v.IsNil()
+	}
+	return false
+}
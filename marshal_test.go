@@ -0,0 +1,123 @@
+package participle
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type marshalINI struct {
+	Properties []*marshalProperty `{ @@ }`
+	Sections   []*marshalSection  `{ @@ }`
+}
+
+type marshalSection struct {
+	Name       string             `"[" @Ident "]"`
+	Properties []*marshalProperty `{ @@ }`
+}
+
+type marshalProperty struct {
+	Key    string   `@Ident "="`
+	String *string  `( @String`
+	Number *float64 `| @(Float | Int) )`
+}
+
+func TestMarshal(t *testing.T) {
+	parser := mustTestParser(t, &marshalINI{})
+
+	ini := &marshalINI{}
+	err := parser.ParseString(`age = 21 name = "Bob Smith" [address] city = "Beverly Hills" postal_code = 90210`, ini)
+	require.NoError(t, err)
+
+	out, err := parser.Marshal(ini)
+	require.NoError(t, err)
+	require.Equal(t, `age = 21 name = "Bob Smith" [ address ] city = "Beverly Hills" postal_code = 90210`, string(out))
+
+	roundtrip := &marshalINI{}
+	err = parser.ParseBytes(out, roundtrip)
+	require.NoError(t, err)
+	require.Equal(t, ini, roundtrip)
+}
+
+func TestMarshalIndent(t *testing.T) {
+	type block struct {
+		Name   string   `@Ident "{"`
+		Blocks []*block `{ @@ } "}"`
+	}
+	type grammar struct {
+		Blocks []*block `{ @@ }`
+	}
+
+	parser := mustTestParser(t, &grammar{})
+
+	actual := &grammar{}
+	err := parser.ParseString(`a { b { } c { d { } } } e { }`, actual)
+	require.NoError(t, err)
+
+	out, err := parser.Marshal(actual, Indent("  "))
+	require.NoError(t, err)
+	require.Equal(t, `a {
+  b { }
+  c {
+    d { }
+  }
+}
+e { }`, string(out))
+}
+
+func TestMarshalBreakAfter(t *testing.T) {
+	type statement struct {
+		Name string `@Ident ";"`
+	}
+	type grammar struct {
+		Statements []*statement `{ @@ }`
+	}
+
+	parser := mustTestParser(t, &grammar{})
+
+	actual := &grammar{}
+	err := parser.ParseString(`a; b; c;`, actual)
+	require.NoError(t, err)
+
+	out, err := parser.Marshal(actual, BreakAfter(";"))
+	require.NoError(t, err)
+	require.Equal(t, "a ;\nb ;\nc ;", string(out))
+}
+
+func TestMarshalZeroValue(t *testing.T) {
+	type value struct {
+		Int  int    `  @Int`
+		Word string `| @Ident`
+	}
+	type property struct {
+		Key   string `@Ident "="`
+		Value int    `@Int`
+		Unit  string `[ @Ident ]`
+		Other value  `[ "," @@ ]`
+	}
+	type grammar struct {
+		Properties []*property `{ @@ ";" }`
+	}
+
+	parser := mustTestParser(t, &grammar{})
+
+	for source, expected := range map[string]string{
+		`x = 0;`:           `x = 0 ;`,
+		`x = 0 cm; y = 1;`: `x = 0 cm ; y = 1 ;`,
+		`x = 0, a;`:        `x = 0 , a ;`,
+		`x = 0, 1;`:        `x = 0 , 1 ;`,
+	} {
+		actual := &grammar{}
+		err := parser.ParseString(source, actual)
+		require.NoError(t, err, source)
+
+		out, err := parser.Marshal(actual)
+		require.NoError(t, err, source)
+		require.Equal(t, expected, string(out), source)
+
+		roundtrip := &grammar{}
+		err = parser.ParseBytes(out, roundtrip)
+		require.NoError(t, err, source)
+		require.Equal(t, actual, roundtrip, source)
+	}
+}
@@ -1,19 +1,41 @@
 package participle
 
 import (
+	"bytes"
+	"encoding"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/peterebden/participle/lexer"
 )
 
 var (
-	positionType  = reflect.TypeOf(lexer.Position{})
-	captureType   = reflect.TypeOf((*Capture)(nil)).Elem()
-	parseableType = reflect.TypeOf((*Parseable)(nil)).Elem()
+	positionType          = reflect.TypeOf(lexer.Position{})
+	tokensType            = reflect.TypeOf([]lexer.Token{})
+	positionsType         = reflect.TypeOf([]lexer.Position{})
+	byteType              = reflect.TypeOf(byte(0))
+	captureType           = reflect.TypeOf((*Capture)(nil)).Elem()
+	contextCaptureType    = reflect.TypeOf((*ContextCapture)(nil)).Elem()
+	positionCaptureType   = reflect.TypeOf((*PositionCapture)(nil)).Elem()
+	binaryUnmarshalerType = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+	textUnmarshalerType   = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	parseableType         = reflect.TypeOf((*Parseable)(nil)).Elem()
+	posSetterType         = reflect.TypeOf((*PosSetter)(nil)).Elem()
+	timeType              = reflect.TypeOf(time.Time{})
+	durationType          = reflect.TypeOf(time.Duration(0))
+	int64Type             = reflect.TypeOf(int64(0))
+	jsonNumberType        = reflect.TypeOf(json.Number(""))
+	regexpType            = reflect.TypeOf(&regexp.Regexp{})
+	nestedMapType         = reflect.TypeOf(map[string]interface{}{})
+	runeType              = reflect.TypeOf(rune(0))
 
 	// NextMatch should be returned by Parseable.Parse() method implementations to indicate
 	// that the node did not match and that other matches should be attempted, if appropriate.
@@ -23,17 +45,27 @@ var (
 // A node in the grammar.
 type node interface {
 	// Parse from scanner into value.
-	// Nodes should panic if parsing fails.
-	Parse(lex lexer.Lexer, parent reflect.Value) []reflect.Value
+	// Nodes should return nil if they do not match, or call ctx.fail() and return nil if parsing
+	// fails.
+	Parse(ctx *parseContext, parent reflect.Value) []reflect.Value
 	String() string
 }
 
 func decorate(name string) {
 	if msg := recover(); msg != nil {
+		if _, ok := msg.(captureError); ok {
+			panic(msg)
+		}
 		panic(fmt.Sprintf("%s: %s", name, msg))
 	}
 }
 
+// A positioned error returned by a capture, which fails the parse as is rather than being
+// decorated with the field it was captured into.
+type captureError struct {
+	err *lexer.Error
+}
+
 // A node that proxies to an implementation that implements the Parseable interface.
 type parseable struct {
 	t reflect.Type
@@ -43,15 +75,25 @@ func (p *parseable) String() string {
 	return p.t.String()
 }
 
-func (p *parseable) Parse(lex lexer.Lexer, parent reflect.Value) (out []reflect.Value) {
+func (p *parseable) Parse(ctx *parseContext, parent reflect.Value) (out []reflect.Value) {
 	rv := reflect.New(p.t.Elem())
 	v := rv.Interface().(Parseable)
-	err := v.Parse(lex)
+	start := ctx.checkpoint()
+	pos := ctx.Peek().Pos
+	err := v.Parse(ctx)
 	if err != nil {
 		if err == NextMatch {
+			ctx.restore(start)
 			return nil
 		}
-		panic(err)
+		// A *lexer.Error is reported as is, while other errors are positioned at the start of
+		// the input the Parseable was given.
+		perr, ok := err.(*lexer.Error)
+		if !ok {
+			perr = lexer.Errorf(pos, "%s", err)
+		}
+		ctx.raise(perr)
+		return nil
 	}
 	return []reflect.Value{rv.Elem()}
 }
@@ -59,6 +101,24 @@ func (p *parseable) Parse(lex lexer.Lexer, parent reflect.Value) (out []reflect.
 type strct struct {
 	typ  reflect.Type
 	expr node
+	// Index of a "Tokens []lexer.Token" field, if any.
+	tokensIndex []int
+	// Documentation from a `doc` tag, if any.
+	doc string
+	// Indexes of lexer.Position fields, in order of precedence.
+	posFields [][]int
+	// Inject the position into all of posFields rather than just the first.
+	injectAllPos bool
+	// Pass the position to SetPos, implemented by pointers to the struct, instead of injecting it.
+	posSetter bool
+	// Index of an "EndPos lexer.Position" field, if any.
+	endPosIndex []int
+	// Fields tagged with `default:"<value>"`, set to the value if nothing is captured into them.
+	defaults []reflect.StructField
+	// If non-nil, expr is the operand of binary operators combining structs of this type.
+	binary *binary
+	// Indexes of map fields whose entries are captured with @@, made empty rather than left nil.
+	maps [][]int
 }
 
 func (s *strct) String() string {
@@ -66,31 +126,304 @@ func (s *strct) String() string {
 }
 
 func (s *strct) maybeInjectPos(pos lexer.Position, v reflect.Value) {
-	// Fast path
-	if f := v.FieldByName("Pos"); f.IsValid() && f.Type() == positionType {
-		f.Set(reflect.ValueOf(pos))
+	if s.posSetter {
+		v.Addr().Interface().(PosSetter).SetPos(pos)
+		return
+	}
+	if len(s.posFields) == 0 {
+		return
+	}
+	if !s.injectAllPos {
+		v.FieldByIndex(s.posFields[0]).Set(reflect.ValueOf(pos))
 		return
 	}
+	for _, index := range s.posFields {
+		v.FieldByIndex(index).Set(reflect.ValueOf(pos))
+	}
+}
 
-	// Iterate over fields.
-	for i := 0; i < v.NumField(); i++ {
-		f := v.Field(i)
-		if f.Type() == positionType {
-			f.Set(reflect.ValueOf(pos))
-			break
+func (s *strct) maybeInjectEndPos(pos lexer.Position, v reflect.Value) {
+	if s.endPosIndex != nil {
+		v.FieldByIndex(s.endPosIndex).Set(reflect.ValueOf(pos))
+	}
+}
+
+// Set the fields tagged with `default:"<value>"` that nothing was captured into to their defaults.
+func (s *strct) applyDefaults(ctx *parseContext, pos lexer.Position, sv reflect.Value) {
+	assigned := ctx.assigned[len(ctx.assigned)-1].fields
+	for _, field := range s.defaults {
+		if !assigned[field.Name] {
+			setField(ctx, pos, sv, field, []reflect.Value{reflect.ValueOf(field.Tag.Get("default"))})
 		}
 	}
 }
 
-func (s *strct) Parse(lex lexer.Lexer, parent reflect.Value) (out []reflect.Value) {
+func (s *strct) Parse(ctx *parseContext, parent reflect.Value) (out []reflect.Value) {
+	if ctx.memo != nil {
+		return ctx.memoize(s, func() []reflect.Value { return s.parse(ctx) })
+	}
+	return s.parse(ctx)
+}
+
+func (s *strct) parse(ctx *parseContext) []reflect.Value {
+	if s.binary != nil {
+		return s.binary.climb(ctx, s, 0)
+	}
+	return s.parseOperand(ctx)
+}
+
+// Parse the struct's own grammar into a new value of its type.
+func (s *strct) parseOperand(ctx *parseContext) (out []reflect.Value) {
+	name := pegName(s)
+	if ctx.disabled[name] {
+		return nil
+	}
 	sv := reflect.New(s.typ).Elem()
-	s.maybeInjectPos(lex.Peek().Pos, sv)
-	if s.expr.Parse(lex, sv) == nil {
+	if init, ok := sv.Addr().Interface().(Initializer); ok {
+		init.Init()
+	}
+	for _, index := range s.maps {
+		if f := sv.FieldByIndex(index); f.IsNil() {
+			f.Set(reflect.MakeMap(f.Type()))
+		}
+	}
+	pos := ctx.Peek().Pos
+	s.maybeInjectPos(pos, sv)
+	ctx.enter(name)
+	defer ctx.leave()
+	if s.defaults != nil {
+		ctx.assigned = append(ctx.assigned, assignedFields{strct: sv, fields: map[string]bool{}})
+		defer func() { ctx.assigned = ctx.assigned[:len(ctx.assigned)-1] }()
+	}
+	start := ctx.checkpoint()
+	if s.expr.Parse(ctx, sv) == nil {
 		return nil
 	}
+	if s.defaults != nil {
+		s.applyDefaults(ctx, pos, sv)
+	}
+	if s.tokensIndex != nil {
+		sv.FieldByIndex(s.tokensIndex).Set(reflect.ValueOf(ctx.consumedSince(start)))
+	}
+	s.maybeInjectEndPos(ctx.Peek().Pos, sv)
+	ctx.cover(s)
 	return []reflect.Value{sv}
 }
 
+// Binary operators with declared precedence and associativity, combining operands parsed by the
+// grammar of a struct into a tree of the struct, eg. `1 + 2 * 3` into
+// {Left: 1, Op: "+", Right: {Left: 2, Op: "*", Right: 3}}.
+type binary struct {
+	// The operator field and the fields of the operator's operands.
+	op    reflect.StructField
+	left  []int
+	right []int
+	// The precedence of each operator, lowest first, and whether each level is right associative.
+	precedence map[string]int
+	rightAssoc []bool
+	// The operators in order of precedence, for rendering the grammar.
+	operators []string
+}
+
+// Parse operands joined by operators of precedence min or higher, by precedence climbing.
+func (b *binary) climb(ctx *parseContext, s *strct, min int) []reflect.Value {
+	pos := ctx.Peek().Pos
+	start := ctx.checkpoint()
+	out := s.parseOperand(ctx)
+	if out == nil {
+		return nil
+	}
+	left := out[0]
+	for {
+		token := ctx.Peek()
+		level, ok := b.precedence[token.Value]
+		if !ok || level < min {
+			return []reflect.Value{left}
+		}
+		ctx.Next()
+		next := level + 1
+		if b.rightAssoc[level] {
+			next = level
+		}
+		out = b.climb(ctx, s, next)
+		if out == nil {
+			if !ctx.failed() {
+				ctx.failExpected(s)
+			}
+			return nil
+		}
+		sv := reflect.New(s.typ).Elem()
+		s.maybeInjectPos(pos, sv)
+		sv.FieldByIndex(b.left).Set(addressOf(left))
+		setField(ctx, token.Pos, sv, b.op, []reflect.Value{reflect.ValueOf(token.Value)})
+		sv.FieldByIndex(b.right).Set(addressOf(out[0]))
+		if s.tokensIndex != nil {
+			sv.FieldByIndex(s.tokensIndex).Set(reflect.ValueOf(ctx.consumedSince(start)))
+		}
+		s.maybeInjectEndPos(ctx.Peek().Pos, sv)
+		left = sv
+	}
+}
+
+// Returns a pointer to a copy of v.
+func addressOf(v reflect.Value) reflect.Value {
+	ptr := reflect.New(v.Type())
+	ptr.Elem().Set(v)
+	return ptr
+}
+
+// ~( <term> ... ) matches its terms in any order.
+//
+// Each term may match at most once, except repetitions, which may match any number of times.
+// Terms other than optionals and { ... } repetitions are required.
+type unordered struct {
+	elements []node
+	// The node matched for each element, with any optional or repetition unwrapped.
+	bodies   []node
+	repeat   []bool
+	required []bool
+}
+
+func (u *unordered) add(n node) {
+	body, repeat, required := n, false, true
+	switch e := n.(type) {
+	case *optional:
+		body, required = e.node, false
+	case *repetition:
+		body, repeat, required = e.node, true, e.min > 0
+	}
+	u.elements = append(u.elements, n)
+	u.bodies = append(u.bodies, body)
+	u.repeat = append(u.repeat, repeat)
+	u.required = append(u.required, required)
+}
+
+func (u *unordered) String() string {
+	out := []string{}
+	for _, n := range u.elements {
+		out = append(out, n.String())
+	}
+	return "~(" + strings.Join(out, " ") + ")"
+}
+
+func (u *unordered) Parse(ctx *parseContext, parent reflect.Value) (out []reflect.Value) {
+	start := ctx.checkpoint()
+	matches := make([]int, len(u.bodies))
+	out = []reflect.Value{}
+next:
+	for {
+		for i, body := range u.bodies {
+			before := ctx.checkpoint()
+			var v []reflect.Value
+			if ctx.maxBacktrack > 0 {
+				v = ctx.backtrack(body, parent)
+			} else {
+				v = body.Parse(ctx, parent)
+			}
+			if ctx.failed() {
+				return nil
+			}
+			if v == nil {
+				continue
+			}
+			if matches[i] > 0 && !u.repeat[i] {
+				token := ctx.tokens[before]
+				ctx.fail(token.Pos, "unexpected duplicate %q", token)
+				return nil
+			}
+			matches[i]++
+			out = append(out, v...)
+			// Bodies matching without consuming any tokens can not progress the parse.
+			if ctx.checkpoint() != before {
+				continue next
+			}
+		}
+		break
+	}
+	for i, body := range u.bodies {
+		if u.required[i] && matches[i] == 0 {
+			if ctx.checkpoint() == start {
+				return nil
+			}
+			ctx.failExpected(body)
+			return nil
+		}
+	}
+	return out
+}
+
+// ^( <term> ... ) matches its terms in sequence, typically optionals, but does not match unless
+// at least one of them consumes input.
+type atLeastOne struct {
+	elements []node
+}
+
+func (a *atLeastOne) String() string {
+	out := []string{}
+	for _, n := range a.elements {
+		out = append(out, n.String())
+	}
+	return "^(" + strings.Join(out, " ") + ")"
+}
+
+func (a *atLeastOne) Parse(ctx *parseContext, parent reflect.Value) (out []reflect.Value) {
+	start := ctx.checkpoint()
+	out = []reflect.Value{}
+	for _, n := range a.elements {
+		child := n.Parse(ctx, parent)
+		if ctx.failed() {
+			return nil
+		}
+		if child == nil {
+			if ctx.checkpoint() == start {
+				return nil
+			}
+			ctx.failExpected(n)
+			return nil
+		}
+		out = append(out, child...)
+	}
+	// If nothing matched, the enclosing node reports the tokens any of the elements could have
+	// started with.
+	if ctx.checkpoint() == start {
+		return nil
+	}
+	return out
+}
+
+// !<term> matches any single token, provided that <term> does not match at that position.
+type negation struct {
+	node node
+}
+
+func (n *negation) String() string {
+	return "!" + n.node.String()
+}
+
+func (n *negation) Parse(ctx *parseContext, parent reflect.Value) (out []reflect.Value) {
+	if ctx.Peek().EOF() || ctx.lookahead(n.node, parent) {
+		return nil
+	}
+	return []reflect.Value{reflect.ValueOf(ctx.Next().Value)}
+}
+
+// &<term> matches without consuming any input or capturing any values, provided that <term>
+// matches at that position.
+type lookahead struct {
+	node node
+}
+
+func (l *lookahead) String() string {
+	return "&" + l.node.String()
+}
+
+func (l *lookahead) Parse(ctx *parseContext, parent reflect.Value) (out []reflect.Value) {
+	if !ctx.lookahead(l.node, parent) {
+		return nil
+	}
+	return []reflect.Value{}
+}
+
 // <expr> {"|" <expr>}
 type disjunction []node
 
@@ -102,13 +435,29 @@ func (e disjunction) String() string {
 	return strings.Join(out, " | ")
 }
 
-func (e disjunction) Parse(lex lexer.Lexer, parent reflect.Value) (out []reflect.Value) {
-	for _, a := range e {
-		if value := a.Parse(lex, parent); value != nil {
-			return value
+func (e disjunction) Parse(ctx *parseContext, parent reflect.Value) (out []reflect.Value) {
+	_, out = e.parse(ctx, parent)
+	return out
+}
+
+// Parse the first matching alternative, returning its index and values.
+func (e disjunction) parse(ctx *parseContext, parent reflect.Value) (int, []reflect.Value) {
+	for i, a := range e {
+		var value []reflect.Value
+		if ctx.maxBacktrack > 0 {
+			value = ctx.backtrack(a, parent)
+		} else {
+			value = a.Parse(ctx, parent)
+		}
+		if value != nil {
+			ctx.cover(alternativeKey{&e[0], i})
+			return i, value
+		}
+		if ctx.failed() {
+			return -1, nil
 		}
 	}
-	return nil
+	return -1, nil
 }
 
 // <node> ...
@@ -118,15 +467,34 @@ func (a sequence) String() string {
 	return a[0].String()
 }
 
-func (a sequence) Parse(lex lexer.Lexer, parent reflect.Value) (out []reflect.Value) {
+// A sequence matches if each of its nodes matches, with an empty, non-nil slice if none of them
+// produced values.
+//
+// A sequence that fails without consuming any tokens does not match, and undoes any captures made
+// by the zero-length matches preceding the failure, eg. `@@` of a struct whose fields are all
+// optional, so that the next alternative starts from the same state.
+func (a sequence) Parse(ctx *parseContext, parent reflect.Value) (out []reflect.Value) {
+	start := ctx.checkpoint()
+	var saved snapshot
+	if len(a) > 1 {
+		saved = ctx.snapshot(prefixKey{&a[0]}, parent)
+	}
 	for i, n := range a {
-		// If first value doesn't match, we early exit, otherwise all values must match.
-		child := n.Parse(lex, parent)
+		// If no tokens have been consumed when a value doesn't match (eg. the sequence leads with an
+		// optional that didn't match), we early exit, otherwise all values must match.
+		child := n.Parse(ctx, parent)
 		if child == nil {
-			if i == 0 {
+			if ctx.failed() {
 				return nil
 			}
-			lexer.Panicf(lex.Peek().Pos, "expected ( %s ) not %q", n, lex.Peek())
+			if ctx.checkpoint() == start {
+				if i > 0 {
+					saved.restore()
+				}
+				return nil
+			}
+			ctx.failExpected(n)
+			return nil
 		}
 		if len(child) == 0 && out == nil {
 			out = []reflect.Value{}
@@ -141,22 +509,506 @@ func (a sequence) Parse(lex lexer.Lexer, parent reflect.Value) (out []reflect.Va
 type reference struct {
 	field reflect.StructField
 	node  node
+	// Capture the source text matched by node verbatim, rather than the values of its tokens.
+	preserve bool
+	// Capture the index of the alternative of node that matched, rather than its values.
+	index bool
+	// If non-nil, capture a Quoted value with the quote style of each string token type.
+	quotes map[rune]rune
+	// Name of a lexer.Position or []lexer.Position field named by a `positions` tag, if any.
+	positions string
 }
 
 func (r *reference) String() string {
 	return r.field.Name + ":" + r.node.String()
 }
 
-func (r *reference) Parse(lex lexer.Lexer, parent reflect.Value) (out []reflect.Value) {
-	pos := lex.Peek().Pos
-	v := r.node.Parse(lex, parent)
+func (r *reference) Parse(ctx *parseContext, parent reflect.Value) (out []reflect.Value) {
+	pos := ctx.Peek().Pos
+	start := ctx.checkpoint()
+	var v []reflect.Value
+	if r.index {
+		var i int
+		if i, v = r.node.(disjunction).parse(ctx, parent); v != nil {
+			v = []reflect.Value{reflect.ValueOf(strconv.Itoa(i))}
+		}
+	} else {
+		v = r.node.Parse(ctx, parent)
+	}
 	if v == nil {
 		return nil
 	}
-	setField(pos, parent, r.field, v)
+	// A zero-length match without values, eg. of an optional, matches without capturing.
+	if len(v) == 0 && ctx.checkpoint() == start {
+		return []reflect.Value{parent}
+	}
+	if r.preserve {
+		v = []reflect.Value{reflect.ValueOf(ctx.sourceSince(start))}
+	} else if r.quotes != nil {
+		v = []reflect.Value{reflect.ValueOf(r.quoted(ctx.source, ctx.consumedSince(start)))}
+	}
+	setField(ctx, pos, parent, r.field, v)
+	if r.positions != "" {
+		r.capturePositions(parent.FieldByName(r.positions), pos, ctx.consumedSince(start))
+	}
+	return []reflect.Value{parent}
+}
+
+// Record the positions of the tokens captured into the positions field f.
+//
+// A []lexer.Position field receives the position of each token, or of each production captured
+// by @@, while a lexer.Position field receives the position of the first.
+func (r *reference) capturePositions(f reflect.Value, pos lexer.Position, tokens []lexer.Token) {
+	if f.Type() == positionType {
+		if f.Interface() == (lexer.Position{}) {
+			f.Set(reflect.ValueOf(pos))
+		}
+		return
+	}
+	positions := f.Interface().([]lexer.Position)
+	switch r.node.(type) {
+	case *strct, *parseable:
+		positions = append(positions, pos)
+	default:
+		for _, token := range tokens {
+			positions = append(positions, token.Pos)
+		}
+	}
+	f.Set(reflect.ValueOf(positions))
+}
+
+// Returns the values of tokens along with the quote style of the first.
+//
+// The quote is read from the source where possible, as lexers may not distinguish every style by
+// token type, eg. the default lexer lexes single quoted strings as String.
+func (r *reference) quoted(source []byte, tokens []lexer.Token) Quoted {
+	out := Quoted{}
+	for _, token := range tokens {
+		out.Value += token.Value
+	}
+	if len(tokens) == 0 {
+		return out
+	}
+	out.Quote = r.quotes[tokens[0].Type]
+	if out.Quote == 0 {
+		return out
+	}
+	// Token positions may precede whitespace before the token.
+	for i := tokens[0].Pos.Offset; i < len(source); i++ {
+		switch c := rune(source[i]); c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case '"', '\'', '`':
+			out.Quote = c
+		}
+		break
+	}
+	return out
+}
+
+// A run of prefix operators, eg. `-`, `+` or `!`.
+//
+// Stacked operators such as `--x` are captured outermost first. A []string field receives one
+// element per operator, while a string field only accepts a single operator.
+type unary struct {
+	field reflect.StructField
+	ops   map[string]bool
+}
+
+func (u *unary) String() string {
+	ops := []string{}
+	for op := range u.ops {
+		ops = append(ops, strconv.Quote(op))
+	}
+	sort.Strings(ops)
+	return u.field.Name + ":{" + strings.Join(ops, "|") + "}"
+}
+
+func (u *unary) Parse(ctx *parseContext, parent reflect.Value) (out []reflect.Value) {
+	pos := ctx.Peek().Pos
+	for u.ops[ctx.Peek().Value] {
+		token := ctx.Peek()
+		if len(out) > 0 && u.field.Type.Kind() != reflect.Slice {
+			ctx.fail(token.Pos, "unexpected stacked unary operator %q", token)
+			return nil
+		}
+		out = append(out, reflect.ValueOf(ctx.Next().Value))
+	}
+	if len(out) == 0 {
+		return []reflect.Value{}
+	}
+	setField(ctx, pos, parent, u.field, out)
+	return []reflect.Value{parent}
+}
+
+// A path of identifiers joined by a separator, eg. a.b.c.
+//
+// A []string field receives each segment, while a string field receives the joined path.
+type path struct {
+	field reflect.StructField
+	sep   string
+	ident rune
+}
+
+func (p *path) String() string {
+	return fmt.Sprintf("%s:Ident { %q Ident }", p.field.Name, p.sep)
+}
+
+func (p *path) Parse(ctx *parseContext, parent reflect.Value) (out []reflect.Value) {
+	token := ctx.Peek()
+	if token.Type != p.ident {
+		return nil
+	}
+	segments := []string{ctx.Next().Value}
+	for ctx.Peek().Value == p.sep {
+		ctx.Next()
+		token := ctx.Next()
+		if token.Type != p.ident {
+			ctx.fail(token.Pos, "expected identifier after %q but got %q", p.sep, token)
+			return nil
+		}
+		segments = append(segments, token.Value)
+	}
+	if p.field.Type.Kind() == reflect.Slice {
+		for _, segment := range segments {
+			out = append(out, reflect.ValueOf(segment))
+		}
+	} else {
+		out = []reflect.Value{reflect.ValueOf(strings.Join(segments, p.sep))}
+	}
+	setField(ctx, token.Pos, parent, p.field, out)
+	return []reflect.Value{parent}
+}
+
+// A set of key/value assignments, eg. a=1 b=2, each captured into the field of a struct named by
+// its key.
+//
+// Keys match the name given by a field's key tag (`key:"..."` by default), falling back to the
+// field name.
+type keyed struct {
+	field  reflect.StructField
+	typ    reflect.Type
+	sep    string
+	ident  rune
+	fields map[string]reflect.StructField
+	// Keys in field order.
+	keys []string
+}
+
+// Index the fields of the struct by the names given by tag.
+func (k *keyed) index(tag string) {
+	k.fields = map[string]reflect.StructField{}
+	k.keys = nil
+	for i := 0; i < k.typ.NumField(); i++ {
+		field := k.typ.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := field.Tag.Get(tag)
+		if name == "" {
+			name = field.Name
+		}
+		k.fields[name] = field
+		k.keys = append(k.keys, name)
+	}
+}
+
+func (k *keyed) String() string {
+	return fmt.Sprintf("%s:{ Ident %q <value> }", k.field.Name, k.sep)
+}
+
+func (k *keyed) Parse(ctx *parseContext, parent reflect.Value) (out []reflect.Value) {
+	sv := parent.FieldByIndex(k.field.Index)
+	if sv.Kind() == reflect.Ptr {
+		if sv.IsNil() {
+			sv.Set(reflect.New(k.typ))
+		}
+		sv = sv.Elem()
+	}
+	for {
+		start := ctx.checkpoint()
+		key := ctx.Next()
+		if key.Type != k.ident || ctx.Next().Value != k.sep {
+			ctx.restore(start)
+			break
+		}
+		field, ok := k.fields[key.Value]
+		if !ok {
+			ctx.fail(key.Pos, "unknown key %q", key.Value)
+			return nil
+		}
+		value := ctx.Next()
+		if value.EOF() {
+			ctx.fail(value.Pos, "expected value for key %q", key.Value)
+			return nil
+		}
+		setField(ctx, value.Pos, sv, field, []reflect.Value{reflect.ValueOf(value.Value)})
+	}
+	return []reflect.Value{parent}
+}
+
+// A set of assignments to separated keys, eg. a.b.c = 1, captured into a nested
+// map[string]interface{}.
+//
+// Values are captured as a string if lexed as a string, otherwise as an int64, float64 or bool
+// if they parse as such, falling back to a string.
+type nested struct {
+	field reflect.StructField
+	sep   string
+	ident rune
+	// Token types of strings.
+	strings map[rune]bool
+}
+
+func (n *nested) String() string {
+	return fmt.Sprintf("%s:{ Ident { %q Ident } \"=\" <value> }", n.field.Name, n.sep)
+}
+
+func (n *nested) Parse(ctx *parseContext, parent reflect.Value) (out []reflect.Value) {
+	f := parent.FieldByIndex(n.field.Index)
+	if f.IsNil() {
+		f.Set(reflect.MakeMap(nestedMapType))
+	}
+	m := f.Interface().(map[string]interface{})
+	for ctx.Peek().Type == n.ident {
+		key := ctx.Next()
+		path := []string{key.Value}
+		for ctx.Peek().Value == n.sep {
+			ctx.Next()
+			token := ctx.Next()
+			if token.Type != n.ident {
+				ctx.fail(token.Pos, "expected identifier after %q but got %q", n.sep, token)
+				return nil
+			}
+			path = append(path, token.Value)
+		}
+		if token := ctx.Next(); token.Value != "=" {
+			ctx.fail(token.Pos, "expected \"=\" but got %q", token)
+			return nil
+		}
+		value := ctx.Next()
+		if value.EOF() {
+			ctx.fail(value.Pos, "expected value for key %q", strings.Join(path, n.sep))
+			return nil
+		}
+		if err := n.set(m, path, n.value(value)); err != nil {
+			ctx.fail(key.Pos, "%s", err)
+			return nil
+		}
+	}
 	return []reflect.Value{parent}
 }
 
+func (n *nested) value(token lexer.Token) interface{} {
+	if n.strings[token.Type] {
+		return token.Value
+	}
+	if v, err := strconv.ParseInt(token.Value, 0, 64); err == nil {
+		return v
+	}
+	if v, err := strconv.ParseFloat(token.Value, 64); err == nil {
+		return v
+	}
+	if v, err := strconv.ParseBool(token.Value); err == nil {
+		return v
+	}
+	return token.Value
+}
+
+// Set value at path in a tree of nested maps, creating intermediate maps as necessary.
+//
+// An error is returned if an element of path other than the last already holds a value that is
+// not a map, or if the last element already holds a map.
+func (n *nested) set(m map[string]interface{}, path []string, value interface{}) error {
+	for i, key := range path[:len(path)-1] {
+		switch child := m[key].(type) {
+		case nil:
+			next := map[string]interface{}{}
+			m[key] = next
+			m = next
+		case map[string]interface{}:
+			m = child
+		default:
+			return fmt.Errorf("can not set %q as %q is already set to %v", strings.Join(path, n.sep), strings.Join(path[:i+1], n.sep), child)
+		}
+	}
+	key := path[len(path)-1]
+	if _, ok := m[key].(map[string]interface{}); ok {
+		return fmt.Errorf("can not set %q as it already contains nested keys", strings.Join(path, n.sep))
+	}
+	m[key] = value
+	return nil
+}
+
+// A discriminator token, optionally followed by a separator, selecting the type to parse into
+// an interface field from the types registered by the Factory option.
+//
+// A discriminator that is not registered does not match, unless followed by the separator.
+type factory struct {
+	field reflect.StructField
+	iface reflect.Type
+	sep   string
+	// Grammars of the registered types by discriminator, shared by all fields of the interface.
+	types map[string]node
+}
+
+func (f *factory) String() string {
+	return fmt.Sprintf("%s:factory(%s)", f.field.Name, f.iface)
+}
+
+// Returns the registered discriminators in sorted order.
+func (f *factory) discriminators() []string {
+	out := []string{}
+	for discriminator := range f.types {
+		out = append(out, discriminator)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (f *factory) Parse(ctx *parseContext, parent reflect.Value) (out []reflect.Value) {
+	start := ctx.checkpoint()
+	token := ctx.Next()
+	if token.EOF() {
+		return nil
+	}
+	hasSep := f.sep != "" && ctx.Peek().Value == f.sep
+	if f.sep != "" && !hasSep {
+		ctx.restore(start)
+		return nil
+	}
+	n, ok := f.types[token.Value]
+	if !ok {
+		if hasSep {
+			ctx.fail(token.Pos, "unknown %s %q", f.iface.Name(), token.Value)
+			return nil
+		}
+		ctx.restore(start)
+		return nil
+	}
+	if hasSep {
+		ctx.Next()
+	}
+	v := n.Parse(ctx, parent)
+	if v == nil {
+		if !ctx.failed() {
+			ctx.failExpected(n)
+		}
+		return nil
+	}
+	value := v[0]
+	if !value.Type().Implements(f.iface) {
+		value = value.Addr()
+	}
+	setField(ctx, token.Pos, parent, f.field, []reflect.Value{value})
+	return []reflect.Value{parent}
+}
+
+// A region between balanced delimiters, eg. `{ ... }`, whose contents are parsed separately.
+//
+// The contents are parsed with node or, if parser is set, re-lexed from the source and parsed
+// with parser.
+type balanced struct {
+	field  reflect.StructField
+	open   string
+	close  string
+	node   node
+	parser *Parser
+}
+
+func (b *balanced) String() string {
+	return fmt.Sprintf("%s:%q ... %q", b.field.Name, b.open, b.close)
+}
+
+func (b *balanced) Parse(ctx *parseContext, parent reflect.Value) (out []reflect.Value) {
+	open := ctx.Peek()
+	if open.Value != b.open {
+		return nil
+	}
+	ctx.Next()
+	start := ctx.checkpoint()
+	for depth := 1; ; ctx.Next() {
+		token := ctx.Peek()
+		if token.EOF() {
+			ctx.fail(open.Pos, "unbalanced %q", b.open)
+			return nil
+		}
+		if token.Value == b.open {
+			depth++
+		} else if token.Value == b.close {
+			if depth--; depth == 0 {
+				break
+			}
+		}
+	}
+	tokens := ctx.consumedSince(start)
+	end := ctx.Next()
+	var value reflect.Value
+	if b.parser != nil {
+		value = b.reparse(ctx, tokens, end)
+	} else {
+		inner := ctx.sub(tokens, end.Pos)
+		v := b.node.Parse(inner, parent)
+		if v == nil && !inner.failed() {
+			inner.failExpected(b.node)
+		} else if !inner.failed() && !inner.Peek().EOF() {
+			inner.fail(inner.Peek().Pos, "unexpected token %q", inner.Peek())
+		}
+		if inner.failed() {
+			ctx.err = inner.err
+			return nil
+		}
+		value = v[0]
+	}
+	setField(ctx, open.Pos, parent, b.field, []reflect.Value{value})
+	return []reflect.Value{parent}
+}
+
+// Parse the source text of tokens with b.parser, offsetting the positions of any errors into the
+// outer source.
+func (b *balanced) reparse(ctx *parseContext, tokens []lexer.Token, end lexer.Token) reflect.Value {
+	base := end.Pos
+	if len(tokens) > 0 {
+		base = tokens[0].Pos
+	}
+	target := reflect.New(indirectType(b.field.Type))
+	err := b.parser.ParseContext(ctx.context, bytes.NewReader(ctx.source[base.Offset:end.Pos.Offset]), target.Interface())
+	if err != nil {
+		lerr, ok := err.(*lexer.Error)
+		if !ok {
+			lexer.Panic(base, err.Error())
+		}
+		pos := lerr.Pos
+		if pos.Line == 1 {
+			pos.Column += base.Column - 1
+		}
+		pos.Line += base.Line - 1
+		pos.Offset += base.Offset
+		pos.Filename = base.Filename
+		lexer.Panic(pos, lerr.Message)
+	}
+	return target.Elem()
+}
+
+// An alternative labelled with <label>: that records its label into field when it matches.
+type labelled struct {
+	field reflect.StructField
+	label string
+	node  node
+}
+
+func (l *labelled) String() string {
+	return l.label + ": " + l.node.String()
+}
+
+func (l *labelled) Parse(ctx *parseContext, parent reflect.Value) (out []reflect.Value) {
+	out = l.node.Parse(ctx, parent)
+	if out != nil {
+		parent.FieldByIndex(l.field.Index).SetString(l.label)
+	}
+	return out
+}
+
 type tokenReference struct {
 	typ        rune
 	identifier string
@@ -166,12 +1018,12 @@ func (t *tokenReference) String() string {
 	return t.identifier
 }
 
-func (t *tokenReference) Parse(lex lexer.Lexer, parent reflect.Value) (out []reflect.Value) {
-	token := lex.Peek()
+func (t *tokenReference) Parse(ctx *parseContext, parent reflect.Value) (out []reflect.Value) {
+	token := ctx.Peek()
 	if token.Type != t.typ {
 		return nil
 	}
-	lex.Next()
+	ctx.Next()
 	return []reflect.Value{reflect.ValueOf(token.Value)}
 }
 
@@ -184,34 +1036,94 @@ func (o *optional) String() string {
 	return o.node.String()
 }
 
-func (o *optional) Parse(lex lexer.Lexer, parent reflect.Value) (out []reflect.Value) {
-	v := o.node.Parse(lex, parent)
+func (o *optional) Parse(ctx *parseContext, parent reflect.Value) (out []reflect.Value) {
+	v := o.node.Parse(ctx, parent)
 	if v == nil {
+		if ctx.failed() {
+			return nil
+		}
 		return []reflect.Value{}
 	}
+	ctx.cover(o)
 	return v
 }
 
-// { <expr> }
+// { <expr> }, { <expr> % <sep> }, { <expr> }<min>,<max> or <expr>+
 type repetition struct {
 	node node
+	// Minimum number of matches, 1 for <expr>+.
+	min int
+	// Maximum number of matches, or 0 if unbounded.
+	max int
+	// If non-zero, the number of matches beyond which the repetition fails with an error.
+	limit int
+	// Matched between each match of node, if any.
+	separator node
+	// Whether a separator may follow the last match.
+	trailing bool
 }
 
 func (r *repetition) String() string {
 	return r.node.String()
 }
 
-// Parse a repetition. Once a repetition is encountered it will always match, so grammars
-// should ensure that branches are differentiated prior to the repetition.
-func (r *repetition) Parse(lex lexer.Lexer, parent reflect.Value) (out []reflect.Value) {
+// Parse a repetition. Once a repetition with no minimum is encountered it will always match, so
+// grammars should ensure that branches are differentiated prior to the repetition.
+func (r *repetition) Parse(ctx *parseContext, parent reflect.Value) (out []reflect.Value) {
 	out = []reflect.Value{}
-	for {
-		v := r.node.Parse(lex, parent)
+	first := ctx.checkpoint()
+	matches := 0
+	for r.max == 0 || matches < r.max {
+		start := ctx.checkpoint()
+		pos := ctx.Peek().Pos
+		if r.separator != nil && matches > 0 {
+			sep := r.separator.Parse(ctx, parent)
+			if sep == nil {
+				if ctx.failed() {
+					return nil
+				}
+				break
+			}
+			out = append(out, sep...)
+		}
+		afterSeparator := ctx.checkpoint()
+		v := ctx.recoverable(r.node, parent)
 		if v == nil {
+			if ctx.failed() {
+				return nil
+			}
+			if afterSeparator != start && !r.trailing {
+				ctx.failExpected(r.node)
+				return nil
+			}
+			break
+		}
+		// Guard against looping forever on a body that matches without consuming any tokens.
+		if ctx.checkpoint() == start {
+			matches++
 			break
 		}
+		matches++
+		if r.limit > 0 && matches > r.limit {
+			ctx.fail(pos, "exceeded the limit of %d repetitions", r.limit)
+			return nil
+		}
 		out = append(out, v...)
 	}
+	if matches < r.min {
+		if ctx.checkpoint() == first {
+			return nil
+		}
+		next := r.node
+		if r.separator != nil && matches > 0 {
+			next = r.separator
+		}
+		ctx.failExpected(next)
+		return nil
+	}
+	if matches > 0 {
+		ctx.cover(r)
+	}
 	return out
 }
 
@@ -219,6 +1131,8 @@ func (r *repetition) Parse(lex lexer.Lexer, parent reflect.Value) (out []reflect
 type literal struct {
 	s string
 	t rune
+	// Match regardless of case, as set by the CaseInsensitive option.
+	fold bool
 }
 
 func (s *literal) String() string {
@@ -228,10 +1142,13 @@ func (s *literal) String() string {
 	return fmt.Sprintf("%q", s.s)
 }
 
-func (s *literal) Parse(lex lexer.Lexer, parent reflect.Value) (out []reflect.Value) {
-	token := lex.Peek()
-	if token.Value == s.s && (s.t == -1 || s.t == token.Type) {
-		return []reflect.Value{reflect.ValueOf(lex.Next().Value)}
+func (s *literal) Parse(ctx *parseContext, parent reflect.Value) (out []reflect.Value) {
+	token := ctx.Peek()
+	if s.t != -1 && s.t != token.Type {
+		return nil
+	}
+	if token.Value == s.s || (s.fold && strings.EqualFold(token.Value, s.s)) {
+		return []reflect.Value{reflect.ValueOf(ctx.Next().Value)}
 	}
 	return nil
 }
@@ -241,39 +1158,55 @@ func (s *literal) Parse(lex lexer.Lexer, parent reflect.Value) (out []reflect.Va
 // This will dereference pointers, and attempt to parse strings into integer values, floats, etc.
 func conform(t reflect.Type, values []reflect.Value) (out []reflect.Value) {
 	for _, v := range values {
-		for t != v.Type() && t.Kind() == reflect.Ptr && v.Kind() != reflect.Ptr {
-			v = v.Addr()
+		out = append(out, conformValue(t, v))
+	}
+	return out
+}
+
+func conformValue(t reflect.Type, v reflect.Value) reflect.Value {
+	if t != v.Type() && t.Kind() == reflect.Ptr && v.Kind() != reflect.Ptr {
+		v = conformValue(t.Elem(), v)
+		if v.CanAddr() {
+			return v.Addr()
 		}
+		// Copy non-addressable values (eg. captured tokens) into addressable storage.
+		pv := reflect.New(v.Type())
+		pv.Elem().Set(v)
+		return pv
+	}
 
-		switch t.Kind() {
-		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-			n, err := strconv.ParseInt(v.String(), 0, 64)
-			if err == nil {
-				v = reflect.New(t).Elem()
-				v.SetInt(n)
-			}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(v.String(), 0, 64)
+		if err == nil && !reflect.Zero(t).OverflowInt(n) {
+			v = reflect.New(t).Elem()
+			v.SetInt(n)
+		}
 
-		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-			n, err := strconv.ParseUint(v.String(), 0, 64)
-			if err == nil {
-				v = reflect.New(t).Elem()
-				v.SetUint(n)
-			}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(v.String(), 0, 64)
+		if err == nil && !reflect.Zero(t).OverflowUint(n) {
+			v = reflect.New(t).Elem()
+			v.SetUint(n)
+		}
 
-		case reflect.Bool:
-			v = reflect.ValueOf(true)
+	case reflect.Bool:
+		v = reflect.ValueOf(true)
 
-		case reflect.Float32, reflect.Float64:
-			n, err := strconv.ParseFloat(v.String(), 64)
-			if err == nil {
-				v = reflect.New(t).Elem()
-				v.SetFloat(n)
-			}
+	case reflect.String:
+		// Named string types such as json.Number receive the raw token text.
+		if t != v.Type() && v.Kind() == reflect.String {
+			v = v.Convert(t)
 		}
 
-		out = append(out, v)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(v.String(), 64)
+		if err == nil {
+			v = reflect.New(t).Elem()
+			v.SetFloat(n)
+		}
 	}
-	return out
+	return v
 }
 
 // Set field.
@@ -283,16 +1216,117 @@ func conform(t reflect.Type, values []reflect.Value) (out []reflect.Value) {
 //
 // For all other types, an attempt will be made to convert the string to the corresponding
 // type (int, float32, etc.).
-func setField(pos lexer.Position, strct reflect.Value, field reflect.StructField, fieldValue []reflect.Value) { // nolint: gocyclo
+func setField(ctx *parseContext, pos lexer.Position, strct reflect.Value, field reflect.StructField, fieldValue []reflect.Value) { // nolint: gocyclo
 	defer decorate(strct.Type().String() + "." + field.Name)
 
+	if name, ok := field.Tag.Lookup("count"); ok {
+		count := strct.FieldByName(name)
+		switch count.Kind() {
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			count.SetUint(count.Uint() + uint64(len(fieldValue)))
+		default:
+			count.SetInt(count.Int() + int64(len(fieldValue)))
+		}
+	}
+
+	ctx.assign(strct, field)
 	f := strct.FieldByIndex(field.Index)
+	if prefix, ok := field.Tag.Lookup("flags"); ok {
+		setFlags(pos, f, prefix, fieldValue)
+		return
+	}
+
+	// Byte slices tagged with `bytes:""` receive the text of the captured tokens, appended as for
+	// strings.
+	if _, ok := field.Tag.Lookup("bytes"); ok {
+		text := reflect.ValueOf([]byte(strings.Join(capturedStrings(fieldValue), "")))
+		f.Set(reflect.AppendSlice(f, text.Convert(f.Type())))
+		return
+	}
+
+	if _, ok := field.Tag.Lookup("rune"); ok {
+		if f.Kind() == reflect.Slice {
+			for _, s := range capturedStrings(fieldValue) {
+				f.Set(reflect.Append(f, runeValue(pos, f.Type().Elem(), s)))
+			}
+		} else {
+			f.Set(runeValue(pos, f.Type(), strings.Join(capturedStrings(fieldValue), "")))
+		}
+		return
+	}
+
+	if f.Type() == regexpType {
+		pattern := strings.Join(capturedStrings(fieldValue), "")
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			lexer.Panicf(pos, "invalid regular expression %q: %s", pattern, err)
+		}
+		f.Set(reflect.ValueOf(re))
+		return
+	}
+
+	if converter, ok := ctx.converters[f.Type()]; ok {
+		f.Set(convert(pos, f.Type(), converter, capturedStrings(fieldValue)))
+		return
+	}
+
 	switch f.Kind() {
 	case reflect.Slice:
+		if converter, ok := ctx.converters[f.Type().Elem()]; ok {
+			for _, value := range capturedStrings(fieldValue) {
+				f.Set(reflect.Append(f, convert(pos, f.Type().Elem(), converter, []string{value})))
+			}
+			return
+		}
+		// A value parsed by a Parseable slice type, eg. `type Args []string`, is the whole field.
+		if len(fieldValue) == 1 && fieldValue[0].Type() == f.Type() {
+			f.Set(fieldValue[0])
+			return
+		}
+		// Slice types such as net.IP may unmarshal themselves from the captured text.
+		if d, ok := addrInterface(f).(encoding.TextUnmarshaler); ok {
+			if err := d.UnmarshalText([]byte(strings.Join(capturedStrings(fieldValue), ""))); err != nil {
+				lexer.Panic(pos, err.Error())
+			}
+			return
+		}
+		if appendCaptured(pos, f, fieldValue) {
+			return
+		}
 		fieldValue = conform(f.Type().Elem(), fieldValue)
+		for _, v := range fieldValue {
+			if v.Type() != f.Type().Elem() {
+				checkInteger(pos, v, f.Type().Elem())
+			}
+		}
+		if appender, ok := addrInterface(f).(Appender); ok {
+			for _, v := range fieldValue {
+				if err := appender.Append(v.Interface()); err != nil {
+					lexer.Panic(pos, err.Error())
+				}
+			}
+			return
+		}
 		f.Set(reflect.Append(f, fieldValue...))
 		return
 
+	case reflect.Map:
+		// Entries are keyed by their Key field, with later entries replacing earlier ones. Entries
+		// of maps of anything other than structs insert their Value field.
+		if f.IsNil() {
+			f.Set(reflect.MakeMap(f.Type()))
+		}
+		if indirectType(f.Type().Elem()).Kind() != reflect.Struct {
+			for _, v := range fieldValue {
+				f.SetMapIndex(v.FieldByName("Key"), v.FieldByName("Value"))
+			}
+			return
+		}
+		for _, v := range conform(f.Type().Elem(), fieldValue) {
+			f.SetMapIndex(reflect.Indirect(v).FieldByName("Key"), v)
+		}
+		return
+
 	case reflect.Ptr:
 		if f.IsNil() {
 			fv := reflect.New(f.Type().Elem()).Elem()
@@ -303,20 +1337,77 @@ func setField(pos lexer.Position, strct reflect.Value, field reflect.StructField
 		}
 	}
 
+	if converter, ok := ctx.converters[f.Type()]; ok {
+		f.Set(convert(pos, f.Type(), converter, capturedStrings(fieldValue)))
+		return
+	}
+
+	// json.Number preserves the exact text of numeric tokens.
+	if f.Type() == jsonNumberType {
+		f.SetString(f.String() + strings.Join(capturedStrings(fieldValue), ""))
+		return
+	}
+
+	if unit, ok := field.Tag.Lookup("unix"); ok && f.Type() == timeType {
+		setUnixTime(pos, f, unit, fieldValue)
+		return
+	}
+
+	if layout, ok := field.Tag.Lookup("time"); ok && f.Type() == timeType {
+		setTime(ctx, pos, f, layout, fieldValue)
+		return
+	}
+
+	if f.Type() == durationType {
+		value := strings.Join(capturedStrings(fieldValue), "")
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			lexer.Panicf(pos, "invalid duration %q: %s", value, err)
+		}
+		f.SetInt(int64(d))
+		return
+	}
+
 	if f.CanAddr() {
-		if d, ok := f.Addr().Interface().(Capture); ok {
-			ifv := []string{}
-			for _, v := range fieldValue {
-				ifv = append(ifv, v.Interface().(string))
+		switch d := f.Addr().Interface().(type) {
+		case ContextCapture:
+			if err := d.CaptureContext(ctx.context, capturedStrings(fieldValue)); err != nil {
+				lexer.Panic(pos, err.Error())
+			}
+			return
+
+		case PositionCapture:
+			if err := d.CapturePosition(pos, capturedStrings(fieldValue)); err != nil {
+				panicCaptureError(pos, err)
 			}
-			err := d.Capture(ifv)
-			if err != nil {
+			return
+
+		case Capture:
+			if err := d.Capture(capturedStrings(fieldValue)); err != nil {
+				lexer.Panic(pos, err.Error())
+			}
+			return
+
+		// Types unmarshalling both text and binary, eg. netip.Addr, are given the captured text.
+		case encoding.TextUnmarshaler:
+			if err := d.UnmarshalText([]byte(strings.Join(capturedStrings(fieldValue), ""))); err != nil {
+				lexer.Panic(pos, err.Error())
+			}
+			return
+
+		case encoding.BinaryUnmarshaler:
+			if err := d.UnmarshalBinary([]byte(strings.Join(capturedStrings(fieldValue), ""))); err != nil {
 				lexer.Panic(pos, err.Error())
 			}
 			return
 		}
 	}
 
+	if f.Kind() == reflect.Bool && len(fieldValue) == 1 && fieldValue[0].Kind() == reflect.String {
+		setBool(f, field, fieldValue[0].String())
+		return
+	}
+
 	fieldValue = conform(f.Type(), fieldValue)
 
 	// Strings concatenate all captured tokens.
@@ -342,12 +1433,14 @@ func setField(pos lexer.Position, strct reflect.Value, field reflect.StructField
 	// Numeric types will increment if the token can not be coerced.
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 		if fv.Type() != f.Type() {
+			checkInteger(pos, fv, f.Type())
 			f.SetInt(f.Int() + 1)
 		} else {
 			f.Set(fv)
 		}
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 		if fv.Type() != f.Type() {
+			checkInteger(pos, fv, f.Type())
 			f.SetUint(f.Uint() + 1)
 		} else {
 			f.Set(fv)
@@ -366,11 +1459,203 @@ func setField(pos lexer.Position, strct reflect.Value, field reflect.StructField
 		}
 		f.Set(fv)
 
+	case reflect.Interface:
+		if !fv.Type().AssignableTo(f.Type()) {
+			panicf("value %q is not assignable to type %s", fv, f.Type())
+		}
+		f.Set(fv)
+
 	default:
 		panicf("unsupported field type %s for field %s", f.Type(), field.Name)
 	}
 }
 
+// Returns the first character of s as a value of the rune type t, or a pointer to one.
+func runeValue(pos lexer.Position, t reflect.Type, s string) reflect.Value {
+	r, size := utf8.DecodeRuneInString(s)
+	if size == 0 {
+		lexer.Panicf(pos, "expected a character but got %q", s)
+	}
+	v := reflect.ValueOf(r).Convert(indirectType(t))
+	if t.Kind() == reflect.Ptr {
+		ptr := reflect.New(v.Type())
+		ptr.Elem().Set(v)
+		v = ptr
+	}
+	return v
+}
+
+// Panic if a value that could not be converted to an integer is nonetheless numeric, eg. 0b102 or
+// 300 for a uint8, rather than a token whose occurrences are being counted.
+//
+// Integers are parsed with their base given by any 0x, 0o or 0b prefix, as for Go literals.
+func checkInteger(pos lexer.Position, v reflect.Value, t reflect.Type) {
+	if v.Kind() != reflect.String {
+		return
+	}
+	s := v.String()
+	digits := strings.TrimLeft(s, "+-")
+	if digits == "" || digits[0] < '0' || digits[0] > '9' {
+		return
+	}
+	var err error
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		_, err = strconv.ParseInt(s, 0, 64)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		_, err = strconv.ParseUint(s, 0, 64)
+	default:
+		return
+	}
+	if nerr, ok := err.(*strconv.NumError); ok {
+		err = nerr.Err
+	} else if err == nil {
+		err = strconv.ErrRange
+	}
+	lexer.Panicf(pos, "invalid %s %q: %s", t, s, err)
+}
+
+// Append each captured value to a slice whose elements implement Capture, returning false if they
+// do not.
+func appendCaptured(pos lexer.Position, f reflect.Value, fieldValue []reflect.Value) bool {
+	elem := f.Type().Elem()
+	ptr := elem.Kind() == reflect.Ptr
+	if !ptr {
+		elem = reflect.PtrTo(elem)
+	}
+	positionCapture := elem.Implements(positionCaptureType)
+	capture := elem.Implements(captureType)
+	if !positionCapture && !capture && !elem.Implements(textUnmarshalerType) {
+		return false
+	}
+	for _, v := range fieldValue {
+		ev := reflect.New(elem.Elem())
+		var err error
+		switch {
+		case positionCapture:
+			err = ev.Interface().(PositionCapture).CapturePosition(pos, capturedStrings([]reflect.Value{v}))
+		case capture:
+			err = ev.Interface().(Capture).Capture(capturedStrings([]reflect.Value{v}))
+		default:
+			err = ev.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(v.String()))
+		}
+		if err != nil {
+			panicCaptureError(pos, err)
+		}
+		if !ptr {
+			ev = ev.Elem()
+		}
+		f.Set(reflect.Append(f, ev))
+	}
+	return true
+}
+
+// Panic with the error of a capture, as is if it is positioned or otherwise at pos.
+func panicCaptureError(pos lexer.Position, err error) {
+	if perr, ok := err.(*lexer.Error); ok {
+		panic(captureError{perr})
+	}
+	lexer.Panic(pos, err.Error())
+}
+
+// Returns a pointer to v as an interface{}, or nil if v is not addressable.
+func addrInterface(v reflect.Value) interface{} {
+	if !v.CanAddr() {
+		return nil
+	}
+	return v.Addr().Interface()
+}
+
+// Set a time.Time field tagged with `unix:"s"` or `unix:"ms"` by parsing the captured integer as
+// seconds or milliseconds since the Unix epoch.
+//
+// The unit is validated when the grammar is built.
+func setUnixTime(pos lexer.Position, f reflect.Value, unit string, fieldValue []reflect.Value) {
+	value := strings.Join(capturedStrings(fieldValue), "")
+	n := conformValue(int64Type, reflect.ValueOf(value))
+	if n.Type() != int64Type {
+		lexer.Panicf(pos, "invalid Unix timestamp %q", value)
+	}
+	if unit == "ms" {
+		f.Set(reflect.ValueOf(time.Unix(0, n.Int()*int64(time.Millisecond))))
+		return
+	}
+	f.Set(reflect.ValueOf(time.Unix(n.Int(), 0)))
+}
+
+// Set a bool field from a captured token, false if it is the false literal, "false" or that given
+// by a `bool:"<true>,<false>"` tag, compared case-insensitively. Any other token, eg. a keyword
+// whose presence is being captured, is true.
+//
+// The `bool` tag is validated when the grammar is built.
+func setBool(f reflect.Value, field reflect.StructField, value string) {
+	literals := []string{"true", "false"}
+	if tag, ok := field.Tag.Lookup("bool"); ok {
+		literals = strings.Split(tag, ",")
+	}
+	f.SetBool(!strings.EqualFold(value, strings.TrimSpace(literals[1])))
+}
+
+// Set a []rune or map[rune]bool field tagged with `flags:"<prefix>"` from clusters of single
+// character flags, eg. -abc, by stripping the prefix from each and adding each remaining rune.
+func setFlags(pos lexer.Position, f reflect.Value, prefix string, fieldValue []reflect.Value) {
+	isSet := f.Kind() == reflect.Map && f.Type().Key() == runeType && f.Type().Elem().Kind() == reflect.Bool
+	if !isSet && !(f.Kind() == reflect.Slice && f.Type().Elem() == runeType) {
+		panicf("a field tagged with `flags` must be a []rune or map[rune]bool, not %s", f.Type())
+	}
+	if isSet && f.IsNil() {
+		f.Set(reflect.MakeMap(f.Type()))
+	}
+	for _, cluster := range capturedStrings(fieldValue) {
+		if !strings.HasPrefix(cluster, prefix) || len(cluster) == len(prefix) {
+			lexer.Panicf(pos, "invalid flags %q, expected %q followed by one or more flags", cluster, prefix)
+		}
+		for _, flag := range cluster[len(prefix):] {
+			if isSet {
+				f.SetMapIndex(reflect.ValueOf(flag), reflect.ValueOf(true).Convert(f.Type().Elem()))
+			} else {
+				f.Set(reflect.Append(f, reflect.ValueOf(flag)))
+			}
+		}
+	}
+}
+
+// Set a time.Time field tagged with `time:"<layout>"` by parsing the captured text with the
+// layout. Times without a zone are in the location given by the TimeLocation option, or UTC.
+func setTime(ctx *parseContext, pos lexer.Position, f reflect.Value, layout string, fieldValue []reflect.Value) {
+	value := strings.Join(capturedStrings(fieldValue), "")
+	location := ctx.location
+	if location == nil {
+		location = time.UTC
+	}
+	t, err := time.ParseInLocation(layout, value, location)
+	if err != nil {
+		lexer.Panicf(pos, "invalid time %q: %s", value, err)
+	}
+	f.Set(reflect.ValueOf(t))
+}
+
+// Convert captured values to a value of type t with a converter registered by the Convert option.
+func convert(pos lexer.Position, t reflect.Type, converter Converter, values []string) reflect.Value {
+	out, err := converter(values)
+	if err != nil {
+		lexer.Panic(pos, err.Error())
+	}
+	v := reflect.ValueOf(out)
+	if !v.IsValid() || !v.Type().AssignableTo(t) {
+		panicf("converter for %s returned a value of type %T", t, out)
+	}
+	return v
+}
+
+func capturedStrings(values []reflect.Value) []string {
+	out := []string{}
+	for _, v := range values {
+		out = append(out, v.Interface().(string))
+	}
+	return out
+}
+
 func indirectType(t reflect.Type) reflect.Type {
 	if t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
 		return indirectType(t.Elem())
@@ -0,0 +1,387 @@
+package participle
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+
+	"github.com/peterebden/participle/lexer"
+)
+
+// An Option to modify the behaviour of the Parser.
+type Option func(p *Parser) error
+
+// UseLexer sets the lexer used to tokenise input, rather than the default lexer based on
+// text/scanner.
+func UseLexer(def lexer.Definition) Option {
+	return func(p *Parser) error {
+		if def == nil {
+			return errors.New("UseLexer requires a lexer")
+		}
+		p.lex = def
+		return nil
+	}
+}
+
+// Returns an Option applying option once the grammar has been built, for options that modify it.
+func afterBuild(option Option) Option {
+	return func(p *Parser) error {
+		p.afterBuild = append(p.afterBuild, option)
+		return nil
+	}
+}
+
+// NormalizeUnicode normalizes identifiers to the given Unicode normalization form, eg. norm.NFC.
+//
+// Identifier tokens from the lexer and literals in the grammar are both normalized, so keywords
+// match and captured identifiers compare equal regardless of how the input was composed.
+func NormalizeUnicode(form norm.Form) Option {
+	return afterBuild(func(p *Parser) error {
+		p.normalize = &form
+		ident := p.lex.Symbols()["Ident"]
+		visit(p.root, func(n node) {
+			if l, ok := n.(*literal); ok && (l.t == -1 || l.t == ident) {
+				l.s = form.String(l.s)
+			}
+		})
+		return nil
+	})
+}
+
+// KeyTag sets the struct tag consulted for the key naming each field captured by a `keys` tag.
+//
+// Fields without the tag are keyed by their field name. The default tag is "key".
+func KeyTag(tag string) Option {
+	return afterBuild(func(p *Parser) error {
+		visit(p.root, func(n node) {
+			if k, ok := n.(*keyed); ok {
+				k.index(tag)
+			}
+		})
+		return nil
+	})
+}
+
+// MaxBacktrack allows an alternative that fails after consuming up to n tokens to be abandoned in
+// favour of the next alternative.
+//
+// By default (n = 0) an alternative is committed to as soon as it consumes a token, so any later
+// failure within it is a hard error. Larger values allow grammars needing more lookahead, while
+// bounding how far from its cause an error can be reported: an alternative failing beyond n
+// tokens is still a hard error, and if every alternative fails the error from the furthest
+// position reached is reported.
+func MaxBacktrack(n int) Option {
+	return func(p *Parser) error {
+		if n < 0 {
+			return fmt.Errorf("invalid backtracking distance %d", n)
+		}
+		p.maxBacktrack = n
+		return nil
+	}
+}
+
+// Memoize caches the result of parsing each production at each position of the input for the
+// duration of a parse, so that a production is parsed only once at a position however many
+// alternatives backtracked over try it, as in a packrat parser.
+//
+// This trades memory for speed in grammars that backtrack heavily, eg. with MaxBacktrack, where
+// alternatives sharing a leading production would otherwise parse it repeatedly.
+func Memoize() Option {
+	return func(p *Parser) error {
+		p.memoize = true
+		return nil
+	}
+}
+
+// Factory registers the types that may be captured into fields of an interface type tagged with
+// `factory:""`, keyed by the discriminator token that selects them, eg.
+//
+//     participle.Factory((*Shape)(nil), map[string]interface{}{
+//         "circle": &Circle{},
+//         "square": &Square{},
+//     })
+//
+// A field tagged with `factory:"<separator>"` requires the separator after the discriminator,
+// eg. `circle: ...`, and reports an error for an unknown discriminator rather than not matching.
+func Factory(iface interface{}, types map[string]interface{}) Option {
+	return afterBuild(func(p *Parser) error {
+		t := reflect.TypeOf(iface)
+		if t == nil || t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Interface {
+			return fmt.Errorf("factory interface must be given as a pointer to an interface, eg. (*Node)(nil)")
+		}
+		t = t.Elem()
+		registry := p.generator.factory(t)
+		for discriminator, v := range types {
+			typ := reflect.TypeOf(v)
+			if typ == nil || !typ.Implements(t) {
+				return fmt.Errorf("factory type %v for %q does not implement %s", typ, discriminator, t)
+			}
+			registry[discriminator] = p.generator.parseType(typ)
+		}
+		return nil
+	})
+}
+
+// A Converter converts the captured tokens into a value of the type it is registered for.
+type Converter func(values []string) (interface{}, error)
+
+// Convert registers a Converter for fields of type t, eg. net.IP or a named enum type, that is
+// consulted before any of the built-in conversions or the Capture interface. Fields of type *t
+// and []t are also converted, the latter once for each captured token.
+func Convert(t reflect.Type, converter Converter) Option {
+	return func(p *Parser) error {
+		if t == nil || converter == nil {
+			return fmt.Errorf("nil converter type or function")
+		}
+		if p.converters == nil {
+			p.converters = map[reflect.Type]Converter{}
+		}
+		p.converters[t] = converter
+		return nil
+	}
+}
+
+// TimeLocation sets the location of times captured into fields tagged with `time:"<layout>"`
+// whose layout does not include a zone. By default such times are in UTC.
+func TimeLocation(location *time.Location) Option {
+	return func(p *Parser) error {
+		if location == nil {
+			return fmt.Errorf("nil time location")
+		}
+		p.location = location
+		return nil
+	}
+}
+
+// ReturnErrors propagates syntax errors, including the failures of alternatives abandoned by
+// MaxBacktrack, by returning them up through the grammar rather than by panicking.
+//
+// This does not change the result of a parse, but keeps stack traces readable when debugging, as
+// syntax errors are not raised by panicking and recovering. Panics are still used for errors such
+// as failing to set a field.
+func ReturnErrors() Option {
+	return func(p *Parser) error {
+		p.returnErrors = true
+		return nil
+	}
+}
+
+// InjectAllPositions sets the start position of each production into every lexer.Position field
+// of its struct.
+//
+// By default the position is only set into a field named "Pos" or, if there is none, the first
+// field of type lexer.Position.
+func InjectAllPositions() Option {
+	return afterBuild(func(p *Parser) error {
+		visit(p.root, func(n node) {
+			if s, ok := n.(*strct); ok {
+				s.injectAllPos = true
+			}
+		})
+		return nil
+	})
+}
+
+// SubParser parses the contents of `balanced` fields of the sub-parser's grammar type with
+// sub, eg. to parse an embedded language with its own lexer.
+//
+// The source of each region is re-lexed by sub, and the positions of any errors are reported
+// relative to the outer source.
+func SubParser(sub *Parser) Option {
+	return afterBuild(func(p *Parser) error {
+		root, ok := sub.root.(*strct)
+		if !ok {
+			return fmt.Errorf("sub-parser grammar must be a struct")
+		}
+		visit(p.root, func(n node) {
+			if b, ok := n.(*balanced); ok && indirectType(b.field.Type) == root.typ {
+				b.parser = sub
+				p.keepSource = true
+			}
+		})
+		return nil
+	})
+}
+
+// Elide removes tokens of the named types, eg. "Comment", before they reach the grammar, so that
+// they may appear anywhere in the input.
+func Elide(types ...string) Option {
+	return afterBuild(func(p *Parser) error {
+		symbols := p.lex.Symbols()
+		for _, name := range types {
+			if typ, ok := symbols[name]; !ok || typ == lexer.EOF {
+				return fmt.Errorf("can not elide unknown token type %q", name)
+			}
+		}
+		p.lex = lexer.Elide(p.lex, types...)
+		return nil
+	})
+}
+
+// Map transforms each token before it reaches the grammar, eg. to unquote strings or lowercase
+// identifiers, so that literals match, and fields capture, the transformed tokens.
+func Map(mapper func(lexer.Token) lexer.Token) Option {
+	return afterBuild(func(p *Parser) error {
+		if mapper == nil {
+			return errors.New("Map requires a mapping function")
+		}
+		p.lex = lexer.Map(p.lex, func(token *lexer.Token) *lexer.Token {
+			out := mapper(*token)
+			return &out
+		})
+		return nil
+	})
+}
+
+// Unquote decodes the escapes of tokens of the named types, "String" if none are given, before they
+// reach the grammar, so that fields capture their unquoted values. Backquoted tokens are used
+// verbatim, while malformed escapes are reported as errors at the token.
+//
+// The default lexer already unquotes its String, RawString and Char tokens.
+func Unquote(types ...string) Option {
+	return afterBuild(func(p *Parser) error {
+		if len(types) == 0 {
+			types = []string{"String"}
+		}
+		symbols := p.lex.Symbols()
+		for _, name := range types {
+			if typ, ok := symbols[name]; !ok || typ == lexer.EOF {
+				return fmt.Errorf("can not unquote unknown token type %q", name)
+			}
+		}
+		p.lex = lexer.Unquote(p.lex, types...)
+		return nil
+	})
+}
+
+// Recover from syntax errors in the elements of repetitions, such as the statements of a file,
+// by skipping the input up to and including the next of syncTokens, eg. ";", and continuing with
+// the next element.
+//
+// A parse that recovered returns Errors, listing every syntax error found, while v receives what
+// could be parsed.
+func Recover(syncTokens ...string) Option {
+	return func(p *Parser) error {
+		if len(syncTokens) == 0 {
+			return errors.New("Recover requires at least one synchronisation token")
+		}
+		p.syncTokens = map[string]bool{}
+		for _, token := range syncTokens {
+			p.syncTokens[token] = true
+		}
+		return nil
+	}
+}
+
+// CaseInsensitive matches literals in the grammar regardless of case, eg. "select" matches SELECT
+// and Select. Fields capturing a literal receive the token as it appears in the input.
+func CaseInsensitive() Option {
+	return afterBuild(func(p *Parser) error {
+		visit(p.root, func(n node) {
+			if l, ok := n.(*literal); ok {
+				l.fold = true
+			}
+		})
+		return nil
+	})
+}
+
+// ValidateUTF8 rejects input that is not valid UTF-8, reporting the position of the first invalid
+// byte, rather than lexing it into garbage tokens.
+//
+// This requires reading the entire input before parsing, so is off by default.
+func ValidateUTF8() Option {
+	return func(p *Parser) error {
+		p.validateUTF8 = true
+		return nil
+	}
+}
+
+// Returns an error positioned at the first invalid UTF-8 sequence in data, if any.
+func validateUTF8(filename string, data []byte) error {
+	pos := lexer.Position{Filename: filename, Line: 1, Column: 1}
+	for pos.Offset < len(data) {
+		rn, size := utf8.DecodeRune(data[pos.Offset:])
+		if rn == utf8.RuneError && size <= 1 {
+			return lexer.Errorf(pos, "invalid UTF-8 byte 0x%02x", data[pos.Offset])
+		}
+		pos.Offset += size
+		if rn == '\n' {
+			pos.Line++
+			pos.Column = 1
+		} else {
+			pos.Column++
+		}
+	}
+	return nil
+}
+
+// A Reader that preserves the name of the Reader it was read from.
+type namedReader struct {
+	io.Reader
+	name string
+}
+
+func (n *namedReader) Name() string {
+	return n.name
+}
+
+// A ParseOption modifies the behaviour of a single parse.
+type ParseOption func(p *parseContext)
+
+// DisableProductions prevents the named productions (grammar struct type names) from matching
+// during the parse, eg. to turn off experimental syntax.
+//
+// A disabled production behaves exactly as if its input did not match, so alternatives fall through
+// to the next branch, while a disabled production that is required results in the usual syntax
+// error at the point it would have been parsed.
+func DisableProductions(names ...string) ParseOption {
+	return func(p *parseContext) {
+		if p.disabled == nil {
+			p.disabled = map[string]bool{}
+		}
+		for _, name := range names {
+			p.disabled[name] = true
+		}
+	}
+}
+
+// AllowTrailing permits input to remain after the grammar has matched, rather than failing the
+// parse with an "unexpected token" error, eg. to parse a prefix of the input and leave the rest
+// to another parser.
+//
+// If consumed is non-nil it is set to the byte offset of the first token not consumed by the
+// parse, or of EOF if the whole input was consumed, from which the rest of the input may be read.
+func AllowTrailing(consumed *int) ParseOption {
+	return func(p *parseContext) {
+		p.allowTrailing = true
+		p.consumed = consumed
+	}
+}
+
+// A Lexer that normalizes the value of identifier tokens.
+type normalizingLexer struct {
+	lexer.Lexer
+	ident rune
+	form  norm.Form
+}
+
+func (n *normalizingLexer) Peek() lexer.Token {
+	return n.normalized(n.Lexer.Peek())
+}
+
+func (n *normalizingLexer) Next() lexer.Token {
+	return n.normalized(n.Lexer.Next())
+}
+
+func (n *normalizingLexer) normalized(token lexer.Token) lexer.Token {
+	if token.Type == n.ident {
+		token.Value = n.form.String(token.Value)
+	}
+	return token
+}
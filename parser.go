@@ -2,24 +2,69 @@ package participle
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"reflect"
 	"strings"
+	"time"
+
+	"golang.org/x/text/unicode/norm"
 
 	"github.com/peterebden/participle/lexer"
 )
 
 // A Parser for a particular grammar and lexer.
+//
+// A Parser is not modified by parsing, so once built it may be used by multiple goroutines
+// concurrently.
 type Parser struct {
 	root node
 	lex  lexer.Definition
+	// The type of the grammar if it is a slice of the root production, eg. `type EBNF []*Production`.
+	rootSlice reflect.Type
+	// The context the grammar was built in, for options that build further grammar.
+	generator *generatorContext
+	// Unicode normalization applied to identifiers, if any.
+	normalize *norm.Form
+	// Reject input that is not valid UTF-8.
+	validateUTF8 bool
+	// Maximum number of tokens a failed alternative may consume and still be backtracked.
+	maxBacktrack int
+	// Retain the source so that fields can capture it verbatim.
+	keepSource bool
+	// Report syntax errors by returning them through the parse rather than panicking.
+	returnErrors bool
+	// Location of times captured without a zone, if not UTC.
+	location *time.Location
+	// Conversions of captured tokens to values of particular types.
+	converters map[reflect.Type]Converter
+	// Options applied once the grammar has been built.
+	afterBuild []Option
+	// Tokens to resynchronise on after a syntax error, if recovering from them.
+	syncTokens map[string]bool
+	// Memoize the results of parsing productions at each position.
+	memoize bool
+	// The fields each node of the grammar may capture into.
+	snapshots snapshotFields
 }
 
-// MustBuild calls Build(grammar, lex) and panics if an error occurs.
-func MustBuild(grammar interface{}, lex lexer.Definition) *Parser {
-	parser, err := Build(grammar, lex)
+// Errors are the syntax errors found by a parse that recovered from them, in order.
+type Errors []*lexer.Error
+
+func (e Errors) Error() string {
+	messages := []string{}
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "\n")
+}
+
+// MustBuild calls Build(grammar, options...) and panics if an error occurs.
+func MustBuild(grammar interface{}, options ...Option) *Parser {
+	parser, err := Build(grammar, options...)
 	if err != nil {
 		panic(err)
 	}
@@ -28,11 +73,11 @@ func MustBuild(grammar interface{}, lex lexer.Definition) *Parser {
 
 // Build constructs a parser for the given grammar.
 //
-// If "lex" is nil, the default lexer based on text/scanner will be used. This scans typical Go-
-// like tokens.
+// Unless the UseLexer option is given, the default lexer based on text/scanner will be used. This
+// scans typical Go-like tokens.
 //
 // See documentation for details
-func Build(grammar interface{}, lex lexer.Definition) (parser *Parser, err error) {
+func Build(grammar interface{}, options ...Option) (parser *Parser, err error) {
 	defer func() {
 		if msg := recover(); msg != nil {
 			if s, ok := msg.(string); ok {
@@ -44,23 +89,102 @@ func Build(grammar interface{}, lex lexer.Definition) (parser *Parser, err error
 			}
 		}
 	}()
-	if lex == nil {
-		lex = lexer.TextScannerLexer
+	parser = &Parser{lex: lexer.TextScannerLexer}
+	for _, option := range options {
+		if option == nil {
+			return nil, errors.New("nil Option passed; to use a custom lexer pass UseLexer(lexer)")
+		}
+		if err = option(parser); err != nil {
+			return nil, err
+		}
+	}
+	parser.generator = newGeneratorContext(parser.lex)
+	parser.root = parser.generator.parseType(reflect.TypeOf(grammar))
+	if t := reflect.TypeOf(grammar); t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Slice {
+		if _, ok := parser.root.(*strct); ok {
+			parser.rootSlice = t.Elem()
+		}
+	}
+	for _, option := range parser.afterBuild {
+		if err = option(parser); err != nil {
+			return nil, err
+		}
 	}
-	context := newGeneratorContext(lex)
-	root := context.parseType(reflect.TypeOf(grammar))
-	return &Parser{root: root, lex: lex}, nil
+	visit(parser.root, func(n node) {
+		switch n := n.(type) {
+		case *reference:
+			if n.preserve || n.quotes != nil {
+				parser.keepSource = true
+			}
+		case *strct:
+			validateRepeatedCaptures(n)
+		}
+	})
+	parser.snapshots = captureFields(parser.root)
+	return parser, nil
 }
 
 // Parse from r into grammar v which must be of the same type as the grammar passed to
 // participle.Build().
-func (p *Parser) Parse(r io.Reader, v interface{}) (err error) {
+func (p *Parser) Parse(r io.Reader, v interface{}, options ...ParseOption) (err error) {
+	return p.ParseContext(context.Background(), r, v, options...)
+}
+
+// ParseContext is like Parse, but makes ctx available to fields implementing ContextCapture for
+// the duration of the parse.
+func (p *Parser) ParseContext(ctx context.Context, r io.Reader, v interface{}, options ...ParseOption) (err error) {
+	defer func() {
+		if msg := recover(); msg != nil {
+			err = fmt.Errorf("%s", msg)
+		}
+	}()
+	pctx, err := p.newParseContext(ctx, r, options)
+	if err != nil {
+		return err
+	}
+	return p.parseRecovering(pctx, v)
+}
+
+// ParseFromLexer parses the tokens of lex, eg. from a tokeniser reading a network stream, rather
+// than lexing an io.Reader with the parser's lexer definition.
+//
+// The tokens must be of the types of the parser's lexer definition, as given by UseLexer, and are
+// used as is, so options transforming the tokens of the definition such as Elide do not apply.
+// Grammars requiring the source text, eg. to capture it verbatim, can not be parsed from a lexer.
+func (p *Parser) ParseFromLexer(lex lexer.Lexer, v interface{}, options ...ParseOption) (err error) {
+	return p.ParseFromLexerContext(context.Background(), lex, v, options...)
+}
+
+// ParseFromLexerContext is like ParseFromLexer, but makes ctx available to fields implementing
+// ContextCapture for the duration of the parse.
+func (p *Parser) ParseFromLexerContext(ctx context.Context, lex lexer.Lexer, v interface{}, options ...ParseOption) (err error) {
 	defer func() {
 		if msg := recover(); msg != nil {
 			err = fmt.Errorf("%s", msg)
 		}
 	}()
-	lex := p.lex.Lex(r)
+	if p.keepSource {
+		return errors.New("grammar requires the source text, which is not available from a lexer")
+	}
+	return p.parseRecovering(p.newLexerContext(ctx, lex, nil, options), v)
+}
+
+// Parse v, returning Errors if the parse recovered from any syntax errors.
+func (p *Parser) parseRecovering(pctx *parseContext, v interface{}) error {
+	err := p.parse(pctx, v)
+	if len(pctx.recovered) == 0 {
+		return err
+	}
+	errs := Errors(pctx.recovered)
+	if perr, ok := err.(*lexer.Error); ok {
+		errs = append(errs, perr)
+	} else if err != nil {
+		return err
+	}
+	return errs
+}
+
+func (p *Parser) parse(lex *parseContext, v interface{}) (err error) {
 	// If the grammar implements Parseable, use it.
 	if parseable, ok := v.(Parseable); ok {
 		err = parseable.Parse(lex)
@@ -68,8 +192,8 @@ func (p *Parser) Parse(r io.Reader, v interface{}) (err error) {
 		if err == NextMatch {
 			return lexer.Errorf(peek.Pos, "invalid syntax")
 		}
-		if err == nil && !peek.EOF() {
-			return lexer.Errorf(peek.Pos, "unexpected token %q", peek)
+		if err == nil {
+			return lex.finish()
 		}
 		return err
 	}
@@ -78,34 +202,137 @@ func (p *Parser) Parse(r io.Reader, v interface{}) (err error) {
 		if msg := recover(); msg != nil {
 			if perr, ok := msg.(*lexer.Error); ok {
 				err = perr
+			} else if cerr, ok := msg.(captureError); ok {
+				err = cerr.err
 			} else {
 				panicf("unexpected error %s", msg)
 			}
 		}
 	}()
 	rv := reflect.ValueOf(v)
+	if p.rootSlice != nil && rv.Kind() == reflect.Ptr && rv.Elem().Kind() == reflect.Slice {
+		return p.parseSlice(lex, rv.Elem())
+	}
 	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
 		return errors.New("target must be a pointer to a struct")
 	}
 	pv := p.root.Parse(lex, rv.Elem())
-	if !lex.Peek().EOF() {
-		lexer.Panicf(lex.Peek().Pos, "unexpected token %q", lex.Peek())
+	if lex.failed() {
+		return lex.err
 	}
 	if pv == nil {
-		lexer.Panic(lex.Peek().Pos, "invalid syntax")
+		lex.failExpected(p.root)
+		return lex.err
+	}
+	if err := lex.finish(); err != nil {
+		return err
 	}
 	rv.Elem().Set(reflect.Indirect(pv[0]))
 	return
 }
 
+// Parse a grammar whose root is a slice by appending matches of the root production to slice
+// until the input is exhausted, or the root no longer matches if trailing input is allowed.
+func (p *Parser) parseSlice(lex *parseContext, slice reflect.Value) error {
+	for !lex.Peek().EOF() {
+		start := lex.checkpoint()
+		pv := p.root.Parse(lex, slice)
+		if lex.failed() {
+			return lex.err
+		}
+		if lex.allowTrailing && (pv == nil || lex.checkpoint() == start) {
+			lex.restore(start)
+			break
+		}
+		if pv == nil {
+			lex.failExpected(p.root)
+			return lex.err
+		}
+		if lex.checkpoint() == start {
+			lex.Panicf(lex.Peek().Pos, "unexpected token %q", lex.Peek())
+		}
+		slice.Set(reflect.Append(slice, conformValue(slice.Type().Elem(), pv[0])))
+	}
+	return lex.finish()
+}
+
+// Create the context for parsing r, applying any options that validate input or transform tokens.
+func (p *Parser) newParseContext(ctx context.Context, r io.Reader, options []ParseOption) (*parseContext, error) {
+	var source []byte
+	if p.validateUTF8 || p.keepSource {
+		var err error
+		name := lexer.NameOfReader(r)
+		if source, err = ioutil.ReadAll(r); err != nil {
+			return nil, err
+		}
+		if p.validateUTF8 {
+			if err = validateUTF8(name, source); err != nil {
+				return nil, err
+			}
+		}
+		r = &namedReader{Reader: bytes.NewReader(source), name: name}
+	}
+	return p.newLexerContext(ctx, p.lex.Lex(r), source, options), nil
+}
+
+// Create the context for parsing the tokens of lex, lexed from source if it is retained.
+func (p *Parser) newLexerContext(ctx context.Context, lex lexer.Lexer, source []byte, options []ParseOption) *parseContext {
+	if p.normalize != nil {
+		lex = &normalizingLexer{Lexer: lex, ident: p.lex.Symbols()["Ident"], form: *p.normalize}
+	}
+	pctx := newParseContext(ctx, lex)
+	pctx.source = source
+	pctx.maxBacktrack = p.maxBacktrack
+	pctx.returnErrors = p.returnErrors
+	pctx.location = p.location
+	pctx.converters = p.converters
+	pctx.syncTokens = p.syncTokens
+	pctx.snapshots = p.snapshots
+	if p.memoize {
+		pctx.memo = map[memoKey]memoEntry{}
+	}
+	for _, option := range options {
+		option(pctx)
+	}
+	return pctx
+}
+
 // ParseString is a convenience around Parse().
-func (p *Parser) ParseString(s string, v interface{}) error {
-	return p.Parse(strings.NewReader(s), v)
+func (p *Parser) ParseString(s string, v interface{}, options ...ParseOption) error {
+	return p.Parse(strings.NewReader(s), v, options...)
 }
 
 // ParseBytes is a convenience around Parse().
-func (p *Parser) ParseBytes(b []byte, v interface{}) error {
-	return p.Parse(bytes.NewReader(b), v)
+func (p *Parser) ParseBytes(b []byte, v interface{}, options ...ParseOption) error {
+	return p.Parse(bytes.NewReader(b), v, options...)
+}
+
+// ParseStringInto parses s into a new value of the grammar's type, returning a pointer to it, eg.
+// a *Grammar for a parser built with Build(&Grammar{}).
+//
+// The value is returned along with any error, so that what could be parsed is available, eg. when
+// recovering from syntax errors with the Recover option.
+func (p *Parser) ParseStringInto(s string, options ...ParseOption) (interface{}, error) {
+	v := reflect.New(p.rootType()).Interface()
+	return v, p.ParseString(s, v, options...)
+}
+
+// Tokens lexes r as Parse would, returning the tokens the grammar would be matched against,
+// including the final EOF token. This is useful for debugging grammars that do not match.
+//
+// Tokens transformed or removed by options such as Elide or Map are returned as the grammar sees
+// them. An error is returned if the input can not be lexed.
+func (p *Parser) Tokens(r io.Reader) (tokens []lexer.Token, err error) {
+	defer func() {
+		if msg := recover(); msg != nil {
+			err = fmt.Errorf("%s", msg)
+		}
+	}()
+	ctx, err := p.newParseContext(context.Background(), r, nil)
+	if err != nil {
+		return nil, err
+	}
+	return lexer.ConsumeAll(ctx)
 }
 
 // String representation of the grammar.
@@ -1,10 +1,23 @@
 package participle
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"net/netip"
+	"reflect"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"text/scanner"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"golang.org/x/text/unicode/norm"
 
 	"github.com/peterebden/participle/lexer"
 )
@@ -14,7 +27,7 @@ func TestProductionReference(t *testing.T) {
 		A string `@Test`
 	}
 
-	_, err := Build(&testReference{}, nil)
+	_, err := Build(&testReference{})
 	require.Error(t, err)
 }
 
@@ -227,7 +240,7 @@ type Group struct {
 	Expression *Expression `"(" @@ ")"`
 }
 
-type Option struct {
+type EBNFOption struct {
 	Expression *Expression `"[" @@ "]"`
 }
 
@@ -244,7 +257,7 @@ type Term struct {
 	Name       string      `@Ident |`
 	Literal    *Literal    `@@ |`
 	Group      *Group      `@@ |`
-	Option     *Option     `@@ |`
+	Option     *EBNFOption `@@ |`
 	Repetition *Repetition `@@`
 }
 
@@ -280,7 +293,7 @@ func TestEBNF(t *testing.T) {
 									{Name: "name"},
 									{Literal: &Literal{Start: "="}},
 									{
-										Option: &Option{
+										Option: &EBNFOption{
 											Expression: &Expression{
 												Alternatives: []*Sequence{
 													{
@@ -364,7 +377,7 @@ func TestEBNF(t *testing.T) {
 								Terms: []*Term{
 									{Name: "token"},
 									{
-										Option: &Option{
+										Option: &EBNFOption{
 											Expression: &Expression{
 												Alternatives: []*Sequence{
 													{
@@ -523,13 +536,13 @@ func TestHello(t *testing.T) {
 }
 
 func mustTestParser(t *testing.T, grammar interface{}) *Parser {
-	parser, err := Build(grammar, nil)
+	parser, err := Build(grammar)
 	require.NoError(t, err)
 	return parser
 }
 
 func BenchmarkEBNFParser(b *testing.B) {
-	parser, err := Build(&EBNF{}, nil)
+	parser, err := Build(&EBNF{})
 	require.NoError(b, err)
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -623,7 +636,7 @@ func TestLiteralTypeConstraint(t *testing.T) {
 		Literal string `@"123456":String`
 	}
 
-	parser, err := Build(&grammar{}, lexer.DefaultDefinition)
+	parser, err := Build(&grammar{}, UseLexer(lexer.DefaultDefinition))
 	require.NoError(t, err)
 
 	actual := &grammar{}
@@ -650,7 +663,7 @@ func TestStructCaptureInterface(t *testing.T) {
 		Capture *nestedCapture `@String`
 	}
 
-	parser, err := Build(&grammar{}, nil)
+	parser, err := Build(&grammar{})
 	require.NoError(t, err)
 
 	actual := &grammar{}
@@ -680,7 +693,7 @@ func TestParseable(t *testing.T) {
 		Inner *parseableStruct `@@`
 	}
 
-	parser, err := Build(&grammar{}, nil)
+	parser, err := Build(&grammar{})
 	require.NoError(t, err)
 
 	actual := &grammar{}
@@ -690,12 +703,56 @@ func TestParseable(t *testing.T) {
 	require.Equal(t, expected, actual)
 }
 
+// Parses `version <n>`, reporting where the version is invalid.
+type parseableVersion struct {
+	Version string
+}
+
+func (p *parseableVersion) Parse(lex lexer.Lexer) error {
+	if lex.Peek().Value != "version" {
+		return NextMatch
+	}
+	lex.Next()
+	token := lex.Next()
+	if token.Type != scanner.Int {
+		return lexer.Errorf(token.Pos, "expected a version number but got %q", token.Value)
+	}
+	if token.Value != "1" && token.Value != "2" {
+		return fmt.Errorf("unsupported version %s", token.Value)
+	}
+	p.Version = token.Value
+	return nil
+}
+
+func TestParseableError(t *testing.T) {
+	type grammar struct {
+		Version *parseableVersion `parser:"@@"`
+	}
+
+	for _, options := range [][]Option{nil, {ReturnErrors()}} {
+		parser, err := Build(&grammar{}, options...)
+		require.NoError(t, err)
+
+		actual := &grammar{}
+		err = parser.ParseString(`version 2`, actual)
+		require.NoError(t, err)
+		require.Equal(t, &grammar{Version: &parseableVersion{"2"}}, actual)
+
+		err = parser.ParseString(`version x`, &grammar{})
+		require.EqualError(t, err, `<source>:1:8: expected a version number but got "x"`)
+		require.IsType(t, &lexer.Error{}, err)
+
+		err = parser.ParseString(`version 3`, &grammar{})
+		require.EqualError(t, err, `<source>:1:1: unsupported version 3`)
+	}
+}
+
 func TestIncrementInt(t *testing.T) {
 	type grammar struct {
 		Field int `@"." { @"." }`
 	}
 
-	parser, err := Build(&grammar{}, nil)
+	parser, err := Build(&grammar{})
 	require.NoError(t, err)
 
 	actual := &grammar{}
@@ -710,7 +767,7 @@ func TestIncrementUint(t *testing.T) {
 		Field uint `@"." { @"." }`
 	}
 
-	parser, err := Build(&grammar{}, nil)
+	parser, err := Build(&grammar{})
 	require.NoError(t, err)
 
 	actual := &grammar{}
@@ -725,7 +782,7 @@ func TestIncrementFloat(t *testing.T) {
 		Field float32 `@"." { @"." }`
 	}
 
-	parser, err := Build(&grammar{}, nil)
+	parser, err := Build(&grammar{})
 	require.NoError(t, err)
 
 	actual := &grammar{}
@@ -740,7 +797,7 @@ func TestStringConcat(t *testing.T) {
 		Field string `@"." { @"." }`
 	}
 
-	parser, err := Build(&grammar{}, nil)
+	parser, err := Build(&grammar{})
 	require.NoError(t, err)
 
 	actual := &grammar{}
@@ -755,7 +812,7 @@ func TestParseIntSlice(t *testing.T) {
 		Field []int `@Int { @Int }`
 	}
 
-	parser, err := Build(&grammar{}, nil)
+	parser, err := Build(&grammar{})
 	require.NoError(t, err)
 
 	actual := &grammar{}
@@ -765,21 +822,2964 @@ func TestParseIntSlice(t *testing.T) {
 	require.Equal(t, expected, actual)
 }
 
-// func TestParseIntPointerSlice(t *testing.T) {
-// 	type grammar struct {
-// 		Field []*int `@Int { @Int }`
-// 	}
-
-// 	parser, err := Build(&grammar{}, nil)
-// 	require.NoError(t, err)
-
-// 	actual := &grammar{}
-// 	i0 := 1
-// 	i1 := 2
-// 	i2 := 3
-// 	i3 := 4
-// 	expected := &grammar{[]*int{&i0, &i1, &i2, &i3}}
-// 	err = parser.ParseString(`1 2 3 4`, actual)
-// 	require.NoError(t, err)
-// 	require.Equal(t, expected, actual)
-// }
+func TestParseIntPointerSlice(t *testing.T) {
+	type grammar struct {
+		Field []*int `@Int { @Int }`
+	}
+
+	parser, err := Build(&grammar{})
+	require.NoError(t, err)
+
+	actual := &grammar{}
+	i0 := 1
+	i1 := 2
+	i2 := 3
+	i3 := 4
+	expected := &grammar{[]*int{&i0, &i1, &i2, &i3}}
+	err = parser.ParseString(`1 2 3 4`, actual)
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+}
+
+func TestUnaryOperators(t *testing.T) {
+	type grammar struct {
+		Op      []string `unary:"- + !"`
+		Operand int      `@Int`
+	}
+
+	parser := mustTestParser(t, &grammar{})
+
+	actual := &grammar{}
+	err := parser.ParseString(`--1`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Op: []string{"-", "-"}, Operand: 1}, actual)
+
+	actual = &grammar{}
+	err = parser.ParseString(`1`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Operand: 1}, actual)
+}
+
+func TestUnaryOperatorStackedIntoString(t *testing.T) {
+	type grammar struct {
+		Op      string `parser:"@@" unary:"- +"`
+		Operand int    `parser:"@Int"`
+	}
+
+	parser := mustTestParser(t, &grammar{})
+
+	actual := &grammar{}
+	err := parser.ParseString(`+1`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Op: "+", Operand: 1}, actual)
+
+	err = parser.ParseString(`-+1`, &grammar{})
+	require.Error(t, err)
+}
+
+func TestPEG(t *testing.T) {
+	parser := mustTestParser(t, &EBNF{})
+	expected := `EBNF <- Production*
+Production <- Ident "=" Expression Expression* "."
+Expression <- Sequence ("|" Sequence)*
+Sequence <- Term Term*
+Term <- Ident / Literal / Group / EBNFOption / Repetition
+Literal <- String ("…" String)?
+Group <- "(" Expression ")"
+EBNFOption <- "[" Expression "]"
+Repetition <- "{" Expression "}"
+`
+	require.Equal(t, expected, parser.PEG())
+}
+
+func TestParserEBNF(t *testing.T) {
+	parser := mustTestParser(t, &EBNF{})
+	expected := `EBNF = { Production } .
+Production = Ident "=" Expression { Expression } "." .
+Expression = Sequence { "|" Sequence } .
+Sequence = Term { Term } .
+Term = Ident | Literal | Group | EBNFOption | Repetition .
+Literal = String [ "…" String ] .
+Group = "(" Expression ")" .
+EBNFOption = "[" Expression "]" .
+Repetition = "{" Expression "}" .
+`
+	require.Equal(t, expected, parser.EBNF())
+
+	type list struct {
+		Kind  string   `@("var" | "let")`
+		Names []string `"(" { @Ident % "," }1,3 ")"`
+	}
+	parser = mustTestParser(t, &list{})
+	require.Equal(t, `list = ( "var" | "let" ) "(" Ident [ "," Ident ] [ "," Ident ] ")" .`+"\n", parser.EBNF())
+}
+
+func TestPathCapture(t *testing.T) {
+	type grammar struct {
+		Segments []string `path:""`
+		Joined   string   `parser:"'=' @@" path:"."`
+	}
+
+	parser := mustTestParser(t, &grammar{})
+
+	actual := &grammar{}
+	err := parser.ParseString(`a.b.c = d.e`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Segments: []string{"a", "b", "c"}, Joined: "d.e"}, actual)
+
+	err = parser.ParseString(`a. = b`, &grammar{})
+	require.Error(t, err)
+}
+
+type symbolTableKey struct{}
+
+type uniqueSymbol string
+
+func (u *uniqueSymbol) CaptureContext(ctx context.Context, values []string) error {
+	symbols := ctx.Value(symbolTableKey{}).(map[string]bool)
+	name := strings.Join(values, "")
+	if symbols[name] {
+		return fmt.Errorf("duplicate symbol %q", name)
+	}
+	symbols[name] = true
+	*u = uniqueSymbol(name)
+	return nil
+}
+
+func TestContextCapture(t *testing.T) {
+	type decl struct {
+		Name uniqueSymbol `"var" @Ident`
+	}
+	type grammar struct {
+		Decls []*decl `{ @@ }`
+	}
+
+	parser := mustTestParser(t, &grammar{})
+
+	ctx := context.WithValue(context.Background(), symbolTableKey{}, map[string]bool{})
+	actual := &grammar{}
+	err := parser.ParseContext(ctx, strings.NewReader(`var a var b`), actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Decls: []*decl{{Name: "a"}, {Name: "b"}}}, actual)
+
+	ctx = context.WithValue(context.Background(), symbolTableKey{}, map[string]bool{})
+	err = parser.ParseContext(ctx, strings.NewReader(`var a var a`), &grammar{})
+	require.Error(t, err)
+}
+
+type lowerIdent string
+
+func (l *lowerIdent) CapturePosition(pos lexer.Position, values []string) error {
+	name := strings.Join(values, "")
+	if len(name) > 8 {
+		return fmt.Errorf("identifier %q is too long", name)
+	}
+	for i, r := range name {
+		if r >= 'A' && r <= 'Z' {
+			pos.Offset += i
+			pos.Column += i
+			return lexer.Errorf(pos, "unexpected upper case %q", r)
+		}
+	}
+	*l = lowerIdent(name)
+	return nil
+}
+
+func TestPositionCapture(t *testing.T) {
+	type grammar struct {
+		Name   lowerIdent   `parser:"\"var\" @Ident"`
+		Others []lowerIdent `parser:"{ @Ident }"`
+	}
+
+	lex := lexer.Must(lexer.Regexp(`(?P<Ident>[a-zA-Z]+)|(\s+)`))
+	parser, err := Build(&grammar{}, UseLexer(lex))
+	require.NoError(t, err)
+
+	actual := &grammar{}
+	err = parser.ParseString(`var a b c`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Name: "a", Others: []lowerIdent{"b", "c"}}, actual)
+
+	err = parser.ParseString(`var fooBar`, &grammar{})
+	require.EqualError(t, err, `<source>:1:8: unexpected upper case 'B'`)
+
+	err = parser.ParseString(`var a b cD`, &grammar{})
+	require.EqualError(t, err, `<source>:1:10: unexpected upper case 'D'`)
+
+	err = parser.ParseString(`var abcdefghij`, &grammar{})
+	require.Contains(t, err.Error(), `1:5: identifier "abcdefghij" is too long`)
+}
+
+func TestOneOrMore(t *testing.T) {
+	type grammar struct {
+		Field []int `@Int+`
+	}
+
+	parser := mustTestParser(t, &grammar{})
+
+	actual := &grammar{}
+	err := parser.ParseString(`1 2 3 4`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{[]int{1, 2, 3, 4}}, actual)
+
+	actual = &grammar{}
+	err = parser.ParseString(`1`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{[]int{1}}, actual)
+
+	err = parser.ParseString(``, &grammar{})
+	require.Error(t, err)
+}
+
+type initializedGrammar struct {
+	Seen  map[string]bool
+	Names []*initializedName `{ @@ }`
+}
+
+func (i *initializedGrammar) Init() {
+	i.Seen = map[string]bool{}
+}
+
+type initializedName struct {
+	Name    string `@Ident`
+	Default int
+}
+
+func (i *initializedName) Init() {
+	i.Default = 42
+}
+
+func TestInitializer(t *testing.T) {
+	parser := mustTestParser(t, &initializedGrammar{})
+
+	actual := &initializedGrammar{}
+	err := parser.ParseString(`a b`, actual)
+	require.NoError(t, err)
+	expected := &initializedGrammar{
+		Seen:  map[string]bool{},
+		Names: []*initializedName{{Name: "a", Default: 42}, {Name: "b", Default: 42}},
+	}
+	require.Equal(t, expected, actual)
+}
+
+type posSetterGrammar struct {
+	pos  lexer.Position
+	Name string `parser:"@Ident"`
+}
+
+func (p *posSetterGrammar) SetPos(pos lexer.Position) {
+	p.pos = pos
+}
+
+func TestPosSetter(t *testing.T) {
+	type grammar struct {
+		Names []*posSetterGrammar `parser:"{ @@ }"`
+	}
+	parser := mustTestParser(t, &grammar{})
+
+	actual := &grammar{}
+	err := parser.ParseString(`a b`, actual)
+	require.NoError(t, err)
+	require.Len(t, actual.Names, 2)
+	require.Equal(t, lexer.Position{Line: 1, Column: 1}, actual.Names[0].pos)
+	require.Equal(t, lexer.Position{Offset: 1, Line: 1, Column: 2}, actual.Names[1].pos)
+}
+
+type binaryHeader struct {
+	magic   []byte
+	version byte
+}
+
+func (b *binaryHeader) UnmarshalBinary(data []byte) error {
+	if len(data) != 4 {
+		return fmt.Errorf("expected 4 byte header but got %d", len(data))
+	}
+	b.magic = data[:3]
+	b.version = data[3]
+	return nil
+}
+
+func TestBinaryUnmarshaler(t *testing.T) {
+	type grammar struct {
+		Header *binaryHeader `@String`
+	}
+
+	parser := mustTestParser(t, &grammar{})
+
+	actual := &grammar{}
+	err := parser.ParseString(`"ELF\x02"`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Header: &binaryHeader{magic: []byte("ELF"), version: 2}}, actual)
+
+	err = parser.ParseString(`"ELF"`, &grammar{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "expected 4 byte header but got 3")
+}
+
+func TestTextUnmarshaler(t *testing.T) {
+	type grammar struct {
+		Addresses []net.IP   `"allow" { @String }`
+		Default   net.IP     `[ "default" @String ]`
+		Gateway   netip.Addr `[ "gateway" @String ]`
+		Limit     *big.Int   `"limit" @Int`
+	}
+
+	parser := mustTestParser(t, &grammar{})
+
+	actual := &grammar{}
+	err := parser.ParseString(`allow "10.0.0.1" "::1" default "10.0.0.2" gateway "10.0.0.254" limit 123456789012345678901234567890`, actual)
+	require.NoError(t, err)
+	limit, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+	require.Equal(t, &grammar{
+		Addresses: []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("::1")},
+		Default:   net.ParseIP("10.0.0.2"),
+		Gateway:   netip.MustParseAddr("10.0.0.254"),
+		Limit:     limit,
+	}, actual)
+
+	err = parser.ParseString(`allow "10.0.0" limit 1`, &grammar{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `1:6: invalid IP address: 10.0.0`)
+}
+
+func TestUnusedTokens(t *testing.T) {
+	type grammar struct {
+		Key   string `@Ident "="`
+		Value string `@String | @"123":Int`
+	}
+
+	parser := mustTestParser(t, &grammar{})
+	require.Equal(t, []string{"Char", "Comment", "Float", "RawString"}, parser.UnusedTokens())
+}
+
+func TestUnixTimestamp(t *testing.T) {
+	type grammar struct {
+		Seconds      time.Time  `parser:"@Int" unix:"s"`
+		Milliseconds *time.Time `parser:"@Int" unix:"ms"`
+	}
+
+	parser := mustTestParser(t, &grammar{})
+
+	actual := &grammar{}
+	err := parser.ParseString(`1500000000 1500000000123`, actual)
+	require.NoError(t, err)
+	ms := time.Unix(1500000000, 123000000)
+	require.Equal(t, &grammar{Seconds: time.Unix(1500000000, 0), Milliseconds: &ms}, actual)
+}
+
+func TestUnixTimestampInvalid(t *testing.T) {
+	type grammar struct {
+		Seconds time.Time `parser:"@(Int | Ident)" unix:"s"`
+	}
+
+	parser := mustTestParser(t, &grammar{})
+
+	err := parser.ParseString(`yesterday`, &grammar{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `1:1: invalid Unix timestamp "yesterday"`)
+
+	type badUnit struct {
+		Minutes time.Time `parser:"@Int" unix:"m"`
+	}
+	_, err = Build(&badUnit{})
+	require.EqualError(t, err, `badUnit: Minutes: unsupported Unix timestamp unit "m", expected "s" or "ms"`)
+
+	type badType struct {
+		Seconds int64 `parser:"@Int" unix:"s"`
+	}
+	_, err = Build(&badType{})
+	require.EqualError(t, err, `badType: Seconds: Unix timestamps can only be captured into time.Time fields`)
+}
+
+func TestCaptureIntoNamedField(t *testing.T) {
+	type grammar struct {
+		Operands  []int `@Int { @Operators=("+" | "-") @Int }`
+		Operators []string
+	}
+
+	parser := mustTestParser(t, &grammar{})
+
+	actual := &grammar{}
+	err := parser.ParseString(`1 + 2 - 3`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Operands: []int{1, 2, 3}, Operators: []string{"+", "-"}}, actual)
+
+	actual = &grammar{}
+	err = parser.ParseString(`1`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Operands: []int{1}}, actual)
+
+	_, err = Build(&struct {
+		A string `@Missing=Ident`
+	}{})
+	require.Error(t, err)
+}
+
+func TestCaptureFloat(t *testing.T) {
+	type grammar struct {
+		Float float64 `@Float`
+		Int   int     `@Int`
+	}
+
+	parser := mustTestParser(t, &grammar{})
+
+	actual := &grammar{}
+	err := parser.ParseString(`3.14 42`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Float: 3.14, Int: 42}, actual)
+}
+
+func TestCaptureTokens(t *testing.T) {
+	type value struct {
+		Tokens []lexer.Token
+		Value  string `@Ident`
+	}
+	type grammar struct {
+		Tokens []lexer.Token
+		Key    string `@Ident "="`
+		Value  *value `@@`
+	}
+
+	parser := mustTestParser(t, &grammar{})
+
+	actual := &grammar{}
+	err := parser.ParseString(`a=b`, actual)
+	require.NoError(t, err)
+	expected := &grammar{
+		Tokens: []lexer.Token{
+			{Type: scanner.Ident, Value: "a", Pos: lexer.Position{Line: 1, Column: 1}},
+			{Type: '=', Value: "=", Pos: lexer.Position{Offset: 1, Line: 1, Column: 2}},
+			{Type: scanner.Ident, Value: "b", Pos: lexer.Position{Offset: 2, Line: 1, Column: 3}},
+		},
+		Key: "a",
+		Value: &value{
+			Tokens: []lexer.Token{
+				{Type: scanner.Ident, Value: "b", Pos: lexer.Position{Offset: 2, Line: 1, Column: 3}},
+			},
+			Value: "b",
+		},
+	}
+	require.Equal(t, expected, actual)
+}
+
+// The statements of unfactoredStatement with their common prefix factored out by hand.
+type factoredStatement struct {
+	Name   string   `"let" @Ident "="`
+	Int    *int     `( @Int`
+	String *string  `| @String`
+	Float  *float64 `| @Float ) ";"`
+}
+
+type factoredGrammar struct {
+	Statements []*factoredStatement `{ @@ }`
+}
+
+func TestAlternativesWithCommonPrefix(t *testing.T) {
+	// Once the common prefix has been consumed the first alternative is committed to.
+	type grammar struct {
+		Int    int    `  "let" "=" @Int`
+		String string `| "let" "=" @String`
+	}
+	parser := mustTestParser(t, &grammar{})
+	err := parser.ParseString(`let = "s"`, &grammar{})
+	require.EqualError(t, err, `<source>:1:6: while parsing grammar: expected an Int but got "s"`)
+
+	type indexed struct {
+		Alt int `parser:"@(\"a\" | \"b\" \"c\" | \"b\" \"d\")" index:""`
+	}
+	parser, err = Build(&indexed{}, MaxBacktrack(1))
+	require.NoError(t, err)
+	actual := &indexed{}
+	err = parser.ParseString(`b d`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &indexed{Alt: 2}, actual)
+}
+
+// Statements sharing a common prefix as separate productions, which must be backtracked over.
+type unfactoredInt struct {
+	Name  string `"let" @Ident "="`
+	Value int    `@Int ";"`
+}
+
+type unfactoredString struct {
+	Name  string `"let" @Ident "="`
+	Value string `@String ";"`
+}
+
+type unfactoredFloat struct {
+	Name  string  `"let" @Ident "="`
+	Value float64 `@Float ";"`
+}
+
+type unfactoredStatement struct {
+	Int    *unfactoredInt    `  @@`
+	String *unfactoredString `| @@`
+	Float  *unfactoredFloat  `| @@`
+}
+
+type unfactoredGrammar struct {
+	Statements []*unfactoredStatement `{ @@ }`
+}
+
+func benchmarkAlternatives(b *testing.B, grammar interface{}, options ...Option) {
+	parser, err := Build(grammar, options...)
+	require.NoError(b, err)
+	source := strings.Repeat(`let a = 1; let b = "two"; let c = 3.5; `, 100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := parser.ParseString(source, reflect.New(reflect.TypeOf(grammar).Elem()).Interface()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFactoredAlternatives(b *testing.B) {
+	benchmarkAlternatives(b, &factoredGrammar{})
+}
+
+func BenchmarkUnfactoredAlternatives(b *testing.B) {
+	benchmarkAlternatives(b, &unfactoredGrammar{}, MaxBacktrack(4))
+}
+
+func TestCaptureJSONNumber(t *testing.T) {
+	type grammar struct {
+		Numbers []json.Number `{ @(Int | Float) }`
+		Single  json.Number   `"=" @(Int | Float)`
+	}
+
+	parser := mustTestParser(t, &grammar{})
+
+	actual := &grammar{}
+	err := parser.ParseString(`123456789012345678901234567890 3.141592653589793238 = 18446744073709551616`, actual)
+	require.NoError(t, err)
+	expected := &grammar{
+		Numbers: []json.Number{"123456789012345678901234567890", "3.141592653589793238"},
+		Single:  "18446744073709551616",
+	}
+	require.Equal(t, expected, actual)
+}
+
+func TestErrorNamesEnclosingProduction(t *testing.T) {
+	type Value struct {
+		Key   string `@Ident "="`
+		Value int    `@Int`
+	}
+	type Config struct {
+		Values []*Value `"{" { @@ } "}"`
+	}
+
+	parser := mustTestParser(t, &Config{})
+
+	err := parser.ParseString(`{ a = 1 b = "x" }`, &Config{})
+	require.EqualError(t, err, `<source>:1:12: while parsing Value: expected an Int but got "x"`)
+
+	err = parser.ParseString(`{ a = 1`, &Config{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "while parsing Config: expected")
+}
+
+func TestCoverage(t *testing.T) {
+	type Value struct {
+		Int    *int    `  @Int`
+		String *string `| @String`
+	}
+	type Entry struct {
+		Key   string `@Ident`
+		Value *Value `[ "=" @@ ]`
+	}
+	type Config struct {
+		Entries []*Entry `{ @@ }`
+	}
+
+	parser := mustTestParser(t, &Config{})
+	coverage := parser.Coverage()
+
+	require.NoError(t, coverage.ParseString(``, &Config{}))
+	require.Equal(t, []string{
+		"Config: Entry* never matched",
+		"Entry: never matched",
+		`Entry: ("=" Value)? never matched`,
+		"Value: never matched",
+		"Value: alternative Int never matched",
+		"Value: alternative String never matched",
+	}, coverage.Uncovered())
+
+	require.NoError(t, coverage.ParseString(`a = 1 b`, &Config{}))
+	require.Equal(t, []string{
+		"Value: alternative String never matched",
+	}, coverage.Uncovered())
+
+	require.NoError(t, coverage.ParseString(`c = "x"`, &Config{}))
+	require.Empty(t, coverage.Uncovered())
+}
+
+type sortedUniqueInts []int
+
+func (s *sortedUniqueInts) Append(value interface{}) error {
+	n := value.(int)
+	i := sort.SearchInts(*s, n)
+	if i < len(*s) && (*s)[i] == n {
+		return fmt.Errorf("duplicate value %d", n)
+	}
+	*s = append(*s, 0)
+	copy((*s)[i+1:], (*s)[i:])
+	(*s)[i] = n
+	return nil
+}
+
+func TestCaptureAppender(t *testing.T) {
+	type grammar struct {
+		Values sortedUniqueInts `{ @Int }`
+	}
+
+	parser := mustTestParser(t, &grammar{})
+
+	actual := &grammar{}
+	err := parser.ParseString(`3 1 2`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Values: sortedUniqueInts{1, 2, 3}}, actual)
+
+	err = parser.ParseString(`3 1 3`, &grammar{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "duplicate value 3")
+}
+
+func TestNormalizeUnicode(t *testing.T) {
+	type grammar struct {
+		Keyword bool     `@"caf\u00e9"`
+		Idents  []string `{ @Ident }`
+	}
+
+	composed := "caf\u00e9"
+	decomposed := "cafe\u0301"
+
+	// The default lexer does not treat combining marks as part of identifiers.
+	def, err := lexer.Regexp(`(?P<Ident>[\pL\pM]+)|(\s+)`)
+	require.NoError(t, err)
+
+	parser, err := Build(&grammar{}, UseLexer(def), NormalizeUnicode(norm.NFC))
+	require.NoError(t, err)
+
+	actual := &grammar{}
+	err = parser.ParseString(decomposed+" "+decomposed+" "+composed, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Keyword: true, Idents: []string{composed, composed}}, actual)
+
+	// Without normalization the decomposed keyword does not match.
+	parser, err = Build(&grammar{}, UseLexer(def))
+	require.NoError(t, err)
+	err = parser.ParseString(decomposed, &grammar{})
+	require.Error(t, err)
+}
+
+func TestCaptureKeys(t *testing.T) {
+	type Settings struct {
+		FullName string `key:"full_name"`
+		Age      int
+		Admin    bool `key:"admin"`
+	}
+	type grammar struct {
+		Name     string    `parser:"\"user\" @Ident \"{\""`
+		Settings *Settings `parser:"@@ \"}\"" keys:"="`
+	}
+
+	parser := mustTestParser(t, &grammar{})
+
+	actual := &grammar{}
+	err := parser.ParseString(`user bob { full_name = "Bob Smith" Age = 42 }`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Name: "bob", Settings: &Settings{FullName: "Bob Smith", Age: 42}}, actual)
+
+	out, err := parser.Marshal(actual)
+	require.NoError(t, err)
+	require.Equal(t, `user bob { full_name = "Bob Smith" Age = 42 }`, string(out))
+
+	err = parser.ParseString(`user bob { FullName = "Bob" }`, &grammar{})
+	require.EqualError(t, err, `<source>:1:11: while parsing grammar: unknown key "FullName"`)
+
+	type jsonSettings struct {
+		FullName string `json:"name"`
+	}
+	type jsonGrammar struct {
+		Settings jsonSettings `keys:"="`
+	}
+	parser, err = Build(&jsonGrammar{}, KeyTag("json"))
+	require.NoError(t, err)
+	jsonActual := &jsonGrammar{}
+	err = parser.ParseString(`name = "Alice"`, jsonActual)
+	require.NoError(t, err)
+	require.Equal(t, &jsonGrammar{Settings: jsonSettings{FullName: "Alice"}}, jsonActual)
+}
+
+func TestValidateUTF8(t *testing.T) {
+	type grammar struct {
+		Values []string `{ @(Ident | String) }`
+	}
+
+	parser, err := Build(&grammar{}, ValidateUTF8())
+	require.NoError(t, err)
+
+	actual := &grammar{}
+	err = parser.ParseString(`a "héllo" b`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Values: []string{"a", "héllo", "b"}}, actual)
+
+	err = parser.ParseString("a\n\"h\xe9llo\"", &grammar{})
+	require.EqualError(t, err, "<source>:2:3: invalid UTF-8 byte 0xe9")
+}
+
+func TestDisableProductions(t *testing.T) {
+	type Lambda struct {
+		Params []string `"fn" "(" { @Ident } ")"`
+	}
+	type Value struct {
+		Lambda *Lambda `  @@`
+		Ident  string  `| @Ident`
+	}
+	type Assignment struct {
+		Name  string `@Ident "="`
+		Value *Value `@@`
+	}
+	type Script struct {
+		Assignments []*Assignment `{ @@ }`
+	}
+
+	parser := mustTestParser(t, &Script{})
+
+	actual := &Script{}
+	err := parser.ParseString(`a = fn(x y)`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &Script{Assignments: []*Assignment{{Name: "a", Value: &Value{Lambda: &Lambda{Params: []string{"x", "y"}}}}}}, actual)
+
+	// With Lambda disabled, "fn" falls through to the Ident alternative.
+	err = parser.ParseString(`a = fn(x y)`, &Script{}, DisableProductions("Lambda"))
+	require.EqualError(t, err, `<source>:1:7: unexpected token "("`)
+
+	actual = &Script{}
+	err = parser.ParseString(`a = fn`, actual, DisableProductions("Lambda"))
+	require.NoError(t, err)
+	require.Equal(t, &Script{Assignments: []*Assignment{{Name: "a", Value: &Value{Ident: "fn"}}}}, actual)
+
+	// Disabling a required production is a syntax error where it would have been parsed.
+	err = parser.ParseString(`a = b`, &Script{}, DisableProductions("Value"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `while parsing Assignment: expected`)
+}
+
+func TestRepetitionLeadingWithOptional(t *testing.T) {
+	type grammar struct {
+		Items []string `{ [ @"a" ] @"b" } "end"`
+	}
+
+	parser := mustTestParser(t, &grammar{})
+	require.Equal(t, []string{`grammar: repetition ("a"? "b")* leads with an optional element`}, parser.Warnings())
+
+	actual := &grammar{}
+	err := parser.ParseString(`a b b a b end`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Items: []string{"a", "b", "b", "a", "b"}}, actual)
+
+	// An optional that matched without its required successor is still an error.
+	err = parser.ParseString(`a end`, &grammar{})
+	require.Error(t, err)
+
+	// The canonical form, which leads with a required element, has no warnings.
+	type canonical struct {
+		Items []string `{ @"a" [ @"b" ] | @"b" } "end"`
+	}
+	parser = mustTestParser(t, &canonical{})
+	require.Empty(t, parser.Warnings())
+}
+
+type leftRecursiveExpr struct {
+	Left  *leftRecursiveSum `@@`
+	Right string            `| @Ident`
+}
+
+type leftRecursiveSum struct {
+	Sign string             `[ @"-" ]`
+	Expr *leftRecursiveExpr `@@ "+"`
+	Int  int                `@Int`
+}
+
+type leftRecursiveList struct {
+	Items []*leftRecursiveList `"(" { @@ } ")"`
+}
+
+func TestValidateLeftRecursion(t *testing.T) {
+	type direct struct {
+		Expr *direct `[ @@ ] "+"`
+		Int  int     `@Int`
+	}
+	parser := mustTestParser(t, &direct{})
+	require.EqualError(t, parser.Validate(), `left recursion: direct -> direct`)
+
+	parser = mustTestParser(t, &leftRecursiveExpr{})
+	require.EqualError(t, parser.Validate(), `left recursion: leftRecursiveExpr -> leftRecursiveSum -> leftRecursiveExpr`)
+
+	// Recursion after consuming input is fine.
+	parser = mustTestParser(t, &leftRecursiveList{})
+	require.NoError(t, parser.Validate())
+}
+
+func TestRepetitionZeroWidthBody(t *testing.T) {
+	type grammar struct {
+		Items []string `{ [ @"a" ] } "end"`
+	}
+
+	parser := mustTestParser(t, &grammar{})
+	actual := &grammar{}
+	err := parser.ParseString(`a a end`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Items: []string{"a", "a"}}, actual)
+}
+
+func TestCaptureRegexp(t *testing.T) {
+	type Route struct {
+		Method  string         `@Ident`
+		Pattern *regexp.Regexp `@(String | RawString)`
+	}
+	type grammar struct {
+		Routes []*Route `{ @@ }`
+	}
+
+	parser := mustTestParser(t, &grammar{})
+
+	actual := &grammar{}
+	err := parser.ParseString("GET \"^/users/\\\\d+$\" POST `^/posts/\\w+$`", actual)
+	require.NoError(t, err)
+	require.Len(t, actual.Routes, 2)
+	require.Equal(t, `^/users/\d+$`, actual.Routes[0].Pattern.String())
+	require.Equal(t, `^/posts/\w+$`, actual.Routes[1].Pattern.String())
+	require.True(t, actual.Routes[1].Pattern.MatchString("/posts/hello"))
+
+	err = parser.ParseString("GET `[a-`", &grammar{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "1:4: invalid regular expression \"[a-\": error parsing regexp")
+}
+
+func TestProductionDoc(t *testing.T) {
+	type Value struct {
+		_      struct{} `doc:"A literal value."`
+		Number int      `@Int`
+	}
+	type Assignment struct {
+		Name  string `parser:"@Ident \"=\"" doc:"Assigns a value to a name."`
+		Value *Value `@@`
+	}
+
+	parser := mustTestParser(t, &Assignment{})
+	require.Equal(t, `# Assigns a value to a name.
+Assignment <- Ident "=" Value
+# A literal value.
+Value <- Int
+`, parser.PEG())
+	require.Contains(t, parser.String(), `doc="A literal value."`)
+
+	actual := &Assignment{}
+	err := parser.ParseString(`a = 1`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &Assignment{Name: "a", Value: &Value{Number: 1}}, actual)
+}
+
+func TestMaxBacktrack(t *testing.T) {
+	type Call struct {
+		Name string   `@Ident "("`
+		Args []string `{ @Ident } ")"`
+	}
+	type Assign struct {
+		Name  string `@Ident "="`
+		Value string `@Ident`
+	}
+	type Stmt struct {
+		Call   *Call   `  @@`
+		Assign *Assign `| @@`
+	}
+	type grammar struct {
+		Stmts []*Stmt `{ @@ }`
+	}
+
+	// Without backtracking, Call commits to "a" and fails.
+	parser := mustTestParser(t, &grammar{})
+	err := parser.ParseString(`a = b`, &grammar{})
+	require.Error(t, err)
+
+	parser, err = Build(&grammar{}, MaxBacktrack(1))
+	require.NoError(t, err)
+
+	actual := &grammar{}
+	err = parser.ParseString(`f(x y) a = b`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Stmts: []*Stmt{
+		{Call: &Call{Name: "f", Args: []string{"x", "y"}}},
+		{Assign: &Assign{Name: "a", Value: "b"}},
+	}}, actual)
+
+	// Failing beyond the backtracking distance is a hard error.
+	err = parser.ParseString(`f(x y`, &grammar{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "while parsing Call: expected")
+
+	// When every alternative fails, the error from the furthest position is reported.
+	err = parser.ParseString(`a + b`, &grammar{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `while parsing Assign: expected "=" but got "+"`)
+}
+
+type backtrackCall struct {
+	Name string   `@Ident "("`
+	Args []string `{ @Ident } ")"`
+}
+
+type backtrackAssign struct {
+	Name  string `@Ident "="`
+	Value string `@Ident`
+}
+
+type backtrackStmt struct {
+	Call   *backtrackCall   `  @@`
+	Assign *backtrackAssign `| @@`
+}
+
+type backtrackGrammar struct {
+	Stmts []*backtrackStmt `{ @@ ";" }`
+}
+
+func TestReturnErrors(t *testing.T) {
+	panicking, err := Build(&backtrackGrammar{}, MaxBacktrack(1))
+	require.NoError(t, err)
+	returning, err := Build(&backtrackGrammar{}, MaxBacktrack(1), ReturnErrors())
+	require.NoError(t, err)
+
+	for _, source := range []string{`f(x y); a = b;`, `f(x y`, `a + b;`, `a = b`, `a = ;`, `f();;`} {
+		expected := &backtrackGrammar{}
+		expectedErr := panicking.ParseString(source, expected)
+		actual := &backtrackGrammar{}
+		err := returning.ParseString(source, actual)
+		require.Equal(t, expectedErr, err, source)
+		require.Equal(t, expected, actual, source)
+	}
+}
+
+func benchmarkBacktracking(b *testing.B, options ...Option) {
+	parser, err := Build(&backtrackGrammar{}, append(options, MaxBacktrack(1))...)
+	require.NoError(b, err)
+	source := strings.Repeat(`a = b; f(x y); c = d; `, 100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		actual := &backtrackGrammar{}
+		if err := parser.ParseString(source, actual); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBacktrackingPanics(b *testing.B) {
+	benchmarkBacktracking(b)
+}
+
+func BenchmarkBacktrackingReturnErrors(b *testing.B) {
+	benchmarkBacktracking(b, ReturnErrors())
+}
+
+// Each alternative parses the same leading group, so that without memoization a group nested n
+// deep is parsed 3^n times.
+type packratNode struct {
+	A *packratGroup `parser:"  @@ \"a\""`
+	B *packratGroup `parser:"| @@ \"b\""`
+	C *packratGroup `parser:"| @@ \"c\""`
+}
+
+type packratGroup struct {
+	Name  string       `parser:"  @Ident"`
+	Inner *packratNode `parser:"| \"(\" @@ \")\""`
+}
+
+func packratSource(depth int) string {
+	source := "x c"
+	for i := 0; i < depth; i++ {
+		source = "( " + source + " ) c"
+	}
+	return source
+}
+
+func TestMemoize(t *testing.T) {
+	plain, err := Build(&packratNode{}, MaxBacktrack(100))
+	require.NoError(t, err)
+	memoized, err := Build(&packratNode{}, MaxBacktrack(100), Memoize())
+	require.NoError(t, err)
+
+	for _, source := range []string{packratSource(0), packratSource(3), `( x b ) a`, `( x d ) c`, `( x c`} {
+		expected := &packratNode{}
+		expectedErr := plain.ParseString(source, expected)
+		actual := &packratNode{}
+		err := memoized.ParseString(source, actual)
+		require.Equal(t, expectedErr, err, source)
+		require.Equal(t, expected, actual, source)
+	}
+
+	actual := &packratNode{}
+	err = memoized.ParseString(`( x b ) a`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &packratNode{A: &packratGroup{Inner: &packratNode{B: &packratGroup{Name: "x"}}}}, actual)
+}
+
+func TestMemoizeBalanced(t *testing.T) {
+	type words struct {
+		Words []string `parser:"{ @Ident }"`
+	}
+	type grammar struct {
+		Head *words `parser:"@@"`
+		Body *words `balanced:"{ }"`
+	}
+
+	for _, options := range [][]Option{nil, {Memoize()}} {
+		parser, err := Build(&grammar{}, options...)
+		require.NoError(t, err)
+		actual := &grammar{}
+		err = parser.ParseString(`a b { c }`, actual)
+		require.NoError(t, err)
+		require.Equal(t, &grammar{Head: &words{Words: []string{"a", "b"}}, Body: &words{Words: []string{"c"}}}, actual)
+	}
+}
+
+func benchmarkMemoize(b *testing.B, options ...Option) {
+	parser, err := Build(&packratNode{}, append(options, MaxBacktrack(100))...)
+	require.NoError(b, err)
+	source := packratSource(8)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		actual := &packratNode{}
+		if err := parser.ParseString(source, actual); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBacktrackingNested(b *testing.B) {
+	benchmarkMemoize(b)
+}
+
+func BenchmarkBacktrackingNestedMemoized(b *testing.B) {
+	benchmarkMemoize(b, Memoize())
+}
+
+// Streams captured values, retaining only the most recent.
+type lastValueSink []string
+
+func (l *lastValueSink) Append(value interface{}) error {
+	*l = lastValueSink{value.(string)}
+	return nil
+}
+
+func TestCaptureCount(t *testing.T) {
+	type grammar struct {
+		Count  int
+		Values lastValueSink `parser:"{ @Ident }" count:"Count"`
+	}
+
+	parser := mustTestParser(t, &grammar{})
+
+	actual := &grammar{}
+	err := parser.ParseString(`a b c d`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Count: 4, Values: lastValueSink{"d"}}, actual)
+
+	type badCount struct {
+		Count  string
+		Values []string `parser:"{ @Ident }" count:"Count"`
+	}
+	_, err = Build(&badCount{})
+	require.Error(t, err)
+}
+
+type positionedArg struct {
+	Name string `parser:"@Ident"`
+}
+
+func TestCapturePositions(t *testing.T) {
+	type grammar struct {
+		Name    string `parser:"@Ident \"=\"" positions:"NamePos"`
+		NamePos lexer.Position
+		Path    []string `parser:"@Ident { \".\" @Ident }" positions:"PathPos"`
+		PathPos []lexer.Position
+		Args    []*positionedArg `parser:"\"(\" { @@ } \")\"" positions:"ArgPos"`
+		ArgPos  []lexer.Position
+	}
+	lex := lexer.Must(lexer.Regexp(`(?P<Ident>[a-z]+)|(?P<Punct>[=.()])|(\s+)`))
+	parser, err := Build(&grammar{}, UseLexer(lex))
+	require.NoError(t, err)
+
+	actual := &grammar{}
+	err = parser.ParseString("x = a.b(\n  c\n  d)", actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{
+		Name:    "x",
+		NamePos: lexer.Position{Offset: 0, Line: 1, Column: 1},
+		Path:    []string{"a", "b"},
+		PathPos: []lexer.Position{
+			{Offset: 4, Line: 1, Column: 5},
+			{Offset: 6, Line: 1, Column: 7},
+		},
+		Args: []*positionedArg{{"c"}, {"d"}},
+		ArgPos: []lexer.Position{
+			{Offset: 11, Line: 2, Column: 3},
+			{Offset: 15, Line: 3, Column: 3},
+		},
+	}, actual)
+
+	type badPositions struct {
+		Pos  string
+		Name string `parser:"@Ident" positions:"Pos"`
+	}
+	_, err = Build(&badPositions{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `Name: positions field "Pos" must be a lexer.Position or []lexer.Position`)
+}
+
+func TestCaptureRune(t *testing.T) {
+	type grammar struct {
+		Char     rune   `parser:"@Char" rune:""`
+		Digit    *rune  `parser:"[ @Int ]" rune:""`
+		Operator rune   `parser:"@(\"+\" | \"-\")" rune:""`
+		Rest     []rune `parser:"{ @Char }" rune:""`
+	}
+
+	parser := mustTestParser(t, &grammar{})
+
+	actual := &grammar{}
+	err := parser.ParseString(`'a' 7 - 'é' '\n'`, actual)
+	require.NoError(t, err)
+	digit := '7'
+	require.Equal(t, &grammar{Char: 'a', Digit: &digit, Operator: '-', Rest: []rune{'é', '\n'}}, actual)
+
+	_, err = Build(&struct {
+		Char string `parser:"@Char" rune:""`
+	}{})
+	require.Error(t, err)
+}
+
+func TestGrammarComments(t *testing.T) {
+	type grammar struct {
+		Key   string `parser:"@Ident # the key\n \"=\" /* then */"`
+		Value string `parser:"( @Ident  # either an identifier\n | @\"#\" # or a hash\n )"`
+	}
+
+	parser := mustTestParser(t, &grammar{})
+
+	actual := &grammar{}
+	err := parser.ParseString(`a = #`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Key: "a", Value: "#"}, actual)
+}
+
+func TestCaptureBytes(t *testing.T) {
+	type blob []byte
+	type grammar struct {
+		Data    []byte `parser:"@String" bytes:""`
+		Hex     blob   `parser:"@Int" bytes:""`
+		Words   []byte `parser:"{ @Ident }" bytes:""`
+		Numbers []byte `parser:"{ @Int }"`
+	}
+
+	parser := mustTestParser(t, &grammar{})
+
+	actual := &grammar{}
+	err := parser.ParseString(`"hello\x00" 0xff a b c 1 2`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Data: []byte("hello\x00"), Hex: blob("0xff"), Words: []byte("abc"), Numbers: []byte{1, 2}}, actual)
+
+	type badBytes struct {
+		Data string `parser:"@String" bytes:""`
+	}
+	_, err = Build(&badBytes{})
+	require.EqualError(t, err, `badBytes: Data: raw bytes can only be captured into a []byte field`)
+}
+
+type binaryExpr struct {
+	Left  *binaryExpr
+	Op    string `binary:"+ - ; * / ; ^ :right"`
+	Right *binaryExpr
+	Value *int        `parser:"  @Int"`
+	Sub   *binaryExpr `parser:"| \"(\" @@ \")\""`
+}
+
+func TestBinaryOperators(t *testing.T) {
+	num := func(n int) *binaryExpr { return &binaryExpr{Value: &n} }
+	op := func(left *binaryExpr, op string, right *binaryExpr) *binaryExpr {
+		return &binaryExpr{Left: left, Op: op, Right: right}
+	}
+	parser := mustTestParser(t, &binaryExpr{})
+
+	tests := []struct {
+		input    string
+		expected *binaryExpr
+	}{
+		{"1", num(1)},
+		{"1 + 2 * 3 - 4", op(op(num(1), "+", op(num(2), "*", num(3))), "-", num(4))},
+		{"2 ^ 3 ^ 2", op(num(2), "^", op(num(3), "^", num(2)))},
+		{"( 1 + 2 ) * 3", op(&binaryExpr{Sub: op(num(1), "+", num(2))}, "*", num(3))},
+	}
+	for _, test := range tests {
+		actual := &binaryExpr{}
+		err := parser.ParseString(test.input, actual)
+		require.NoError(t, err, test.input)
+		require.Equal(t, test.expected, actual, test.input)
+
+		out, err := parser.Marshal(actual)
+		require.NoError(t, err, test.input)
+		require.Equal(t, test.input, string(out))
+	}
+
+	err := parser.ParseString("1 + * 2", &binaryExpr{})
+	require.Error(t, err)
+	require.Contains(t, parser.EBNF(), `{ ( "+" | "-" | "*" | "/" | "^" )`)
+
+	type missingRight struct {
+		Left  *missingRight
+		Op    string `binary:"+"`
+		Value int    `parser:"@Int"`
+	}
+	_, err = Build(&missingRight{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "binary operators require a Right field of type *missingRight")
+}
+
+func TestRepeatedCaptureIntoScalar(t *testing.T) {
+	type item struct {
+		Name string `parser:"@Ident"`
+	}
+	type single struct {
+		Item *item `parser:"{ @@ }"`
+	}
+	_, err := Build(&single{})
+	require.EqualError(t, err, `single: Item: productions captured repeatedly into a single *participle.item would each replace the last, use a slice`)
+
+	type unordered struct {
+		Item *item `parser:"~( { @@ } \";\" )"`
+	}
+	_, err = Build(&unordered{})
+	require.Error(t, err)
+
+	// Tokens captured repeatedly into a string are concatenated.
+	type tokens struct {
+		Items []*item `parser:"{ @@ }"`
+		Path  string  `parser:"\"/\" @Ident { @\".\" @Ident }"`
+	}
+	parser := mustTestParser(t, &tokens{})
+	actual := &tokens{}
+	err = parser.ParseString(`a b / c.d`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &tokens{Items: []*item{{"a"}, {"b"}}, Path: "c.d"}, actual)
+}
+
+func TestCaptureCharEscapes(t *testing.T) {
+	type grammar struct {
+		Chars []string `{ @Char }`
+	}
+
+	parser := mustTestParser(t, &grammar{})
+
+	actual := &grammar{}
+	err := parser.ParseString(`'a' '\n' '\'' 'é'`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Chars: []string{"a", "\n", "'", "é"}}, actual)
+}
+
+func TestRepetitionIntoTypedBuckets(t *testing.T) {
+	type Import struct {
+		Path string `"import" @String`
+	}
+	type Func struct {
+		Name string `"func" @Ident "(" ")"`
+	}
+	type Var struct {
+		Name string `"var" @Ident`
+	}
+	type File struct {
+		Imports []*Import `{ @@`
+		Funcs   []*Func   `  | @@`
+		Vars    []Var     `  | @@ }`
+	}
+
+	parser := mustTestParser(t, &File{})
+
+	actual := &File{}
+	err := parser.ParseString(`import "fmt" func a() var x import "os" func b()`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &File{
+		Imports: []*Import{{Path: "fmt"}, {Path: "os"}},
+		Funcs:   []*Func{{Name: "a"}, {Name: "b"}},
+		Vars:    []Var{{Name: "x"}},
+	}, actual)
+}
+
+func TestEndPosInjection(t *testing.T) {
+	type subgrammar struct {
+		Pos    lexer.Position
+		EndPos lexer.Position
+		B      string `@{ "," }`
+	}
+	type grammar struct {
+		Pos    lexer.Position
+		EndPos lexer.Position
+		A      string      `@{ "." }`
+		B      *subgrammar `@@ "!"`
+	}
+
+	parser := mustTestParser(t, &grammar{})
+	actual := &grammar{}
+	err := parser.ParseString("..,,,!", actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{
+		Pos:    lexer.Position{Line: 1, Column: 1},
+		EndPos: lexer.Position{Offset: 6, Line: 1, Column: 7},
+		A:      "..",
+		B: &subgrammar{
+			Pos:    lexer.Position{Offset: 2, Line: 1, Column: 3},
+			EndPos: lexer.Position{Offset: 5, Line: 1, Column: 6},
+			B:      ",,,",
+		},
+	}, actual)
+
+	// EndPos is not a candidate for the start position.
+	parser, err = Build(&grammar{}, InjectAllPositions())
+	require.NoError(t, err)
+	actual = &grammar{}
+	err = parser.ParseString("..,,,!", actual)
+	require.NoError(t, err)
+	require.Equal(t, lexer.Position{Offset: 6, Line: 1, Column: 7}, actual.EndPos)
+}
+
+func TestPositionFieldPrecedence(t *testing.T) {
+	type grammar struct {
+		Start lexer.Position
+		Pos   lexer.Position
+		Other lexer.Position
+		A     string `"x" @Ident`
+	}
+
+	pos := lexer.Position{Line: 1, Column: 1}
+
+	// "Pos" takes precedence over other Position fields.
+	parser := mustTestParser(t, &grammar{})
+	actual := &grammar{}
+	err := parser.ParseString(`x a`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Pos: pos, A: "a"}, actual)
+
+	// Otherwise the first Position field is used.
+	type unnamed struct {
+		Start lexer.Position
+		Other lexer.Position
+		A     string `"x" @Ident`
+	}
+	parser = mustTestParser(t, &unnamed{})
+	actualUnnamed := &unnamed{}
+	err = parser.ParseString(`x a`, actualUnnamed)
+	require.NoError(t, err)
+	require.Equal(t, &unnamed{Start: pos, A: "a"}, actualUnnamed)
+
+	parser, err = Build(&grammar{}, InjectAllPositions())
+	require.NoError(t, err)
+	actual = &grammar{}
+	err = parser.ParseString(`x a`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Start: pos, Pos: pos, Other: pos, A: "a"}, actual)
+}
+
+func TestExpectedSummary(t *testing.T) {
+	type Operand struct {
+		Number *float64 `  @(Int | Float)`
+		Name   *string  `| @Ident`
+		Sub    *Operand `| "(" @@ ")"`
+	}
+	type Expr struct {
+		Left  *Operand `@@`
+		Op    string   `@("+" | "-" | "*")`
+		Right *Operand `@@`
+	}
+
+	parser := mustTestParser(t, &Expr{})
+
+	err := parser.ParseString(`1 / 2`, &Expr{})
+	require.EqualError(t, err, `<source>:1:2: while parsing Expr: expected one of "*", "+" or "-" but got "/"`)
+
+	err = parser.ParseString(`1 + +`, &Expr{})
+	require.EqualError(t, err, `<source>:1:4: while parsing Expr: expected one of "(", a Float, an Ident or an Int but got "+"`)
+
+	err = parser.ParseString(`+`, &Expr{})
+	require.EqualError(t, err, `<source>:1:1: expected one of "(", a Float, an Ident or an Int but got "+"`)
+}
+
+type expectedTerm struct {
+	Literal *expectedLiteral `  @@`
+	Group   *expectedGroup   `| @@`
+	Name    *string          `| @Ident`
+}
+
+type expectedLiteral struct {
+	Negative bool `[ @"-" ]`
+	Value    int  `@Int`
+}
+
+type expectedGroup struct {
+	Term *expectedTerm `"(" @@ ")"`
+}
+
+type expectedList struct {
+	Terms []*expectedTerm `@@ { "," @@ }`
+}
+
+func TestExpectedAlternativeFields(t *testing.T) {
+	parser := mustTestParser(t, &expectedList{})
+
+	// The leading tokens of every alternative are listed, including those of alternatives that
+	// begin with an optional element.
+	err := parser.ParseString(`a, +`, &expectedList{})
+	require.EqualError(t, err, `<source>:1:3: while parsing expectedList: expected one of "(", "-", an Ident or an Int but got "+"`)
+
+	err = parser.ParseString(`+`, &expectedList{})
+	require.EqualError(t, err, `<source>:1:1: expected one of "(", "-", an Ident or an Int but got "+"`)
+
+	// Once an alternative has consumed input, its own error is reported.
+	err = parser.ParseString(`(a +`, &expectedList{})
+	require.EqualError(t, err, `<source>:1:3: while parsing expectedGroup: expected ")" but got "+"`)
+
+	err = parser.ParseString(`- a`, &expectedList{})
+	require.EqualError(t, err, `<source>:1:2: while parsing expectedLiteral: expected an Int but got "a"`)
+}
+
+func TestCaptureNestedMap(t *testing.T) {
+	type grammar struct {
+		Config map[string]interface{} `nested:"."`
+	}
+
+	parser := mustTestParser(t, &grammar{})
+
+	actual := &grammar{}
+	err := parser.ParseString(`
+		server.host = "localhost"
+		server.port = 8080
+		server.tls.enabled = true
+		ratio = 0.5
+		name = example
+	`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Config: map[string]interface{}{
+		"server": map[string]interface{}{
+			"host": "localhost",
+			"port": int64(8080),
+			"tls":  map[string]interface{}{"enabled": true},
+		},
+		"ratio": 0.5,
+		"name":  "example",
+	}}, actual)
+
+	out, err := parser.Marshal(actual)
+	require.NoError(t, err)
+	require.Equal(t, `name = "example" ratio = 0.5 server.host = "localhost" server.port = 8080 server.tls.enabled = true`, string(out))
+
+	err = parser.ParseString("a.b = 1\na.b.c = 2", &grammar{})
+	require.EqualError(t, err, `<source>:1:8: while parsing grammar: can not set "a.b.c" as "a.b" is already set to 1`)
+
+	err = parser.ParseString("a.b.c = 1\na.b = 2", &grammar{})
+	require.EqualError(t, err, `<source>:1:10: while parsing grammar: can not set "a.b" as it already contains nested keys`)
+
+	type slashed struct {
+		Config map[string]interface{} `nested:"/"`
+	}
+	parser = mustTestParser(t, &slashed{})
+	err = parser.ParseString("a/b = 1\na/b/c = 2", &slashed{})
+	require.EqualError(t, err, `<source>:1:8: while parsing slashed: can not set "a/b/c" as "a/b" is already set to 1`)
+}
+
+func TestCapturePreservedSource(t *testing.T) {
+	type Doc struct {
+		Name string `parser:"\"doc\" @Ident \"{\""`
+		Body string `parser:"@{ Ident | Int | \",\" | \".\" } \"}\"" preserve:""`
+	}
+
+	parser := mustTestParser(t, &Doc{})
+
+	actual := &Doc{}
+	err := parser.ParseString(`doc greeting {
+    Hello,   world.
+      Indented 2 lines.
+}`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &Doc{Name: "greeting", Body: "Hello,   world.\n      Indented 2 lines."}, actual)
+
+	type unpreserved struct {
+		Body string `"{" @{ Ident | "," } "}"`
+	}
+	parser = mustTestParser(t, &unpreserved{})
+	actualUnpreserved := &unpreserved{}
+	err = parser.ParseString("{ a,\n  b }", actualUnpreserved)
+	require.NoError(t, err)
+	require.Equal(t, "a,b", actualUnpreserved.Body)
+}
+
+func TestBalancedSubParser(t *testing.T) {
+	type Body struct {
+		Words []string `parser:"{ @(Ident | \"{\" | \"}\") }"`
+	}
+	type Block struct {
+		Name string `parser:"\"block\" @Ident"`
+		Body *Body  `balanced:"{ }"`
+	}
+
+	parser := mustTestParser(t, &Block{})
+
+	actual := &Block{}
+	err := parser.ParseString(`block a { x { y } z }`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &Block{Name: "a", Body: &Body{Words: []string{"x", "{", "y", "}", "z"}}}, actual)
+
+	err = parser.ParseString(`block a { x { y }`, &Block{})
+	require.EqualError(t, err, `<source>:1:8: while parsing Block: unbalanced "{"`)
+
+	type Numbers struct {
+		Values []string `parser:"{ @Int }"`
+	}
+	type Outer struct {
+		Name    string   `parser:"@Ident"`
+		Numbers *Numbers `balanced:"[ ]"`
+	}
+	sub := MustBuild(&Numbers{}, UseLexer(lexer.Must(lexer.Regexp(`(?P<Int>\d+)|(\s+)`))))
+	parser = MustBuild(&Outer{}, SubParser(sub))
+
+	outer := &Outer{}
+	err = parser.ParseString(`list [ 1 2 3 ]`, outer)
+	require.NoError(t, err)
+	require.Equal(t, &Outer{Name: "list", Numbers: &Numbers{Values: []string{"1", "2", "3"}}}, outer)
+
+	err = parser.ParseString("list\n  [ 1 x ]", &Outer{})
+	require.Error(t, err)
+	require.Equal(t, 2, err.(*lexer.Error).Pos.Line)
+}
+
+func TestLabelledAlternatives(t *testing.T) {
+	type Constant struct {
+		Name  string `parser:"\"const\" @Ident \"=\""`
+		Kind  string
+		Value interface{} `parser:"( int: @Int | str: @String | ref: @Ident )" oneof:"Kind"`
+	}
+	type grammar struct {
+		Constants []*Constant `{ @@ }`
+	}
+
+	parser := mustTestParser(t, &grammar{})
+
+	actual := &grammar{}
+	err := parser.ParseString(`const a = 1 const b = "two" const c = a`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Constants: []*Constant{
+		{Name: "a", Kind: "int", Value: "1"},
+		{Name: "b", Kind: "str", Value: "two"},
+		{Name: "c", Kind: "ref", Value: "a"},
+	}}, actual)
+
+	out, err := parser.Marshal(actual)
+	require.NoError(t, err)
+	require.Equal(t, `const a = 1 const b = "two" const c = a`, string(out))
+
+	type unlabelled struct {
+		Kind  string
+		Value string `parser:"int: @Int"`
+	}
+	_, err = Build(&unlabelled{})
+	require.EqualError(t, err, `unlabelled: Value: labelled alternative "int" requires a oneof tag naming the field to record it in`)
+}
+
+func TestUnorderedGroup(t *testing.T) {
+	type Options struct {
+		Name  string   `parser:"~( (\"name\" \"=\" @Ident)"`
+		Size  int      `parser:"   (\"size\" \"=\" @Int)"`
+		Debug bool     `parser:"   [@\"debug\"]"`
+		Tags  []string `parser:"   { \"tag\" \"=\" @Ident } )"`
+	}
+
+	parser := mustTestParser(t, &Options{})
+
+	expected := &Options{Name: "a", Size: 1}
+	for _, source := range []string{`name = a size = 1`, `size = 1 name = a`} {
+		actual := &Options{}
+		err := parser.ParseString(source, actual)
+		require.NoError(t, err, source)
+		require.Equal(t, expected, actual, source)
+	}
+
+	actual := &Options{}
+	err := parser.ParseString(`tag = x debug size = 2 tag = y name = b`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &Options{Name: "b", Size: 2, Debug: true, Tags: []string{"x", "y"}}, actual)
+
+	out, err := parser.Marshal(actual)
+	require.NoError(t, err)
+	require.Equal(t, `name = b size = 2 debug tag = x tag = y`, string(out))
+
+	err = parser.ParseString(`name = a size = 1 name = b`, &Options{})
+	require.EqualError(t, err, `<source>:1:18: while parsing Options: unexpected duplicate "name"`)
+
+	err = parser.ParseString(`size = 1 debug`, &Options{})
+	require.EqualError(t, err, `<source>:1:15: while parsing Options: expected "name" but got ""`)
+}
+
+func TestCaptureAlternativeIndex(t *testing.T) {
+	type grammar struct {
+		Op   int     `parser:"@(\"add\" | \"sub\" | \"mul\")" index:""`
+		Args []uint8 `parser:"{ @(\"x\" | \"y\") }" index:""`
+	}
+
+	parser := mustTestParser(t, &grammar{})
+
+	for i, op := range []string{"add", "sub", "mul"} {
+		actual := &grammar{}
+		err := parser.ParseString(op+" y x y", actual)
+		require.NoError(t, err)
+		require.Equal(t, &grammar{Op: i, Args: []uint8{1, 0, 1}}, actual)
+
+		out, err := parser.Marshal(actual)
+		require.NoError(t, err)
+		require.Equal(t, op+" y x y", string(out))
+	}
+
+	type invalid struct {
+		Op string `parser:"@(\"a\" | \"b\")" index:""`
+	}
+	_, err := Build(&invalid{})
+	require.EqualError(t, err, "invalid: Op: an alternative index can only be captured into integer fields")
+}
+
+func TestVerify(t *testing.T) {
+	type grammar struct {
+		Name  string `parser:"@Ident \"=\""`
+		Value int    `parser:"@Int"`
+	}
+
+	parser := mustTestParser(t, &grammar{})
+
+	require.Nil(t, parser.Verify([]string{`a = 1`, `b = 2`}))
+
+	errs := parser.Verify([]string{`a = 1`, `b = c`, `= 3`})
+	require.Len(t, errs, 3)
+	require.NoError(t, errs[0])
+	require.EqualError(t, errs[1], `<source>:1:4: while parsing grammar: expected an Int but got "c"`)
+	require.Error(t, errs[2])
+
+	errs = parser.VerifySamples([]Sample{
+		{Input: `a = 1`},
+		{Input: `a = b`, Reject: true},
+		{Input: `a = 2`, Reject: true},
+	})
+	require.Len(t, errs, 3)
+	require.NoError(t, errs[0])
+	require.NoError(t, errs[1])
+	require.EqualError(t, errs[2], `sample 2: expected input to be rejected: "a = 2"`)
+
+	require.NoError(t, parser.Check(`a = 1`))
+	require.EqualError(t, parser.Check(`a = b`), `<source>:1:4: while parsing grammar: expected an Int but got "b"`)
+}
+
+func TestTimeLayout(t *testing.T) {
+	type grammar struct {
+		Local time.Time  `parser:"@String" time:"2006-01-02 15:04"`
+		Zoned *time.Time `parser:"@String" time:"2006-01-02T15:04:05Z07:00"`
+	}
+
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("time zone database unavailable: %s", err)
+	}
+
+	source := `"2017-07-14 02:40" "2017-07-14T02:40:00+01:00"`
+	zoned := time.Date(2017, 7, 14, 1, 40, 0, 0, time.UTC)
+
+	parser := mustTestParser(t, &grammar{})
+	actual := &grammar{}
+	err = parser.ParseString(source, actual)
+	require.NoError(t, err)
+	require.True(t, actual.Local.Equal(time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC)))
+	require.True(t, actual.Zoned.Equal(zoned))
+
+	parser, err = Build(&grammar{}, TimeLocation(newYork))
+	require.NoError(t, err)
+	actual = &grammar{}
+	err = parser.ParseString(source, actual)
+	require.NoError(t, err)
+	require.Equal(t, newYork, actual.Local.Location())
+	require.True(t, actual.Local.Equal(time.Date(2017, 7, 14, 6, 40, 0, 0, time.UTC)))
+	require.True(t, actual.Zoned.Equal(zoned))
+
+	out, err := parser.Marshal(actual)
+	require.NoError(t, err)
+	require.Equal(t, source, string(out))
+
+	err = parser.ParseString(`"yesterday" "2017-07-14T02:40:00Z"`, &grammar{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `1:1: invalid time "yesterday"`)
+}
+
+func TestGrammarMacros(t *testing.T) {
+	type Server struct {
+		_     struct{} `macro:"setting(key, value) key \"=\" @value \";\""`
+		Host  string   `parser:"\"server\" \"{\" %setting(\"host\", String)"`
+		Port  int      `parser:"%setting(\"port\", Int)"`
+		Debug bool     `parser:"[ %setting(\"debug\", \"true\" | \"yes\") ] \"}\""`
+	}
+
+	parser := mustTestParser(t, &Server{})
+
+	actual := &Server{}
+	err := parser.ParseString(`server { host = "localhost"; port = 8080; debug = yes; }`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &Server{Host: "localhost", Port: 8080, Debug: true}, actual)
+
+	type unknown struct {
+		Host string `parser:"%setting(\"host\", String)"`
+	}
+	_, err = Build(&unknown{})
+	require.EqualError(t, err, `unknown: Host: unknown macro "setting"`)
+
+	type arguments struct {
+		_    struct{} `macro:"setting(key, value) key \"=\" @value"`
+		Host string   `parser:"%setting(\"host\")"`
+	}
+	_, err = Build(&arguments{})
+	require.EqualError(t, err, `arguments: Host: macro "setting" expects 2 arguments but got 1`)
+
+	type recursive struct {
+		_    struct{} `macro:"loop(x) %loop(x)"`
+		Host string   `parser:"%loop(@Ident)"`
+	}
+	_, err = Build(&recursive{})
+	require.EqualError(t, err, `recursive: Host: macro expansion exceeds a depth of 16, is a macro recursive?`)
+}
+
+func TestCaptureQuoted(t *testing.T) {
+	type grammar struct {
+		Values []Quoted `parser:"{ @(String | Char | RawString) }"`
+		Single *Quoted  `parser:"\"=\" @String"`
+	}
+
+	parser := mustTestParser(t, &grammar{})
+
+	source := "\"double \\\"quoted\\\"\" 'single \"quoted\"' `raw \\n` 'c' = \"last\""
+	actual := &grammar{}
+	err := parser.ParseString(source, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{
+		Values: []Quoted{
+			{Value: `double "quoted"`, Quote: '"'},
+			{Value: `single "quoted"`, Quote: '\''},
+			{Value: `raw \n`, Quote: '`'},
+			{Value: `c`, Quote: '\''},
+		},
+		Single: &Quoted{Value: "last", Quote: '"'},
+	}, actual)
+
+	out, err := parser.Marshal(actual)
+	require.NoError(t, err)
+	require.Equal(t, source, string(out))
+}
+
+func TestAtLeastOneGroup(t *testing.T) {
+	type Record struct {
+		Name  string `parser:"\"record\" \"{\" ^( [\"name\" \"=\" @String]"`
+		Age   int    `parser:"                  [\"age\" \"=\" @Int]"`
+		Email string `parser:"                  [\"email\" \"=\" @String] ) \"}\""`
+	}
+
+	parser := mustTestParser(t, &Record{})
+
+	for source, expected := range map[string]*Record{
+		`record { name = "a" }`:                           {Name: "a"},
+		`record { age = 3 }`:                              {Age: 3},
+		`record { name = "a" age = 3 email = "a@b.com" }`: {Name: "a", Age: 3, Email: "a@b.com"},
+	} {
+		actual := &Record{}
+		err := parser.ParseString(source, actual)
+		require.NoError(t, err, source)
+		require.Equal(t, expected, actual, source)
+	}
+
+	err := parser.ParseString(`record { }`, &Record{})
+	require.EqualError(t, err, `<source>:1:9: while parsing Record: expected one of "age", "email" or "name" but got "}"`)
+
+	// A repetition followed by a group is not mistaken for an at least one group.
+	type grammar struct {
+		A []string `parser:"@Ident+"`
+		B []string `parser:"( @Int )"`
+	}
+	other := mustTestParser(t, &grammar{})
+	actualGrammar := &grammar{}
+	err = other.ParseString(`x y 1`, actualGrammar)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{A: []string{"x", "y"}, B: []string{"1"}}, actualGrammar)
+
+	require.Equal(t, `Record <- "record" "{" &("name" "=" String / "age" "=" Int / "email" "=" String) ("name" "=" String)? ("age" "=" Int)? ("email" "=" String)? "}"`+"\n", parser.PEG())
+}
+
+func TestNegation(t *testing.T) {
+	type Block struct {
+		Words []string `parser:"\"{{\" @!\"}}\"+ \"}}\""`
+	}
+	type Template struct {
+		Blocks []*Block `parser:"{ @@ }"`
+	}
+
+	lex := lexer.Must(lexer.Regexp(`(?P<Delim>\{\{|\}\})|(?P<Ident>\w+)|(?P<Punct>[^\s\w])|(\s+)`))
+	parser := MustBuild(&Template{}, UseLexer(lex))
+
+	actual := &Template{}
+	err := parser.ParseString(`{{ a } b }} {{ } }}`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &Template{Blocks: []*Block{
+		{Words: []string{"a", "}", "b"}},
+		{Words: []string{"}"}},
+	}}, actual)
+
+	require.Equal(t, `strct(type=participle.Block, expr=("{{" @(field=Words, node=!"}}"+) "}}"))`, dumpNode(MustBuild(&Block{}, UseLexer(lex)).root))
+	require.Equal(t, `Block <- "{{" (!"}}" .)+ "}}"`, strings.Split(parser.PEG(), "\n")[1])
+
+	// The position is left untouched when the negated expression matches.
+	err = parser.ParseString(`{{ }}`, &Template{})
+	require.EqualError(t, err, `<source>:1:4: while parsing Block: expected any token other than "}}" but got "}}"`)
+}
+
+type factoryShape interface {
+	area() float64
+}
+
+type factoryCircle struct {
+	Radius float64 `parser:"@(Int | Float)"`
+}
+
+func (c *factoryCircle) area() float64 { return 3 * c.Radius * c.Radius }
+
+type factorySquare struct {
+	Side float64 `parser:"@(Int | Float)"`
+}
+
+func (s factorySquare) area() float64 { return s.Side * s.Side }
+
+func TestFactory(t *testing.T) {
+	type grammar struct {
+		Shapes []factoryShape `parser:"{ @@ }" factory:""`
+		Named  factoryShape   `parser:"\"named\" @@" factory:":"`
+	}
+
+	parser, err := Build(&grammar{}, Factory((*factoryShape)(nil), map[string]interface{}{
+		"circle": &factoryCircle{},
+		"square": factorySquare{},
+	}))
+	require.NoError(t, err)
+
+	actual := &grammar{}
+	err = parser.ParseString(`circle 1 square 2.5 circle 3 named square: 4`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{
+		Shapes: []factoryShape{&factoryCircle{Radius: 1}, factorySquare{Side: 2.5}, &factoryCircle{Radius: 3}},
+		Named:  factorySquare{Side: 4},
+	}, actual)
+
+	out, err := parser.Marshal(actual)
+	require.NoError(t, err)
+	require.Equal(t, `circle 1 square 2.5 circle 3 named square : 4`, string(out))
+
+	err = parser.ParseString(`hexagon 1 named square: 1`, &grammar{})
+	require.EqualError(t, err, `<source>:1:1: expected one of "circle", "named" or "square" but got "hexagon"`)
+
+	err = parser.ParseString(`named hexagon: 1`, &grammar{})
+	require.EqualError(t, err, `<source>:1:6: while parsing grammar: unknown factoryShape "hexagon"`)
+
+	_, err = Build(&grammar{}, Factory((*factoryShape)(nil), map[string]interface{}{"int": 1}))
+	require.EqualError(t, err, `factory type int for "int" does not implement participle.factoryShape`)
+}
+
+func TestLookahead(t *testing.T) {
+	type Statement struct {
+		Call   string `parser:"  @Ident &\"(\" \"(\" \")\""`
+		Assign string `parser:"| @Ident &\"=\" \"=\" Int"`
+		Label  string `parser:"| @Ident &\":\""`
+	}
+	type grammar struct {
+		Statements []*Statement `parser:"{ @@ [ \":\" ] \";\" }"`
+	}
+
+	parser, err := Build(&grammar{}, MaxBacktrack(1))
+	require.NoError(t, err)
+
+	actual := &grammar{}
+	err = parser.ParseString(`f(); a = 1; loop:;`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Statements: []*Statement{{Call: "f"}, {Assign: "a"}, {Label: "loop"}}}, actual)
+
+	type terminated struct {
+		Words []string `parser:"{ @Ident } &\";\""`
+		End   string   `parser:"@\";\""`
+	}
+	parser = mustTestParser(t, &terminated{})
+	actualTerminated := &terminated{}
+	err = parser.ParseString(`a b c;`, actualTerminated)
+	require.NoError(t, err)
+	require.Equal(t, &terminated{Words: []string{"a", "b", "c"}, End: ";"}, actualTerminated)
+
+	err = parser.ParseString(`a b c.`, &terminated{})
+	require.EqualError(t, err, `<source>:1:6: while parsing terminated: expected ";" but got "."`)
+
+	require.Equal(t, `Terminated <- Ident* &";" ";"`+"\n", strings.Replace(parser.PEG(), "terminated", "Terminated", 1))
+}
+
+func TestTypedNumber(t *testing.T) {
+	type grammar struct {
+		Numbers []TypedNumber `parser:"{ @Number }"`
+	}
+
+	lex := lexer.Must(lexer.Regexp(`(?P<Number>(0x[0-9a-fA-F]+|\d+(\.\d+)?)([iuf]\d*)?)|(\s+)`))
+	parser := MustBuild(&grammar{}, UseLexer(lex))
+
+	actual := &grammar{}
+	err := parser.ParseString(`10i8 3.5f32 5u 0xffu8 -1 7 2.5 300i16 1f64`, actual)
+	require.Error(t, err)
+
+	err = parser.ParseString(`10i8 3.5f32 5u 0xffu8 7 2.5 300i16 1f64 9i`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Numbers: []TypedNumber{
+		{Value: int8(10), Suffix: "i8"},
+		{Value: float32(3.5), Suffix: "f32"},
+		{Value: uint(5), Suffix: "u"},
+		{Value: uint8(255), Suffix: "u8"},
+		{Value: int64(7)},
+		{Value: 2.5},
+		{Value: int16(300), Suffix: "i16"},
+		{Value: float64(1), Suffix: "f64"},
+		{Value: int(9), Suffix: "i"},
+	}}, actual)
+
+	out, err := parser.Marshal(actual)
+	require.NoError(t, err)
+	require.Equal(t, `10i8 3.5f32 5u 255u8 7 2.5 300i16 1f64 9i`, string(out))
+
+	err = parser.ParseString(`1 300i8`, &grammar{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `1:3: 300i8 overflows int8`)
+}
+
+func TestRepetitionSeparator(t *testing.T) {
+	type strict struct {
+		Args []string `parser:"\"(\" { @Ident % \",\" } \")\""`
+	}
+	parser := mustTestParser(t, &strict{})
+	for input, expected := range map[string][]string{
+		`()`:      nil,
+		`(a)`:     {"a"},
+		`(a,b,c)`: {"a", "b", "c"},
+	} {
+		actual := &strict{}
+		err := parser.ParseString(input, actual)
+		require.NoError(t, err, input)
+		require.Equal(t, &strict{Args: expected}, actual, input)
+	}
+	err := parser.ParseString(`(a,b,)`, &strict{})
+	require.EqualError(t, err, `<source>:1:6: while parsing strict: expected an Ident but got ")"`)
+	require.Equal(t, `Strict <- "(" (Ident ("," Ident)*)? ")"`+"\n", strings.Replace(parser.PEG(), "strict", "Strict", 1))
+
+	type trailing struct {
+		Args []string `parser:"\"(\" { @Ident %% \",\" }+ \")\""`
+	}
+	parser = mustTestParser(t, &trailing{})
+	actual := &trailing{}
+	err = parser.ParseString(`(a,b,)`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &trailing{Args: []string{"a", "b"}}, actual)
+
+	err = parser.ParseString(`()`, &trailing{})
+	require.Error(t, err)
+
+	out, err := parser.Marshal(&trailing{Args: []string{"a", "b"}})
+	require.NoError(t, err)
+	require.Equal(t, `( a , b )`, string(out))
+}
+
+func TestCaptureFlags(t *testing.T) {
+	type command struct {
+		Name  string        `parser:"@Ident"`
+		Flags []rune        `parser:"{ @Flag }" flags:"-"`
+		Set   map[rune]bool `parser:"{ @LongFlag }" flags:"+"`
+	}
+
+	lex := lexer.Must(lexer.Regexp(`(?P<Ident>[a-z]+)|(?P<Flag>-[a-z]*)|(?P<LongFlag>\+[a-z]*)|(\s+)`))
+	parser := MustBuild(&command{}, UseLexer(lex))
+
+	actual := &command{}
+	err := parser.ParseString(`ls -abc -d +xy`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &command{
+		Name:  "ls",
+		Flags: []rune{'a', 'b', 'c', 'd'},
+		Set:   map[rune]bool{'x': true, 'y': true},
+	}, actual)
+
+	err = parser.ParseString(`ls -`, &command{})
+	require.Contains(t, err.Error(), `1:4: invalid flags "-", expected "-" followed by one or more flags`)
+}
+
+func TestZeroLengthMatches(t *testing.T) {
+	type leaked struct {
+		Name *string `parser:"  @[ Ident ] \"x\""`
+		Num  int     `parser:"| @Int"`
+	}
+	parser := mustTestParser(t, &leaked{})
+	actualLeaked := &leaked{}
+	err := parser.ParseString(`1`, actualLeaked)
+	require.NoError(t, err)
+	require.Equal(t, &leaked{Num: 1}, actualLeaked)
+
+	type flag struct {
+		Not  bool   `parser:"@[ \"!\" ]"`
+		Name string `parser:"@Ident"`
+	}
+	parser = mustTestParser(t, &flag{})
+	actualFlag := &flag{}
+	err = parser.ParseString(`a`, actualFlag)
+	require.NoError(t, err)
+	require.Equal(t, &flag{Name: "a"}, actualFlag)
+
+	type inner struct {
+		Name string `parser:"[ @Ident ]"`
+	}
+	type outer struct {
+		Inner *inner `parser:"  @@ \";\""`
+		Num   int    `parser:"| @Int"`
+	}
+	parser = mustTestParser(t, &outer{})
+	actualOuter := &outer{}
+	err = parser.ParseString(`;`, actualOuter)
+	require.NoError(t, err)
+	require.Equal(t, &outer{Inner: &inner{}}, actualOuter)
+
+	actualOuter = &outer{}
+	err = parser.ParseString(`1`, actualOuter)
+	require.NoError(t, err)
+	require.Equal(t, &outer{Num: 1}, actualOuter)
+
+	type required struct {
+		Opt  []string `parser:"{ [ @Ident ] \",\" }"`
+		Last string   `parser:"@Int"`
+	}
+	parser = mustTestParser(t, &required{})
+	actualRequired := &required{}
+	err = parser.ParseString(`a, , b, 1`, actualRequired)
+	require.NoError(t, err)
+	require.Equal(t, &required{Opt: []string{"a", "b"}, Last: "1"}, actualRequired)
+
+	err = parser.ParseString(`a b`, &required{})
+	require.EqualError(t, err, `<source>:1:2: while parsing required: expected "," but got "b"`)
+}
+
+// A record with many fields, each captured by its own sequence.
+type wideRecord struct {
+	Name  string   `parser:"\"record\" @Ident \"{\""`
+	A     string   `parser:"[ \"a\" \"=\" @String \";\" ]"`
+	B     int      `parser:"[ \"b\" \"=\" @Int \";\" ]"`
+	C     string   `parser:"[ \"c\" \"=\" @String \";\" ]"`
+	D     int      `parser:"[ \"d\" \"=\" @Int \";\" ]"`
+	E     string   `parser:"[ \"e\" \"=\" @String \";\" ]"`
+	F     int      `parser:"[ \"f\" \"=\" @Int \";\" ]"`
+	G     string   `parser:"[ \"g\" \"=\" @String \";\" ]"`
+	H     int      `parser:"[ \"h\" \"=\" @Int \";\" ]"`
+	Tags  []string `parser:"{ \"tag\" @Ident \";\" } \"}\""`
+	Notes [8]string
+}
+
+type wideGrammar struct {
+	Records []*wideRecord `parser:"{ @@ }"`
+}
+
+func BenchmarkWideSequences(b *testing.B) {
+	parser := MustBuild(&wideGrammar{})
+	source := strings.Repeat(`record r { a = "x"; b = 1; d = 2; g = "y"; tag t; tag u; } `, 100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := parser.ParseString(source, &wideGrammar{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestRepetitionBounds(t *testing.T) {
+	type grammar struct {
+		Octets []int `parser:"{ @Int }2,4 \";\""`
+	}
+	parser := mustTestParser(t, &grammar{})
+	for input, expected := range map[string][]int{
+		`1 2;`:     {1, 2},
+		`1 2 3;`:   {1, 2, 3},
+		`1 2 3 4;`: {1, 2, 3, 4},
+	} {
+		actual := &grammar{}
+		err := parser.ParseString(input, actual)
+		require.NoError(t, err, input)
+		require.Equal(t, &grammar{Octets: expected}, actual, input)
+	}
+	err := parser.ParseString(`1;`, &grammar{})
+	require.EqualError(t, err, `<source>:1:2: while parsing grammar: expected an Int but got ";"`)
+	err = parser.ParseString(`1 2 3 4 5;`, &grammar{})
+	require.EqualError(t, err, `<source>:1:8: while parsing grammar: expected ";" but got "5"`)
+	require.Equal(t, `Grammar <- Int Int Int? Int? ";"`+"\n", strings.Replace(parser.PEG(), "grammar", "Grammar", 1))
+
+	type exact struct {
+		Pair []string `parser:"{ @Ident % \",\" }2"`
+	}
+	parser = mustTestParser(t, &exact{})
+	actual := &exact{}
+	err = parser.ParseString(`a, b`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &exact{Pair: []string{"a", "b"}}, actual)
+	err = parser.ParseString(`a`, &exact{})
+	require.EqualError(t, err, `<source>:1:2: while parsing exact: expected "," but got ""`)
+	require.Equal(t, `Exact <- Ident ("," Ident)`+"\n", strings.Replace(parser.PEG(), "exact", "Exact", 1))
+
+	type invalid struct {
+		Values []int `parser:"{ @Int }3,2"`
+	}
+	_, err = Build(&invalid{})
+	require.Error(t, err)
+}
+
+func TestUseLexer(t *testing.T) {
+	type grammar struct {
+		Numbers []int `parser:"{ @Int }"`
+	}
+	def := lexer.Must(lexer.Regexp(`(?P<Int>\d+)|(,)`))
+
+	// Options modifying the grammar apply regardless of their order relative to UseLexer.
+	parser, err := Build(&grammar{}, NormalizeUnicode(norm.NFC), UseLexer(def))
+	require.NoError(t, err)
+	actual := &grammar{}
+	err = parser.ParseString(`1,2,3`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Numbers: []int{1, 2, 3}}, actual)
+
+	_, err = Build(&grammar{}, nil)
+	require.Error(t, err)
+	_, err = Build(&grammar{}, UseLexer(nil))
+	require.Error(t, err)
+}
+
+func TestRepetitionLimit(t *testing.T) {
+	type entry struct {
+		Key   string `parser:"@Ident \"=\""`
+		Value int    `parser:"@Int"`
+	}
+	type config struct {
+		Entries []*entry `parser:"{ @@ }<3>"`
+	}
+	parser := mustTestParser(t, &config{})
+	actual := &config{}
+	err := parser.ParseString(`a = 1 b = 2 c = 3`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &config{Entries: []*entry{{"a", 1}, {"b", 2}, {"c", 3}}}, actual)
+
+	err = parser.ParseString(`a = 1 b = 2 c = 3 d = 4`, &config{})
+	require.EqualError(t, err, `<source>:1:18: while parsing config: exceeded the limit of 3 repetitions`)
+
+	_, err = Build(&struct {
+		Values []int `parser:"{ @Int }<0>"`
+	}{})
+	require.Error(t, err)
+
+	// Grammar errors name the type of the offending token.
+	_, err = Build(&struct {
+		Values []int `parser:"{ @Int }<x>"`
+	}{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `expected a positive repetition limit but got Ident "x"`)
+}
+
+// Parses `<key> = <value>` pairs only, backtracking over the key otherwise.
+type parseableAssignment struct {
+	Key   string
+	Value string
+}
+
+func (p *parseableAssignment) Parse(lex lexer.Lexer) error {
+	checkpointer := lex.(lexer.Checkpointer)
+	start := checkpointer.Checkpoint()
+	key := lex.Next()
+	if key.Type != scanner.Ident || lex.Next().Value != "=" {
+		checkpointer.Restore(start)
+		return NextMatch
+	}
+	p.Key, p.Value = key.Value, lex.Next().Value
+	return nil
+}
+
+// Consumes a token before returning NextMatch, relying on the parser to restore it.
+type parseableGreedy struct{}
+
+func (p *parseableGreedy) Parse(lex lexer.Lexer) error {
+	lex.Next()
+	return NextMatch
+}
+
+func TestCheckpointer(t *testing.T) {
+	type grammar struct {
+		Greedy      *parseableGreedy       `parser:"  @@"`
+		Assignments []*parseableAssignment `parser:"| { @@ }"`
+		Name        string                 `parser:"  @Ident"`
+	}
+	parser := mustTestParser(t, &grammar{})
+	actual := &grammar{}
+	err := parser.ParseString(`a = 1 b = 2 c`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Assignments: []*parseableAssignment{{"a", "1"}, {"b", "2"}}, Name: "c"}, actual)
+
+	// Alternatives sharing a leading token backtrack by restoring a checkpoint.
+	type call struct {
+		Name string `parser:"@Ident \"(\" \")\""`
+	}
+	type assignment struct {
+		Name  string `parser:"@Ident \"=\""`
+		Value int    `parser:"@Int"`
+	}
+	type statement struct {
+		Call       *call       `parser:"  @@"`
+		Assignment *assignment `parser:"| @@"`
+	}
+	parser, err = Build(&statement{}, MaxBacktrack(1))
+	require.NoError(t, err)
+	actualStatement := &statement{}
+	err = parser.ParseString(`a = 1`, actualStatement)
+	require.NoError(t, err)
+	require.Equal(t, &statement{Assignment: &assignment{Name: "a", Value: 1}}, actualStatement)
+}
+
+// Parses `<ident> = = <ident>` only, deciding from the tokens ahead without consuming any.
+type parseableEquality struct {
+	Left  string
+	Right string
+}
+
+func (p *parseableEquality) Parse(lex lexer.Lexer) error {
+	lookahead := lex.(lexer.Lookahead)
+	if lookahead.PeekN(1).Value != "=" || lookahead.PeekN(2).Value != "=" {
+		return NextMatch
+	}
+	p.Left = lex.Next().Value
+	lex.Next()
+	lex.Next()
+	p.Right = lex.Next().Value
+	return nil
+}
+
+func TestLookaheadN(t *testing.T) {
+	type assignment struct {
+		Left  string `parser:"@Ident \"=\""`
+		Right string `parser:"@Ident"`
+	}
+	type grammar struct {
+		Equality   *parseableEquality `parser:"  @@"`
+		Assignment *assignment        `parser:"| @@"`
+	}
+	parser := mustTestParser(t, &grammar{})
+	actual := &grammar{}
+	err := parser.ParseString(`a == b`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Equality: &parseableEquality{"a", "b"}}, actual)
+
+	actual = &grammar{}
+	err = parser.ParseString(`a = b`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Assignment: &assignment{"a", "b"}}, actual)
+}
+
+func TestErrorExpected(t *testing.T) {
+	type value struct {
+		Int    *int    `parser:"  @Int"`
+		String *string `parser:"| @String"`
+		List   []int   `parser:"| \"[\" { @Int } \"]\""`
+	}
+	type grammar struct {
+		Key   string `parser:"@Ident \"=\""`
+		Value *value `parser:"@@"`
+	}
+	parser := mustTestParser(t, &grammar{})
+	err := parser.ParseString(`a = b`, &grammar{})
+	require.EqualError(t, err, `<source>:1:4: while parsing grammar: expected one of "[", an Int or a String but got "b"`)
+	perr, ok := err.(*lexer.Error)
+	require.True(t, ok)
+	require.Equal(t, []string{`"["`, "an Int", "a String"}, perr.Expected)
+
+	err = parser.ParseString(`a b`, &grammar{})
+	require.Equal(t, []string{`"="`}, err.(*lexer.Error).Expected)
+
+	err = parser.ParseString(`=`, &grammar{})
+	require.Equal(t, []string{"an Ident"}, err.(*lexer.Error).Expected)
+}
+
+// Consumes the tokens up to the ")" closing the enclosing parentheses.
+type balancedArgs []lexer.Token
+
+func (b *balancedArgs) Parse(lex lexer.Lexer) error {
+	depth := 0
+	for token := lex.Peek(); !token.EOF(); token = lex.Peek() {
+		switch token.Value {
+		case "(":
+			depth++
+		case ")":
+			if depth == 0 {
+				return nil
+			}
+			depth--
+		}
+		*b = append(*b, lex.Next())
+	}
+	return nil
+}
+
+func TestParseableField(t *testing.T) {
+	type call struct {
+		Name string       `parser:"@Ident \"(\""`
+		Args balancedArgs `parser:"@@ \")\""`
+	}
+	type grammar struct {
+		Calls []*call `parser:"{ @@ }"`
+	}
+	parser := mustTestParser(t, &grammar{})
+	actual := &grammar{}
+	err := parser.ParseString(`f(a, (b, c)) g()`, actual)
+	require.NoError(t, err)
+	require.Len(t, actual.Calls, 2)
+	values := []string{}
+	for _, token := range actual.Calls[0].Args {
+		values = append(values, token.Value)
+	}
+	require.Equal(t, []string{"a", ",", "(", "b", ",", "c", ")"}, values)
+	require.Empty(t, actual.Calls[1].Args)
+	require.Equal(t, 3, actual.Calls[0].Args[0].Pos.Column)
+}
+
+func TestCaptureMap(t *testing.T) {
+	type setting struct {
+		Key   string `parser:"@Ident \"=\""`
+		Value string `parser:"@String"`
+	}
+	type block struct {
+		Name     string              `parser:"@Ident \"{\""`
+		Settings map[string]*setting `parser:"{ @@ } \"}\""`
+	}
+	type grammar struct {
+		Blocks []*block `parser:"{ @@ }"`
+	}
+	parser := mustTestParser(t, &grammar{})
+	actual := &grammar{}
+	err := parser.ParseString(`
+		server {
+			host = "localhost"
+			port = "80"
+			port = "8080"
+		}
+		empty {}
+	`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Blocks: []*block{
+		{Name: "server", Settings: map[string]*setting{
+			"host": {Key: "host", Value: "localhost"},
+			"port": {Key: "port", Value: "8080"},
+		}},
+		{Name: "empty", Settings: map[string]*setting{}},
+	}}, actual)
+
+	type invalid struct {
+		Settings map[string]string `parser:"{ @@ }"`
+	}
+	_, err = Build(&invalid{})
+	require.EqualError(t, err, "invalid: Settings: map values must be structs with a Key field, or the map must be tagged with key and value grammars, not string")
+}
+
+func TestCaptureMapValues(t *testing.T) {
+	type block struct {
+		Name     string         `parser:"@Ident \"{\""`
+		Settings map[string]int `parser:"{ @@ } \"}\"" key:"@Ident \"=\"" value:"@Int"`
+	}
+	type grammar struct {
+		Blocks []*block `parser:"{ @@ }"`
+	}
+	parser := mustTestParser(t, &grammar{})
+	actual := &grammar{}
+	err := parser.ParseString(`
+		server {
+			port = 80
+			port = 8080
+			workers = 4
+		}
+		empty {}
+	`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Blocks: []*block{
+		{Name: "server", Settings: map[string]int{"port": 8080, "workers": 4}},
+		{Name: "empty", Settings: map[string]int{}},
+	}}, actual)
+	require.NotNil(t, actual.Blocks[1].Settings)
+}
+
+func TestCaptureBoolLiteral(t *testing.T) {
+	type setting struct {
+		Key      string `parser:"@Ident \"=\""`
+		Value    bool   `parser:"@(\"true\" | \"false\" | \"TRUE\" | \"FALSE\")"`
+		Optional bool   `parser:"@[ \"optional\" ]"`
+		Switch   bool   `parser:"[ @(\"on\" | \"off\") ]" bool:"on,off"`
+	}
+	type grammar struct {
+		Settings []*setting `parser:"{ @@ \";\" }"`
+	}
+	parser := mustTestParser(t, &grammar{})
+	actual := &grammar{}
+	err := parser.ParseString(`a = true; b = false optional; c = FALSE off; d = TRUE on;`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Settings: []*setting{
+		{Key: "a", Value: true},
+		{Key: "b", Value: false, Optional: true},
+		{Key: "c", Value: false, Switch: false},
+		{Key: "d", Value: true, Switch: true},
+	}}, actual)
+
+	type badLiterals struct {
+		Switch bool `parser:"@(\"on\" | \"off\")" bool:"on"`
+	}
+	_, err = Build(&badLiterals{})
+	require.EqualError(t, err, "badLiterals: Switch: bool tag must be of the form `bool:\"<true>,<false>\"` but got \"on\"")
+}
+
+type yesBool bool
+
+func (y *yesBool) Capture(values []string) error {
+	*y = values[0] == "yes"
+	return nil
+}
+
+func TestCaptureBoolCapture(t *testing.T) {
+	type value struct {
+		Value yesBool `parser:"@Ident"`
+	}
+	type grammar struct {
+		Values []*value `parser:"{ @@ }"`
+	}
+	parser := mustTestParser(t, &grammar{})
+	actual := &grammar{}
+	err := parser.ParseString(`yes true no`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Values: []*value{{Value: true}, {Value: false}, {Value: false}}}, actual)
+}
+
+func TestCaptureDuration(t *testing.T) {
+	type grammar struct {
+		Timeout  time.Duration  `parser:"\"timeout\" @(Int Ident)"`
+		Interval *time.Duration `parser:"[ \"interval\" @(Int Ident) ]"`
+	}
+	parser := mustTestParser(t, &grammar{})
+	actual := &grammar{}
+	err := parser.ParseString(`timeout 1h30m interval 250ms`, actual)
+	require.NoError(t, err)
+	interval := 250 * time.Millisecond
+	require.Equal(t, &grammar{Timeout: 90 * time.Minute, Interval: &interval}, actual)
+
+	err = parser.ParseString(`timeout 30x`, &grammar{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `1:8: invalid duration "30x"`)
+}
+
+func TestIntegerBases(t *testing.T) {
+	type grammar struct {
+		Signed   []int64 `parser:"\"signed\" { @Number }"`
+		Unsigned []uint8 `parser:"\"unsigned\" { @Number }"`
+	}
+	lex := lexer.Must(lexer.Regexp(`(?P<Keyword>[a-z]+)|(?P<Number>-?[0-9][0-9a-zA-Z_]*)|(\s+)`))
+	parser := MustBuild(&grammar{}, UseLexer(lex))
+
+	actual := &grammar{}
+	err := parser.ParseString(`signed 42 -0x10 0o17 0b1010 1_000 unsigned 0xFF 0b1`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Signed: []int64{42, -16, 15, 10, 1000}, Unsigned: []uint8{255, 1}}, actual)
+
+	err = parser.ParseString(`signed 0b102 unsigned`, &grammar{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `invalid int64 "0b102": invalid syntax`)
+
+	err = parser.ParseString(`signed unsigned 256`, &grammar{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `invalid uint8 "256": value out of range`)
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	type grammar struct {
+		Distinct bool     `parser:"\"select\" @[ \"distinct\" ]"`
+		Columns  []string `parser:"@Ident { \",\" @Ident }"`
+		Table    string   `parser:"\"from\" @Ident"`
+		Order    string   `parser:"[ \"order\" \"by\" Ident @( \"asc\" | \"desc\" ) ]"`
+	}
+	parser, err := Build(&grammar{}, CaseInsensitive())
+	require.NoError(t, err)
+	actual := &grammar{}
+	err = parser.ParseString(`SELECT Distinct a, b FROM t Order BY a DESC`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Distinct: true, Columns: []string{"a", "b"}, Table: "t", Order: "DESC"}, actual)
+
+	parser = mustTestParser(t, &grammar{})
+	err = parser.ParseString(`SELECT a FROM t`, &grammar{})
+	require.Error(t, err)
+}
+
+func TestCaptureLiteralAlternatives(t *testing.T) {
+	type request struct {
+		Method  string   `parser:"@(\"GET\" | \"POST\" | (\"PUT\" | \"PATCH\"))"`
+		Flags   []string `parser:"{ @(\"secure\" | \"cached\") }"`
+		Version *string  `parser:"[ @(\"http\" \"2\" | \"http1\") ]"`
+	}
+	http1, http2 := "http1", "http2"
+	parser := mustTestParser(t, &request{})
+	for input, expected := range map[string]*request{
+		`GET`:                       {Method: "GET"},
+		`PATCH cached secure http1`: {Method: "PATCH", Flags: []string{"cached", "secure"}, Version: &http1},
+		`POST http 2`:               {Method: "POST", Version: &http2},
+	} {
+		actual := &request{}
+		err := parser.ParseString(input, actual)
+		require.NoError(t, err, input)
+		require.Equal(t, expected, actual, input)
+
+		// Each value marshals as the literals it was captured from.
+		out, err := parser.Marshal(actual)
+		require.NoError(t, err, input)
+		require.Equal(t, input, string(out))
+	}
+
+	_, err := parser.Marshal(&request{Method: "DELETE"})
+	require.Error(t, err)
+}
+
+func TestElide(t *testing.T) {
+	type grammar struct {
+		Assignments []string `parser:"{ @Ident \"=\" Int \";\" }"`
+	}
+	lex := lexer.Must(lexer.Regexp(`(?P<Comment>#[^\n]*)|(?P<Ident>[a-z]+)|(?P<Int>\d+)|(?P<Punct>[=;])|(\s+)`))
+	parser, err := Build(&grammar{}, Elide("Comment"), UseLexer(lex))
+	require.NoError(t, err)
+	actual := &grammar{}
+	err = parser.ParseString("# header\na = # inline\n1; b = 2;\n# trailing\n# comments", actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Assignments: []string{"a", "b"}}, actual)
+
+	_, err = Build(&grammar{}, Elide("Whitespace"), UseLexer(lex))
+	require.EqualError(t, err, `can not elide unknown token type "Whitespace"`)
+}
+
+func TestTokens(t *testing.T) {
+	type grammar struct {
+		Key   string `parser:"@Ident \"=\""`
+		Value string `parser:"@Ident"`
+	}
+	lex := lexer.Must(lexer.Regexp(`(?P<Comment>#[^\n]*)|(?P<Ident>[a-z]+)|(?P<Punct>=)|(\s+)`))
+	parser, err := Build(&grammar{}, UseLexer(lex), Elide("Comment"))
+	require.NoError(t, err)
+
+	tokens, err := parser.Tokens(strings.NewReader("a = # comment\nb"))
+	require.NoError(t, err)
+	values := []string{}
+	for _, token := range tokens {
+		values = append(values, token.Value)
+	}
+	require.Equal(t, []string{"a", "=", "b", "<<EOF>>"}, values)
+	require.True(t, tokens[len(tokens)-1].EOF())
+
+	_, err = parser.Tokens(strings.NewReader("a = 1"))
+	require.EqualError(t, err, `<source>:1:5: invalid token '1'`)
+}
+
+func TestEOL(t *testing.T) {
+	type line struct {
+		Words []string `parser:"@Ident+ EOL"`
+	}
+	type grammar struct {
+		Lines []*line `parser:"{ EOL | @@ }"`
+	}
+	parser, err := Build(&grammar{}, UseLexer(lexer.TextScannerLexerWithEOL))
+	require.NoError(t, err)
+
+	actual := &grammar{}
+	err = parser.ParseString("\na b\n\n\nc\n\n", actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Lines: []*line{{Words: []string{"a", "b"}}, {Words: []string{"c"}}}}, actual)
+
+	err = parser.ParseString("a b\nc", &grammar{})
+	require.Error(t, err)
+}
+
+func TestUnquote(t *testing.T) {
+	type grammar struct {
+		Values []string `parser:"{ @(String | Raw | Char) }"`
+	}
+	lex := lexer.Must(lexer.Regexp(`(?P<String>"(\\.|[^"])*")|(?P<Raw>` + "`[^`]*`" + `)|(?P<Char>'(\\.|[^'])')|(\s+)`))
+	parser, err := Build(&grammar{}, UseLexer(lex), Unquote("String", "Raw", "Char"))
+	require.NoError(t, err)
+
+	actual := &grammar{}
+	err = parser.ParseString(`"a\x41\t" '\n' `+"`raw\\t`", actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Values: []string{"aA\t", "\n", `raw\t`}}, actual)
+
+	err = parser.ParseString(`"bad \q"`, &grammar{})
+	require.EqualError(t, err, `<source>:1:1: invalid quoted string "\"bad \\q\"": invalid syntax`)
+
+	_, err = Build(&grammar{}, UseLexer(lex), Unquote("Number"))
+	require.EqualError(t, err, `can not unquote unknown token type "Number"`)
+}
+
+func TestMap(t *testing.T) {
+	type grammar struct {
+		Key   string `parser:"\"set\" @Ident \"=\""`
+		Value string `parser:"@String"`
+	}
+	lex := lexer.Must(lexer.Regexp(`(?P<Ident>[a-zA-Z]+)|(?P<String>"[^"]*")|(?P<Punct>=)|(\s+)`))
+	symbols := lex.Symbols()
+	parser, err := Build(&grammar{}, UseLexer(lex), Map(func(token lexer.Token) lexer.Token {
+		switch token.Type {
+		case symbols["Ident"]:
+			token.Value = strings.ToLower(token.Value)
+		case symbols["String"]:
+			token.Value = token.Value[1 : len(token.Value)-1]
+		}
+		return token
+	}))
+	require.NoError(t, err)
+	actual := &grammar{}
+	err = parser.ParseString(`SET Name = "Bob Smith"`, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Key: "name", Value: "Bob Smith"}, actual)
+}
+
+func TestRecover(t *testing.T) {
+	type statement struct {
+		Name  string `parser:"@Ident \"=\""`
+		Value int    `parser:"@Int \";\""`
+	}
+	type grammar struct {
+		Statements []*statement `parser:"{ @@ }"`
+	}
+	parser, err := Build(&grammar{}, Recover(";"))
+	require.NoError(t, err)
+	actual := &grammar{}
+	err = parser.ParseString(`a = 1; b = x; c = 3; d 4; e = 5;`, actual)
+	require.EqualError(t, err, "<source>:1:11: while parsing statement: expected an Int but got \"x\"\n"+
+		"<source>:1:23: while parsing statement: expected \"=\" but got \"4\"")
+	errs, ok := err.(Errors)
+	require.True(t, ok)
+	require.Len(t, errs, 2)
+	require.Equal(t, &grammar{Statements: []*statement{{"a", 1}, {"c", 3}, {"e", 5}}}, actual)
+
+	err = parser.ParseString(`a = 1; b =`, &grammar{})
+	require.EqualError(t, err, `<source>:1:11: while parsing statement: expected an Int but got ""`)
+
+	err = parser.ParseString(`a = 1; b = 2;`, &grammar{})
+	require.NoError(t, err)
+
+	parser, err = Build(&grammar{}, Recover(";"), ReturnErrors())
+	require.NoError(t, err)
+	err = parser.ParseString(`a = 1; b = x; c = 3;`, &grammar{})
+	require.EqualError(t, err, `<source>:1:11: while parsing statement: expected an Int but got "x"`)
+}
+
+type convertedColour string
+
+func TestConvert(t *testing.T) {
+	type grammar struct {
+		Colour  convertedColour   `parser:"\"colour\" @Ident"`
+		Accent  *convertedColour  `parser:"[ \"accent\" @Ident ]"`
+		Palette []convertedColour `parser:"\"palette\" { @Ident }"`
+	}
+	colours := map[string]convertedColour{"red": "#f00", "green": "#0f0", "blue": "#00f"}
+	parser, err := Build(&grammar{}, Convert(reflect.TypeOf(convertedColour("")), func(values []string) (interface{}, error) {
+		colour, ok := colours[strings.Join(values, "")]
+		if !ok {
+			return nil, fmt.Errorf("unknown colour %q", strings.Join(values, ""))
+		}
+		return colour, nil
+	}))
+	require.NoError(t, err)
+
+	actual := &grammar{}
+	err = parser.ParseString(`colour red accent blue palette green blue`, actual)
+	require.NoError(t, err)
+	accent := convertedColour("#00f")
+	require.Equal(t, &grammar{Colour: "#f00", Accent: &accent, Palette: []convertedColour{"#0f0", "#00f"}}, actual)
+
+	err = parser.ParseString(`colour purple palette`, &grammar{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `1:7: unknown colour "purple"`)
+
+	_, err = Build(&grammar{}, Convert(nil, nil))
+	require.EqualError(t, err, "nil converter type or function")
+}
+
+type sliceRootProduction struct {
+	Name  string `parser:"@Ident \"=\""`
+	Value int    `parser:"@Int \";\""`
+}
+
+type sliceRoot []*sliceRootProduction
+
+func TestSliceRoot(t *testing.T) {
+	parser := mustTestParser(t, &sliceRoot{})
+	actual := sliceRoot{}
+	err := parser.ParseString(`a = 1; b = 2;`, &actual)
+	require.NoError(t, err)
+	require.Equal(t, sliceRoot{{Name: "a", Value: 1}, {Name: "b", Value: 2}}, actual)
+
+	actual = sliceRoot{}
+	err = parser.ParseString(``, &actual)
+	require.NoError(t, err)
+	require.Empty(t, actual)
+
+	err = parser.ParseString(`a = 1; b`, &sliceRoot{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `1:9: while parsing sliceRootProduction: expected "=" but got ""`)
+
+	require.Nil(t, parser.Verify([]string{`a = 1;`}))
+}
+
+func TestParseStringInto(t *testing.T) {
+	type grammar struct {
+		Name  string `parser:"@Ident \"=\""`
+		Value int    `parser:"@Int"`
+	}
+	parser := mustTestParser(t, &grammar{})
+	actual, err := parser.ParseStringInto(`a = 1`)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Name: "a", Value: 1}, actual)
+
+	_, err = parser.ParseStringInto(`a = b`)
+	require.Error(t, err)
+
+	slices := mustTestParser(t, &sliceRoot{})
+	actual, err = slices.ParseStringInto(`a = 1;`)
+	require.NoError(t, err)
+	require.Equal(t, &sliceRoot{{Name: "a", Value: 1}}, actual)
+}
+
+func TestConcurrentParse(t *testing.T) {
+	type Value struct {
+		Int    *int    `  @Int`
+		String *string `| @String`
+	}
+	type Entry struct {
+		Pos   lexer.Position
+		Key   string `@Ident`
+		Value *Value `[ "=" @@ ]`
+	}
+	type Config struct {
+		Entries []*Entry `{ @@ }`
+	}
+
+	parser := mustTestParser(t, &Config{})
+	coverage := parser.Coverage()
+	var wg sync.WaitGroup
+	errs := make([]error, 16)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				input := fmt.Sprintf(`a%d = %d b = "x"`, i, j)
+				actual := &Config{}
+				if err := parser.ParseString(input, actual); err != nil {
+					errs[i] = err
+					return
+				}
+				if key := fmt.Sprintf("a%d", i); actual.Entries[0].Key != key || *actual.Entries[0].Value.Int != j {
+					errs[i] = fmt.Errorf("%q parsed as %s = %d", input, actual.Entries[0].Key, *actual.Entries[0].Value.Int)
+					return
+				}
+				if err := coverage.ParseString(input, &Config{}); err != nil {
+					errs[i] = err
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+	require.Empty(t, coverage.Uncovered())
+}
+
+func TestDefaults(t *testing.T) {
+	type grammar struct {
+		Name    string  `parser:"@Ident"`
+		Port    int     `parser:"[ \":\" @Int ]" default:"80"`
+		Timeout *int    `parser:"[ \"timeout\" @Int ]" default:"30"`
+		Scheme  string  `parser:"[ \"via\" @Ident ]" default:"http"`
+		Retries int     `parser:"[ \"retries\" @Int ]"`
+		Weight  float64 `parser:"[ \"weight\" @Float ]" default:"1.5"`
+	}
+	parser := mustTestParser(t, &grammar{})
+
+	actual := &grammar{}
+	err := parser.ParseString(`host:0 timeout 5 via https retries 3 weight 2.5`, actual)
+	require.NoError(t, err)
+	timeout := 5
+	require.Equal(t, &grammar{Name: "host", Port: 0, Timeout: &timeout, Scheme: "https", Retries: 3, Weight: 2.5}, actual)
+
+	actual = &grammar{}
+	err = parser.ParseString(`host`, actual)
+	require.NoError(t, err)
+	timeout = 30
+	require.Equal(t, &grammar{Name: "host", Port: 80, Timeout: &timeout, Scheme: "http", Weight: 1.5}, actual)
+
+	type invalid struct {
+		Port int `parser:"[ @Int ]" default:"eighty"`
+	}
+	_, err = Build(&invalid{})
+	require.EqualError(t, err, `invalid: Port: invalid default "eighty"`)
+}
+
+// A lexer returning tokens from a channel, as from a tokeniser reading a network stream.
+type channelLexer struct {
+	tokens chan lexer.Token
+	peek   *lexer.Token
+}
+
+func (c *channelLexer) Peek() lexer.Token {
+	if c.peek == nil {
+		token, ok := <-c.tokens
+		if !ok {
+			token = lexer.EOFToken
+		}
+		c.peek = &token
+	}
+	return *c.peek
+}
+
+func (c *channelLexer) Next() lexer.Token {
+	token := c.Peek()
+	if !token.EOF() {
+		c.peek = nil
+	}
+	return token
+}
+
+func TestAllowTrailing(t *testing.T) {
+	type grammar struct {
+		Key   string `parser:"@Ident \"=\""`
+		Value string `parser:"@Ident"`
+	}
+	parser := mustTestParser(t, &grammar{})
+
+	input := "a = b c = d"
+	err := parser.ParseString(input, &grammar{})
+	require.Error(t, err)
+
+	consumed := 0
+	actual := &grammar{}
+	err = parser.ParseString(input, actual, AllowTrailing(&consumed))
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Key: "a", Value: "b"}, actual)
+	require.Equal(t, 5, consumed)
+
+	actual = &grammar{}
+	err = parser.ParseString(input[consumed:], actual, AllowTrailing(&consumed))
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Key: "c", Value: "d"}, actual)
+	require.Equal(t, 6, consumed)
+
+	err = parser.ParseString("a = b", &grammar{}, AllowTrailing(nil))
+	require.NoError(t, err)
+}
+
+type embeddedName struct {
+	Pos  lexer.Position
+	Name string `parser:"@Ident"`
+}
+
+func TestEmbeddedStruct(t *testing.T) {
+	type assignment struct {
+		embeddedName
+		Value int `parser:"\"=\" @Int"`
+	}
+	type call struct {
+		embeddedName
+		Args []string `parser:"\"(\" { @Ident } \")\""`
+	}
+
+	actualAssignment := &assignment{}
+	err := mustTestParser(t, &assignment{}).ParseString("a = 1", actualAssignment)
+	require.NoError(t, err)
+	require.Equal(t, &assignment{
+		embeddedName: embeddedName{Pos: lexer.Position{Line: 1, Column: 1}, Name: "a"},
+		Value:        1,
+	}, actualAssignment)
+
+	actualCall := &call{}
+	err = mustTestParser(t, &call{}).ParseString("f(x y)", actualCall)
+	require.NoError(t, err)
+	require.Equal(t, &call{
+		embeddedName: embeddedName{Pos: lexer.Position{Line: 1, Column: 1}, Name: "f"},
+		Args:         []string{"x", "y"},
+	}, actualCall)
+}
+
+func TestParseFromLexer(t *testing.T) {
+	type grammar struct {
+		Name  string `parser:"@Ident \"=\""`
+		Value int    `parser:"@Int"`
+	}
+	parser := mustTestParser(t, &grammar{})
+	tokens := make(chan lexer.Token, 3)
+	tokens <- lexer.Token{Type: scanner.Ident, Value: "a"}
+	tokens <- lexer.Token{Type: '=', Value: "="}
+	tokens <- lexer.Token{Type: scanner.Int, Value: "1"}
+	close(tokens)
+	actual := &grammar{}
+	err := parser.ParseFromLexer(&channelLexer{tokens: tokens}, actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Name: "a", Value: 1}, actual)
+
+	type verbatim struct {
+		Source string `parser:"@Ident" preserve:""`
+	}
+	parser = mustTestParser(t, &verbatim{})
+	err = parser.ParseFromLexer(&channelLexer{}, &verbatim{})
+	require.EqualError(t, err, "grammar requires the source text, which is not available from a lexer")
+}
+
+func TestParseFromLexerContext(t *testing.T) {
+	type decl struct {
+		Name uniqueSymbol `parser:"@Ident"`
+	}
+	type grammar struct {
+		Decls []*decl `parser:"{ @@ }"`
+	}
+	parser := mustTestParser(t, &grammar{})
+	lex := func(names ...string) lexer.Lexer {
+		tokens := make(chan lexer.Token, len(names))
+		for _, name := range names {
+			tokens <- lexer.Token{Type: scanner.Ident, Value: name}
+		}
+		close(tokens)
+		return &channelLexer{tokens: tokens}
+	}
+
+	ctx := context.WithValue(context.Background(), symbolTableKey{}, map[string]bool{})
+	actual := &grammar{}
+	err := parser.ParseFromLexerContext(ctx, lex("a", "b"), actual)
+	require.NoError(t, err)
+	require.Equal(t, &grammar{Decls: []*decl{{Name: "a"}, {Name: "b"}}}, actual)
+
+	ctx = context.WithValue(context.Background(), symbolTableKey{}, map[string]bool{})
+	err = parser.ParseFromLexerContext(ctx, lex("a", "a"), &grammar{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `duplicate symbol "a"`)
+}
@@ -0,0 +1,218 @@
+package participle
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PEG returns the grammar in Parsing Expression Grammar notation.
+//
+// Participle's ordered choice, optionals and repetitions are already PEG semantics, so this is
+// a faithful rendering of the grammar. Each struct type is emitted as a production named after
+// the type, preceded by a comment containing its `doc` tag, if any.
+func (p *Parser) PEG() string {
+	w := &pegWriter{seen: map[*strct]bool{}}
+	w.production(p.root)
+	return strings.Join(w.out, "\n") + "\n"
+}
+
+type pegWriter struct {
+	seen    map[*strct]bool
+	pending []*strct
+	out     []string
+}
+
+func (w *pegWriter) production(root node) {
+	if s, ok := root.(*strct); ok {
+		w.ref(s)
+	} else {
+		w.out = append(w.out, "Grammar <- "+w.node(root))
+	}
+	for len(w.pending) > 0 {
+		s := w.pending[0]
+		w.pending = w.pending[1:]
+		if s.doc != "" {
+			w.out = append(w.out, "# "+s.doc)
+		}
+		expr := w.node(s.expr)
+		if s.binary != nil {
+			ops := []string{}
+			for _, op := range s.binary.operators {
+				ops = append(ops, strconv.Quote(op))
+			}
+			operand := w.operand(s.expr)
+			expr = fmt.Sprintf("%s ((%s) %s)*", operand, strings.Join(ops, " / "), operand)
+		}
+		w.out = append(w.out, fmt.Sprintf("%s <- %s", pegName(s), expr))
+	}
+}
+
+func (w *pegWriter) ref(s *strct) string {
+	if !w.seen[s] {
+		w.seen[s] = true
+		w.pending = append(w.pending, s)
+	}
+	return pegName(s)
+}
+
+func (w *pegWriter) node(n node) string { // nolint: gocyclo
+	switch n := n.(type) {
+	case disjunction:
+		out := []string{}
+		for _, c := range n {
+			out = append(out, w.node(c))
+		}
+		return strings.Join(out, " / ")
+
+	case sequence:
+		out := []string{}
+		for _, c := range n {
+			if _, ok := c.(disjunction); ok {
+				out = append(out, "("+w.node(c)+")")
+			} else {
+				out = append(out, w.node(c))
+			}
+		}
+		return strings.Join(out, " ")
+
+	case *strct:
+		return w.ref(n)
+
+	case *parseable:
+		return n.t.Elem().Name()
+
+	case *reference:
+		return w.node(n.node)
+
+	case *unary:
+		ops := []string{}
+		for op := range n.ops {
+			ops = append(ops, strconv.Quote(op))
+		}
+		sort.Strings(ops)
+		return "(" + strings.Join(ops, " / ") + ")*"
+
+	case *path:
+		return fmt.Sprintf("Ident (%q Ident)*", n.sep)
+
+	case *keyed:
+		return fmt.Sprintf("(Ident %q .)*", n.sep)
+
+	case *factory:
+		sep := ""
+		if n.sep != "" {
+			sep = " " + strconv.Quote(n.sep)
+		}
+		out := []string{}
+		for _, discriminator := range n.discriminators() {
+			out = append(out, strconv.Quote(discriminator)+sep+" "+w.node(n.types[discriminator]))
+		}
+		return "(" + strings.Join(out, " / ") + ")"
+
+	case *lookahead:
+		return "&" + w.operand(n.node)
+
+	case *negation:
+		return "!" + w.operand(n.node) + " ."
+
+	case *atLeastOne:
+		// An and-predicate requires that at least one element can match.
+		first := []string{}
+		out := []string{}
+		for _, c := range n.elements {
+			body := c
+			if o, ok := c.(*optional); ok {
+				body = o.node
+			}
+			first = append(first, w.node(body))
+			out = append(out, w.node(c))
+		}
+		return "&(" + strings.Join(first, " / ") + ") " + strings.Join(out, " ")
+
+	case *unordered:
+		// PEG has no unordered operator, so this accepts a superset of the group.
+		out := []string{}
+		for _, c := range n.bodies {
+			out = append(out, w.node(c))
+		}
+		return "(" + strings.Join(out, " / ") + ")*"
+
+	case *labelled:
+		return w.node(n.node)
+
+	case *balanced:
+		return fmt.Sprintf("%q %s %q", n.open, w.node(n.node), n.close)
+
+	case *nested:
+		return fmt.Sprintf("(Ident (%q Ident)* \"=\" .)*", n.sep)
+
+	case *tokenReference:
+		return n.identifier
+
+	case *literal:
+		return strconv.Quote(n.s)
+
+	case *optional:
+		return w.operand(n.node) + "?"
+
+	case *repetition:
+		if n.separator == nil && n.max == 0 && n.min <= 1 {
+			if n.min == 1 {
+				return w.operand(n.node) + "+"
+			}
+			return w.operand(n.node) + "*"
+		}
+		return w.repetition(n)
+	}
+	panic(fmt.Sprintf("unsupported node type %T", n))
+}
+
+// Render a repetition with a separator or bounds, which PEG lacks, by spelling out each match,
+// eg. `{ x }2,3` as `x x x?` and `{ x % "," }` as `(x ("," x)*)?`.
+func (w *pegWriter) repetition(n *repetition) string {
+	elem := w.operand(n.node)
+	rest := elem
+	if n.separator != nil {
+		rest = "(" + w.operand(n.separator) + " " + elem + ")"
+	}
+	// The first match is not preceded by a separator.
+	out := []string{elem}
+	min := n.min
+	if min == 0 {
+		min = 1
+	}
+	for i := 1; i < min; i++ {
+		out = append(out, rest)
+	}
+	if n.max == 0 {
+		out = append(out, rest+"*")
+	}
+	for i := min; i < n.max; i++ {
+		out = append(out, rest+"?")
+	}
+	if n.trailing {
+		out = append(out, w.operand(n.separator)+"?")
+	}
+	if n.min == 0 {
+		return "(" + strings.Join(out, " ") + ")?"
+	}
+	return strings.Join(out, " ")
+}
+
+// Render a node as the operand of a postfix operator, grouping it if necessary.
+func (w *pegWriter) operand(n node) string {
+	switch n.(type) {
+	case disjunction, sequence, *negation, *atLeastOne:
+		return "(" + w.node(n) + ")"
+	}
+	return w.node(n)
+}
+
+func pegName(s *strct) string {
+	if name := s.typ.Name(); name != "" {
+		return name
+	}
+	return "Struct"
+}
@@ -25,6 +25,9 @@ func nodePrinter(seen map[reflect.Value]bool, v node) string {
 		return strings.Join(out, "|")
 
 	case *strct:
+		if n.doc != "" {
+			return fmt.Sprintf("strct(type=%s, doc=%q, expr=%s)", n.typ, n.doc, nodePrinter(seen, n.expr))
+		}
 		return fmt.Sprintf("strct(type=%s, expr=%s)", n.typ, nodePrinter(seen, n.expr))
 
 	case sequence:
@@ -37,6 +40,51 @@ func nodePrinter(seen map[reflect.Value]bool, v node) string {
 	case *reference:
 		return fmt.Sprintf("@(field=%s, node=%s)", n.field.Name, nodePrinter(seen, n.node))
 
+	case *unary:
+		return fmt.Sprintf("unary(%s)", n)
+
+	case *path:
+		return fmt.Sprintf("path(%s)", n)
+
+	case *keyed:
+		return fmt.Sprintf("keyed(%s)", n)
+
+	case *nested:
+		return fmt.Sprintf("nested(%s)", n)
+
+	case *balanced:
+		return fmt.Sprintf("balanced(%q, %s, %q)", n.open, nodePrinter(seen, n.node), n.close)
+
+	case *factory:
+		out := []string{}
+		for _, discriminator := range n.discriminators() {
+			out = append(out, fmt.Sprintf("%q=%s", discriminator, nodePrinter(seen, n.types[discriminator])))
+		}
+		return fmt.Sprintf("factory(%s, %s)", n.iface, strings.Join(out, ", "))
+
+	case *lookahead:
+		return "&" + nodePrinter(seen, n.node)
+
+	case *negation:
+		return "!" + nodePrinter(seen, n.node)
+
+	case *atLeastOne:
+		out := []string{}
+		for _, n := range n.elements {
+			out = append(out, nodePrinter(seen, n))
+		}
+		return fmt.Sprintf("^(%s)", strings.Join(out, " "))
+
+	case *unordered:
+		out := []string{}
+		for _, n := range n.elements {
+			out = append(out, nodePrinter(seen, n))
+		}
+		return fmt.Sprintf("~(%s)", strings.Join(out, " "))
+
+	case *labelled:
+		return fmt.Sprintf("%s: %s", n.label, nodePrinter(seen, n.node))
+
 	case *tokenReference:
 		return fmt.Sprintf("token(%q)", n.identifier)
 
@@ -44,7 +92,31 @@ func nodePrinter(seen map[reflect.Value]bool, v node) string {
 		return fmt.Sprintf("[%s]", nodePrinter(seen, n.node))
 
 	case *repetition:
-		return fmt.Sprintf("{ %s }", nodePrinter(seen, n.node))
+		out := nodePrinter(seen, n.node)
+		if n.separator != nil {
+			op := "%"
+			if n.trailing {
+				op = "%%"
+			}
+			out = fmt.Sprintf("%s %s %s", out, op, nodePrinter(seen, n.separator))
+		}
+		bounds := ""
+		switch {
+		case n.max == n.min && n.max > 0:
+			bounds = fmt.Sprintf("%d", n.min)
+		case n.max > 0:
+			bounds = fmt.Sprintf("%d,%d", n.min, n.max)
+		case n.min > 1 || (n.min == 1 && n.limit > 0):
+			bounds = fmt.Sprintf("%d,", n.min)
+		case n.min == 1 && n.separator == nil:
+			return fmt.Sprintf("%s+", out)
+		case n.min == 1:
+			bounds = "+"
+		}
+		if n.limit > 0 {
+			bounds += fmt.Sprintf("<%d>", n.limit)
+		}
+		return fmt.Sprintf("{ %s }%s", out, bounds)
 
 	case *literal:
 		return n.String()
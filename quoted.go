@@ -0,0 +1,43 @@
+package participle
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var quotedType = reflect.TypeOf(Quoted{})
+
+// Quoted captures a string token along with the style of quote it was written with, for tooling
+// that must reproduce its input exactly.
+//
+// Quote is the quote the token was written with, one of '"', '\'' or '`', or 0 if the token is
+// not of the lexer's String, Char or RawString types.
+type Quoted struct {
+	Value string
+	Quote rune
+}
+
+// String returns the value quoted in its original style.
+func (q Quoted) String() string {
+	switch q.Quote {
+	case '`':
+		return "`" + q.Value + "`"
+	case '\'':
+		s := strconv.Quote(q.Value)
+		s = strings.Replace(s[1:len(s)-1], `\"`, `"`, -1)
+		return "'" + strings.Replace(s, `'`, `\'`, -1) + "'"
+	}
+	return strconv.Quote(q.Value)
+}
+
+// Returns the quote style of each string token type of a lexer.
+func quoteStyles(symbols map[string]rune) map[rune]rune {
+	out := map[rune]rune{}
+	for name, quote := range map[string]rune{"String": '"', "Char": '\'', "RawString": '`'} {
+		if t, ok := symbols[name]; ok {
+			out[t] = quote
+		}
+	}
+	return out
+}
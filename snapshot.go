@@ -0,0 +1,201 @@
+package participle
+
+import "reflect"
+
+// The index of the field of the struct being parsed that each node may capture into, keyed by
+// snapshotKey, so that only that field is saved before parsing a node that may have to be undone.
+//
+// An empty index means the node captures nothing, while a nil index, including that of a node not
+// in the map, means the whole struct is saved, eg. for a node capturing into several fields.
+type snapshotFields map[interface{}][]int
+
+// Returns a comparable key for n, identifying sequences and disjunctions by their first element.
+func snapshotKey(n node) interface{} {
+	switch n := n.(type) {
+	case sequence:
+		return &n[0]
+	case disjunction:
+		return &n[0]
+	}
+	return n
+}
+
+// Identifies the fields captured into by the leading elements of a sequence that may match without
+// consuming input.
+type prefixKey struct{ first *node }
+
+// Returns the fields each node reachable from root may capture into, relative to the struct
+// whose grammar the node belongs to.
+//
+// A sequence only has to undo the captures of the leading elements that matched without consuming
+// input, so only the fields of those that may do so are saved.
+func captureFields(root node) snapshotFields {
+	out := snapshotFields{}
+	all := map[interface{}][][]int{}
+	var collect func(t reflect.Type, n node) [][]int
+	collect = func(t reflect.Type, n node) [][]int {
+		// A struct captures into a new value rather than its parent.
+		if _, ok := n.(*strct); ok {
+			return nil
+		}
+		key := snapshotKey(n)
+		if fields, ok := all[key]; ok {
+			return fields
+		}
+		all[key] = [][]int{}
+		fields := ownFields(t, n)
+		for _, child := range nodeChildren(n) {
+			fields = mergeFields(fields, collect(t, child))
+		}
+		all[key] = fields
+		out[key] = snapshotIndex(fields)
+		if seq, ok := n.(sequence); ok {
+			prefix := [][]int{}
+			for _, child := range seq {
+				if consumes(child) {
+					break
+				}
+				prefix = mergeFields(prefix, all[snapshotKey(child)])
+			}
+			out[prefixKey{&seq[0]}] = snapshotIndex(prefix)
+		}
+		return fields
+	}
+	visit(root, func(n node) {
+		if s, ok := n.(*strct); ok {
+			out[s] = []int{}
+			collect(s.typ, s.expr)
+		}
+	})
+	return out
+}
+
+// Returns the index of the field to save before parsing a node capturing into fields. Saving a
+// single copy of the whole struct is cheaper than saving several of its fields.
+func snapshotIndex(fields [][]int) []int {
+	switch len(fields) {
+	case 0:
+		return []int{}
+	case 1:
+		return fields[0]
+	}
+	return nil
+}
+
+// Returns the fields of t that n itself captures into.
+func ownFields(t reflect.Type, n node) [][]int {
+	switch n := n.(type) {
+	case *reference:
+		fields := capturedFields(t, n.field)
+		if n.positions != "" {
+			fields = appendField(fields, t, n.positions)
+		}
+		return fields
+	case *unary:
+		return capturedFields(t, n.field)
+	case *path:
+		return capturedFields(t, n.field)
+	case *keyed:
+		return capturedFields(t, n.field)
+	case *nested:
+		return capturedFields(t, n.field)
+	case *balanced:
+		return capturedFields(t, n.field)
+	case *factory:
+		return capturedFields(t, n.field)
+	case *labelled:
+		return [][]int{n.field.Index}
+	}
+	return [][]int{}
+}
+
+// Returns true if n can not match without consuming input. Nodes that may are assumed to.
+func consumes(n node) bool {
+	switch n := n.(type) {
+	case *literal, *tokenReference, *negation, *balanced, *atLeastOne:
+		return true
+	case *reference:
+		return consumes(n.node)
+	case *labelled:
+		return consumes(n.node)
+	case *repetition:
+		return n.min > 0 && consumes(n.node)
+	case sequence:
+		for _, child := range n {
+			if consumes(child) {
+				return true
+			}
+		}
+	case disjunction:
+		for _, alt := range n {
+			if !consumes(alt) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Returns the index of field, and of the field its captures are counted in, if any.
+func capturedFields(t reflect.Type, field reflect.StructField) [][]int {
+	fields := [][]int{field.Index}
+	if name, ok := field.Tag.Lookup("count"); ok {
+		fields = appendField(fields, t, name)
+	}
+	return fields
+}
+
+func appendField(fields [][]int, t reflect.Type, name string) [][]int {
+	if field, ok := t.FieldByName(name); ok {
+		return append(fields, field.Index)
+	}
+	return fields
+}
+
+// Returns fields with those of other it does not already contain appended.
+func mergeFields(fields, other [][]int) [][]int {
+next:
+	for _, index := range other {
+		for _, field := range fields {
+			if reflect.DeepEqual(field, index) {
+				continue next
+			}
+		}
+		fields = append(fields, index)
+	}
+	return fields
+}
+
+// The value of the field of a struct that a node may capture into, or of the whole struct, saved
+// before parsing the node so that its captures can be undone.
+type snapshot struct {
+	field reflect.Value
+	value reflect.Value
+}
+
+// Save the field of parent with the given key, eg. snapshotKey(n) for the field node n may capture
+// into.
+func (p *parseContext) snapshot(key interface{}, parent reflect.Value) snapshot {
+	if !parent.IsValid() {
+		return snapshot{}
+	}
+	index := p.snapshots[key]
+	field := parent
+	if index != nil {
+		if len(index) == 0 {
+			return snapshot{}
+		}
+		field = parent.FieldByIndex(index)
+	}
+	value := reflect.New(field.Type()).Elem()
+	value.Set(field)
+	return snapshot{field: field, value: value}
+}
+
+// Restore the saved value, undoing any captures made since the snapshot was taken.
+func (s snapshot) restore() {
+	if s.field.IsValid() {
+		s.field.Set(s.value)
+	}
+}
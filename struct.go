@@ -2,70 +2,139 @@ package participle
 
 import (
 	"reflect"
+	"strings"
+	"text/scanner"
 
 	"github.com/peterebden/participle/lexer"
 )
 
 // A structLexer lexes over the tags of struct fields while tracking the current field.
 type structLexer struct {
-	s     reflect.Type
-	field int
-	lexer lexer.Lexer
+	s reflect.Type
+	// The fields of s contributing to its grammar, and the index of the current one.
+	grammarFields []reflect.StructField
+	field         int
+	// The tokens of the grammar of every field, with any macros expanded, and the index of the
+	// field each belongs to.
+	tokens []lexer.Token
+	fields []int
+	cursor int
 }
 
-func lexStruct(s reflect.Type) *structLexer {
-	return &structLexer{
-		s:     s,
-		lexer: lexer.LexString(fieldLexerTag(s.Field(0))),
+func lexStruct(s reflect.Type, macros macros) *structLexer {
+	out := &structLexer{s: s, grammarFields: grammarFields(s)}
+	for i, field := range out.grammarFields {
+		for _, token := range lexTag(field, macros) {
+			token.Pos.Line = i + 1
+			out.tokens = append(out.tokens, token)
+			out.fields = append(out.fields, i)
+		}
+	}
+	return out
+}
+
+// Lex the grammar of field, expanding any macros.
+//
+// The grammar may contain comments, either /* ... */ or from # to the end of the line.
+func lexTag(field reflect.StructField, macros macros) (tokens []lexer.Token) {
+	defer decorate(field.Name)
+	lex := lexer.LexString(macros.expand(stripComments(fieldLexerTag(field)), 0))
+	for token := lex.Next(); !token.EOF(); token = lex.Next() {
+		tokens = append(tokens, token)
 	}
+	return tokens
 }
 
-// NumField returns the number of fields in the struct associated with this structLexer.
+// NumField returns the number of fields contributing to the grammar of the struct associated with
+// this structLexer.
 func (s *structLexer) NumField() int {
-	return s.s.NumField()
+	return len(s.grammarFields)
 }
 
 // Field returns the field associated with the current token.
 func (s *structLexer) Field() reflect.StructField {
-	return s.s.Field(s.field)
+	return s.grammarFields[s.field]
 }
 
 func (s *structLexer) Peek() lexer.Token {
-	field := s.field
-	lex := s.lexer
-	for {
-		token := lex.Peek()
-		if !token.EOF() {
-			token.Pos.Line = field + 1
-			return token
+	if s.cursor >= len(s.tokens) {
+		return lexer.EOFToken
+	}
+	return s.tokens[s.cursor]
+}
+
+func (s *structLexer) Next() lexer.Token {
+	if s.cursor >= len(s.tokens) {
+		// The end of the grammar belongs to the last field.
+		if s.NumField() > 0 {
+			s.field = s.NumField() - 1
 		}
-		field++
-		if field >= s.s.NumField() {
-			return lexer.EOFToken
+		return lexer.EOFToken
+	}
+	token := s.tokens[s.cursor]
+	s.field = s.fields[s.cursor]
+	s.cursor++
+	return token
+}
+
+// Returns the fields of s contributing to its grammar, in declaration order. The fields of
+// untagged embedded structs take the place of the embedded struct, so that a struct embedded in
+// several productions contributes its grammar to each, with indexes relative to s.
+func grammarFields(s reflect.Type) []reflect.StructField {
+	out := []reflect.StructField{}
+	for i := 0; i < s.NumField(); i++ {
+		field := s.Field(i)
+		if field.Anonymous && field.Tag == "" && field.Type.Kind() == reflect.Struct && field.Type != positionType {
+			for _, embedded := range grammarFields(field.Type) {
+				embedded.Index = append([]int{i}, embedded.Index...)
+				out = append(out, embedded)
+			}
+			continue
 		}
-		tag := fieldLexerTag(s.s.Field(field))
-		lex = lexer.LexString(tag)
+		out = append(out, field)
 	}
+	return out
 }
 
-func (s *structLexer) Next() lexer.Token {
-	token := s.lexer.Next()
-	if !token.EOF() {
-		token.Pos.Line = s.field + 1
-		return token
+// Remove the # comments from a grammar, leaving any # within quoted literals.
+//
+// /* ... */ comments are skipped when the grammar is lexed.
+func stripComments(tag string) string {
+	if !strings.Contains(tag, "#") {
+		return tag
 	}
-	if s.field+1 >= s.s.NumField() {
-		return lexer.EOFToken
+	out := ""
+	last := 0
+	s := newTagScanner(tag)
+	for token := s.Scan(); token != scanner.EOF; token = s.Scan() {
+		if token != '#' {
+			continue
+		}
+		out += tag[last:s.Position.Offset]
+		// Skip the comment by character, as it need not consist of valid tokens, eg. "don't".
+		for s.Peek() != '\n' && s.Peek() != scanner.EOF {
+			s.Next()
+		}
+		last = s.Pos().Offset
 	}
-	s.field++
-	tag := fieldLexerTag(s.s.Field(s.field))
-	s.lexer = lexer.LexString(tag)
-	return s.Next()
+	return out + tag[last:]
 }
 
 func fieldLexerTag(field reflect.StructField) string {
 	if tag := field.Tag.Get("parser"); tag != "" {
 		return tag
 	}
+	// Fields tagged with one of these keys have their grammar generated.
+	for _, key := range []string{"unary", "path", "keys", "nested", "balanced", "factory"} {
+		if _, ok := field.Tag.Lookup(key); ok {
+			return "@@"
+		}
+	}
+	// Documentation, macro definitions or binary operators only, eg. `_ struct{} doc:"..."`.
+	for _, key := range []string{"doc", "macro", "binary"} {
+		if _, ok := field.Tag.Lookup(key); ok {
+			return ""
+		}
+	}
 	return string(field.Tag)
 }
@@ -16,7 +16,7 @@ func TestStructLexerTokens(t *testing.T) {
 		B string `34`
 	}
 
-	scan := lexStruct(reflect.TypeOf(testScanner{}))
+	scan := lexStruct(reflect.TypeOf(testScanner{}), nil)
 	t12 := lexer.Token{Type: scanner.Int, Value: "12", Pos: lexer.Position{Line: 1, Column: 1}}
 	t34 := lexer.Token{Type: scanner.Int, Value: "34", Pos: lexer.Position{Line: 2, Column: 1}}
 	assert.Equal(t, t12, scan.Peek())
@@ -38,7 +38,7 @@ func TestStructLexer(t *testing.T) {
 	}{}
 
 	gt := reflect.TypeOf(g)
-	r := lexStruct(gt)
+	r := lexStruct(gt, nil)
 	f := []reflect.StructField{}
 	s := ""
 	for {
@@ -55,3 +55,17 @@ func TestStructLexer(t *testing.T) {
 	f1 := gt.Field(1)
 	assert.Equal(t, []reflect.StructField{f0, f0, f1}, f)
 }
+
+func TestStructLexerComments(t *testing.T) {
+	type grammar struct {
+		A string `parser:"@Ident /* the name */ \"#\" # followed by a hash, isn't it?\n @Int # and a number"`
+		B string `parser:"# only a comment"`
+	}
+
+	r := lexStruct(reflect.TypeOf(grammar{}), nil)
+	values := []string{}
+	for token := r.Next(); !token.EOF(); token = r.Next() {
+		values = append(values, token.Value)
+	}
+	assert.Equal(t, []string{"@", "Ident", "#", "@", "Int"}, values)
+}
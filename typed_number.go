@@ -0,0 +1,109 @@
+package participle
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Types selected by numeric suffixes.
+var numberSuffixTypes = map[string]reflect.Type{
+	"i":   reflect.TypeOf(int(0)),
+	"i8":  reflect.TypeOf(int8(0)),
+	"i16": reflect.TypeOf(int16(0)),
+	"i32": reflect.TypeOf(int32(0)),
+	"i64": reflect.TypeOf(int64(0)),
+	"u":   reflect.TypeOf(uint(0)),
+	"u8":  reflect.TypeOf(uint8(0)),
+	"u16": reflect.TypeOf(uint16(0)),
+	"u32": reflect.TypeOf(uint32(0)),
+	"u64": reflect.TypeOf(uint64(0)),
+	"f32": reflect.TypeOf(float32(0)),
+	"f64": reflect.TypeOf(float64(0)),
+}
+
+// TypedNumber captures a numeric literal with an optional suffix selecting its type, eg. 10i8,
+// 3.0f32 or 5u.
+//
+// The suffixes i, i8, i16, i32 and i64 select signed integers, u, u8, u16, u32 and u64 unsigned
+// integers, and f32 and f64 floats. Value holds the magnitude converted to the selected type, or
+// an int64 or float64 if there is no suffix. A magnitude that does not fit its type is an error.
+//
+// The lexer must produce each suffixed literal as a single token.
+type TypedNumber struct {
+	Value  interface{}
+	Suffix string
+}
+
+// Capture implements Capture.
+func (n *TypedNumber) Capture(values []string) error {
+	literal := strings.Join(values, "")
+	magnitude, suffix := splitNumberSuffix(literal)
+	t, ok := numberSuffixTypes[suffix]
+	if !ok {
+		t = reflect.TypeOf(int64(0))
+		if isFloatLiteral(magnitude) {
+			t = reflect.TypeOf(float64(0))
+		}
+	}
+	v := reflect.New(t).Elem()
+	var err error
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		if i, err = strconv.ParseInt(magnitude, 0, t.Bits()); err == nil {
+			v.SetInt(i)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var u uint64
+		if u, err = strconv.ParseUint(magnitude, 0, t.Bits()); err == nil {
+			v.SetUint(u)
+		}
+	default:
+		var f float64
+		if f, err = strconv.ParseFloat(magnitude, t.Bits()); err == nil {
+			v.SetFloat(f)
+		}
+	}
+	if err != nil {
+		if numErr, ok := err.(*strconv.NumError); ok && numErr.Err == strconv.ErrRange {
+			return fmt.Errorf("%s overflows %s", literal, t)
+		}
+		return fmt.Errorf("invalid %s literal %q", t, literal)
+	}
+	n.Value = v.Interface()
+	n.Suffix = suffix
+	return nil
+}
+
+// String returns the number as a literal, with its suffix.
+func (n TypedNumber) String() string {
+	return fmt.Sprint(n.Value) + n.Suffix
+}
+
+// Split a literal into its magnitude and type suffix, if any.
+func splitNumberSuffix(literal string) (magnitude, suffix string) {
+	hex := strings.HasPrefix(literal, "0x") || strings.HasPrefix(literal, "0X")
+	for i := len(literal) - 1; i > 0; i-- {
+		c := literal[i]
+		if c >= '0' && c <= '9' {
+			continue
+		}
+		// Floats can not be written in hex, where f is a digit.
+		if c == 'i' || c == 'u' || (c == 'f' && !hex) {
+			if _, ok := numberSuffixTypes[literal[i:]]; ok {
+				return literal[:i], literal[i:]
+			}
+		}
+		break
+	}
+	return literal, ""
+}
+
+func isFloatLiteral(literal string) bool {
+	if strings.HasPrefix(literal, "0x") || strings.HasPrefix(literal, "0X") {
+		return false
+	}
+	return strings.ContainsAny(literal, ".eE")
+}
@@ -0,0 +1,76 @@
+package participle
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// A Sample is an input to Parser.VerifySamples, along with whether the grammar should reject it.
+type Sample struct {
+	Input  string
+	Reject bool
+}
+
+// Verify parses each input into a new value of the grammar's type, as a quick check that the
+// grammar accepts a corpus of samples.
+//
+// If every input parses, nil is returned. Otherwise the returned slice holds the error, if any,
+// for the input at the same index.
+func (p *Parser) Verify(inputs []string, options ...ParseOption) []error {
+	samples := make([]Sample, len(inputs))
+	for i, input := range inputs {
+		samples[i] = Sample{Input: input}
+	}
+	return p.VerifySamples(samples, options...)
+}
+
+// VerifySamples is like Verify, but checks that samples marked with Reject fail to parse.
+//
+// A rejected sample that parses results in an error, while the parse error of a rejected
+// sample that fails as expected is discarded.
+func (p *Parser) VerifySamples(samples []Sample, options ...ParseOption) []error {
+	errs := make([]error, len(samples))
+	failed := false
+	for i, sample := range samples {
+		err := p.Check(sample.Input, options...)
+		switch {
+		case sample.Reject && err == nil:
+			err = fmt.Errorf("sample %d: expected input to be rejected: %q", i, sample.Input)
+		case sample.Reject:
+			err = nil
+		}
+		if err != nil {
+			errs[i] = err
+			failed = true
+		}
+	}
+	if !failed {
+		return nil
+	}
+	return errs
+}
+
+// Check parses sample into a new value of the grammar's type, which is discarded, returning any
+// error, eg. as a sanity check when a parser is built at init time:
+//
+//     var parser = participle.MustBuild(&Grammar{})
+//
+//     func init() {
+//         if err := parser.Check(`a = 1`); err != nil {
+//             panic(err)
+//         }
+//     }
+func (p *Parser) Check(sample string, options ...ParseOption) error {
+	return p.ParseString(sample, reflect.New(p.rootType()).Interface(), options...)
+}
+
+// Returns the type of the grammar the parser was built from.
+func (p *Parser) rootType() reflect.Type {
+	if p.rootSlice != nil {
+		return p.rootSlice
+	}
+	if n, ok := p.root.(*parseable); ok {
+		return n.t.Elem()
+	}
+	return p.root.(*strct).typ
+}
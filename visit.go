@@ -0,0 +1,100 @@
+package participle
+
+// Call fn once for every node reachable from n, in depth-first order.
+func visit(n node, fn func(n node)) {
+	seen := map[node]bool{}
+	var walk func(n node)
+	walk = func(n node) {
+		if n == nil {
+			return
+		}
+		if key, ok := nodeKey(n); ok {
+			if seen[key] {
+				return
+			}
+			seen[key] = true
+		}
+		fn(n)
+		for _, child := range nodeChildren(n) {
+			walk(child)
+		}
+	}
+	walk(n)
+}
+
+// Returns a comparable key for nodes that may be shared or recursive.
+func nodeKey(n node) (node, bool) {
+	switch n.(type) {
+	case disjunction, sequence:
+		return nil, false
+	}
+	return n, true
+}
+
+// Returns the direct children of n.
+func nodeChildren(n node) []node {
+	switch n := n.(type) {
+	case disjunction:
+		return n
+	case sequence:
+		return n
+	case *strct:
+		return []node{n.expr}
+	case *reference:
+		return []node{n.node}
+	case *optional:
+		return []node{n.node}
+	case *repetition:
+		if n.separator != nil {
+			return []node{n.node, n.separator}
+		}
+		return []node{n.node}
+	case *balanced:
+		return []node{n.node}
+	case *labelled:
+		return []node{n.node}
+	case *unordered:
+		return n.elements
+	case *atLeastOne:
+		return n.elements
+	case *negation:
+		return []node{n.node}
+	case *lookahead:
+		return []node{n.node}
+	case *factory:
+		out := []node{}
+		for _, discriminator := range n.discriminators() {
+			out = append(out, n.types[discriminator])
+		}
+		return out
+	}
+	return nil
+}
+
+// Like visit, but also passes fn the name of the production enclosing each node.
+func visitProductions(root node, fn func(production string, n node)) {
+	production := ""
+	seen := map[node]bool{}
+	var walk func(n node)
+	walk = func(n node) {
+		if n == nil {
+			return
+		}
+		if key, ok := nodeKey(n); ok {
+			if seen[key] {
+				return
+			}
+			seen[key] = true
+		}
+		if s, ok := n.(*strct); ok {
+			outer := production
+			production = pegName(s)
+			defer func() { production = outer }()
+		}
+		fn(production, n)
+		for _, child := range nodeChildren(n) {
+			walk(child)
+		}
+	}
+	walk(root)
+}